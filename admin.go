@@ -0,0 +1,305 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+)
+
+// accounts and sharing are managed from the command line with the user, album and stats commands, which go through
+// the same functions as the web pages (newUser, newAlbum, grantRole) so the rules are the same either way:
+//
+//	user create -email e [-password p]	user list	user disable|enable|delete <email>	user password <email> [-password p]
+//	user app-password -name n <email>
+//	album create -user e <name>	album grant -album id -user e [-role viewer|contributor]	album revoke -album id -user e
+//	album chown -album id -user e [-photos]	stats
+
+// userInfo is a user as listed by user list
+type userInfo struct {
+	ID         int64
+	Email      string
+	Disabled   bool
+	Albums     int
+	Photos     int
+	Bytes      int64
+	QuotaBytes sql.NullInt64
+}
+
+// returns a password for accounts made without one
+func randomPassword() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate password: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// finds the id of the user with the given email
+func lookupUser(email string, tx *sql.Tx) (int64, error) {
+	id, _, err := store.WithTx(tx).UserByEmail(email)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("there's no user %s", email)
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to find user %s: %w", email, err)
+	}
+	return id, nil
+}
+
+func listUsers(db *sql.DB) ([]userInfo, error) {
+	rows, err := db.Query("SELECT id, email, disabled_at IS NOT NULL, quota_bytes, " +
+		"(SELECT COUNT(*) FROM albums WHERE albums.user_id = users.id AND trashed_at IS NULL), " +
+		"(SELECT COUNT(*) FROM photos WHERE photos.user_id = users.id AND trashed_at IS NULL), " +
+		"(SELECT COALESCE(SUM(size), 0) FROM photos WHERE photos.user_id = users.id) " +
+		"FROM users ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get users: %w", err)
+	}
+	defer rows.Close()
+	users := make([]userInfo, 0)
+	for rows.Next() {
+		var u userInfo
+		if err := rows.Scan(&u.ID, &u.Email, &u.Disabled, &u.QuotaBytes, &u.Albums, &u.Photos, &u.Bytes); err != nil {
+			return nil, fmt.Errorf("failed to scan user: %w", err)
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// revokePerm takes a user's permission to an album away. The owner's can't be, it has to be given to someone else
+// with chownAlbum first
+func revokePerm(albumID int64, userID int64, tx *sql.Tx) error {
+	if checkOwner(albumID, userID, tx) {
+		return fmt.Errorf("user %v owns album %v", userID, albumID)
+	}
+	if !checkPerm(albumID, userID, tx) {
+		return fmt.Errorf("user %v doesn't have permission to album %v", userID, albumID)
+	}
+	return store.WithTx(tx).RevokePermission(albumID, userID)
+}
+
+// chownAlbum gives an album to another user, who becomes a contributor if they weren't one. The previous owner stays
+// a contributor. Photos belong to whoever uploaded them and count towards their quota, so with photos set the ones
+// the previous owner uploaded to the album go to the new owner as well, and stay in the album if the previous owner
+// is deleted
+func chownAlbum(albumID int64, userID int64, photos bool, tx *sql.Tx) error {
+	previous, err := store.WithTx(tx).AlbumOwner(albumID)
+	if err != nil {
+		return err
+	}
+	if previous == userID {
+		return fmt.Errorf("user %v already owns album %v", userID, albumID)
+	}
+	if err := store.WithTx(tx).SetAlbumOwner(albumID, userID); err != nil {
+		return err
+	}
+	contributor, err := store.WithTx(tx).HasRole(albumID, userID, "contributor")
+	if err != nil {
+		return err
+	}
+	if !contributor {
+		if err := store.WithTx(tx).RevokePermission(albumID, userID); err != nil {
+			return err
+		}
+		if err := givePerm(albumID, userID, tx); err != nil {
+			return err
+		}
+	}
+	if photos {
+		_, err := tx.Exec("UPDATE photos SET user_id = ? WHERE user_id = ? AND id IN (SELECT photo_id FROM album_photos WHERE album_id = ?)",
+			userID, previous, albumID)
+		if err != nil {
+			return fmt.Errorf("failed to give photos in album %v to user %v: %w", albumID, userID, err)
+		}
+	}
+	return nil
+}
+
+// appStats is what stats prints
+type appStats struct {
+	Users, DisabledUsers     int
+	Albums, TrashedAlbums    int
+	Photos, TrashedPhotos    int
+	BrokenPhotos, Sessions   int
+	PhotoBytes, StoredBytes  int64
+	TotalFiles, PendingFiles int
+}
+
+func collectStats(db *sql.DB) (appStats, error) {
+	var s appStats
+	err := db.QueryRow("SELECT "+
+		"(SELECT COUNT(*) FROM users), (SELECT COUNT(*) FROM users WHERE disabled_at IS NOT NULL), "+
+		"(SELECT COUNT(*) FROM albums WHERE trashed_at IS NULL), (SELECT COUNT(*) FROM albums WHERE trashed_at IS NOT NULL), "+
+		"(SELECT COUNT(*) FROM photos WHERE trashed_at IS NULL), (SELECT COUNT(*) FROM photos WHERE trashed_at IS NOT NULL), "+
+		"(SELECT COUNT(*) FROM photos WHERE broken IS NOT NULL), (SELECT COUNT(*) FROM sessions), "+
+		"(SELECT COALESCE(SUM(size), 0) FROM photos), "+
+		"(SELECT COALESCE(SUM(size), 0) FROM (SELECT MAX(size) AS size FROM photos WHERE path IS NOT NULL GROUP BY path) AS files), "+
+		"(SELECT COUNT(DISTINCT path) FROM photos), (SELECT COUNT(*) FROM file_cleanup)").
+		Scan(&s.Users, &s.DisabledUsers, &s.Albums, &s.TrashedAlbums, &s.Photos, &s.TrashedPhotos,
+			&s.BrokenPhotos, &s.Sessions, &s.PhotoBytes, &s.StoredBytes, &s.TotalFiles, &s.PendingFiles)
+	if err != nil {
+		return s, fmt.Errorf("failed to collect stats: %w", err)
+	}
+	return s, nil
+}
+
+func (s appStats) String() string {
+	return fmt.Sprintf("users: %v (%v disabled)\nalbums: %v (%v in the trash)\nphotos: %v (%v in the trash, %v broken)\n"+
+		"sessions: %v\nphoto bytes: %v\nstored: %v bytes in %v files, %v waiting to be removed\n",
+		s.Users, s.DisabledUsers, s.Albums, s.TrashedAlbums, s.Photos, s.TrashedPhotos, s.BrokenPhotos,
+		s.Sessions, s.PhotoBytes, s.StoredBytes, s.TotalFiles, s.PendingFiles)
+}
+
+func userCommand(args []string, db *sql.DB) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: user create|list|disable|enable|delete|password|app-password")
+	}
+	fs := flag.NewFlagSet("user "+args[0], flag.ExitOnError)
+	email := fs.String("email", "", "email of the new user")
+	password := fs.String("password", "", "password to set, a random one is printed if not given")
+	name := fs.String("name", "", "what an app password is for")
+	fs.Parse(args[1:])
+
+	// create and password print the password they set if it wasn't given
+	setPassword := func() (string, error) {
+		if *password != "" {
+			return *password, nil
+		}
+		p, err := randomPassword()
+		if err == nil {
+			fmt.Printf("password: %s\n", p)
+		}
+		return p, err
+	}
+
+	switch args[0] {
+	case "create":
+		if *email == "" {
+			return fmt.Errorf("usage: user create -email e [-password p]")
+		}
+		p, err := setPassword()
+		if err != nil {
+			return err
+		}
+		return inTx(db, func(tx *sql.Tx) error {
+			id, err := newUser(*email, p, tx)
+			if err == nil {
+				fmt.Printf("created user %v\n", id)
+			}
+			return err
+		})
+	case "list":
+		users, err := listUsers(db)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "id\temail\talbums\tphotos\tbytes\tquota\t")
+		for _, u := range users {
+			quota := "default"
+			if u.QuotaBytes.Valid {
+				quota = strconv.FormatInt(u.QuotaBytes.Int64, 10)
+			}
+			email := u.Email
+			if u.Disabled {
+				email += " (disabled)"
+			}
+			fmt.Fprintf(tw, "%v\t%s\t%v\t%v\t%v\t%s\t\n", u.ID, email, u.Albums, u.Photos, u.Bytes, quota)
+		}
+		return tw.Flush()
+	case "disable", "enable", "delete", "password", "app-password":
+		if fs.NArg() != 1 {
+			return fmt.Errorf("usage: user %s <email>", args[0])
+		}
+		return inTx(db, func(tx *sql.Tx) error {
+			id, err := lookupUser(fs.Arg(0), tx)
+			if err != nil {
+				return err
+			}
+			s := store.WithTx(tx)
+			switch args[0] {
+			case "disable":
+				return s.SetDisabled(id, true)
+			case "enable":
+				return s.SetDisabled(id, false)
+			case "delete":
+				return s.DeleteUser(id)
+			case "app-password":
+				p, err := newAppPassword(id, *name, tx)
+				if err == nil {
+					fmt.Printf("app password: %s\n", p)
+				}
+				return err
+			}
+			p, err := setPassword()
+			if err != nil {
+				return err
+			}
+			hashed, err := hashPassword(p)
+			if err != nil {
+				return err
+			}
+			return s.SetPassword(id, hashed)
+		})
+	default:
+		return fmt.Errorf("unknown user command %q", args[0])
+	}
+}
+
+func albumCommand(args []string, db *sql.DB) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: album create|grant|revoke|chown")
+	}
+	fs := flag.NewFlagSet("album "+args[0], flag.ExitOnError)
+	albumID := fs.Int64("album", 0, "id of the album")
+	email := fs.String("user", "", "email of the user")
+	role := fs.String("role", "contributor", "viewer or contributor")
+	photos := fs.Bool("photos", false, "also give the new owner the photos the previous owner put in the album")
+	fs.Parse(args[1:])
+	if *email == "" || (args[0] == "create") != (*albumID == 0) {
+		return fmt.Errorf("usage: album create -user e <name> | album grant|revoke|chown -album id -user e")
+	}
+
+	return inTx(db, func(tx *sql.Tx) error {
+		id, err := lookupUser(*email, tx)
+		if err != nil {
+			return err
+		}
+		switch args[0] {
+		case "create":
+			if fs.NArg() != 1 {
+				return fmt.Errorf("usage: album create -user e <name>")
+			}
+			created, err := newAlbum(fs.Arg(0), id, tx)
+			if err == nil {
+				fmt.Printf("created album %v\n", created)
+			}
+			return err
+		case "grant":
+			return grantRole(*albumID, id, *role, tx)
+		case "revoke":
+			return revokePerm(*albumID, id, tx)
+		case "chown":
+			return chownAlbum(*albumID, id, *photos, tx)
+		default:
+			return fmt.Errorf("unknown album command %q", args[0])
+		}
+	})
+}
+
+func statsCommand(args []string, db *sql.DB) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	fs.Parse(args)
+
+	s, err := collectStats(db)
+	if err != nil {
+		return err
+	}
+	fmt.Print(s)
+	return nil
+}
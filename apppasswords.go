@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apps that can't log in through the login page, like WebDAV clients, use app passwords instead:
+// app_passwords: id!|user_id|name|token_hash|created_at|last_used_at. They're sent either as the password of HTTP
+// basic auth along with the user's email, or on their own as a bearer token for scripts. They're random enough that a
+// sha256 of one is as good as a bcrypt hash and can be looked up directly
+
+type appPasswordInfo struct {
+	ID         int64
+	Name       string
+	CreatedAt  string
+	LastUsedAt string
+}
+
+type apppasswordspage struct {
+	UserID    int64
+	Passwords []appPasswordInfo
+	// the password just made, which is only ever shown this once
+	New string
+}
+
+func (a apppasswordspage) render(w http.ResponseWriter) error {
+	return templates.ExecuteTemplate(w, "apppasswords.html", a)
+}
+
+func hashAppPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAppPassword makes an app password for userID and returns it
+func newAppPassword(userID int64, name string, tx *sql.Tx) (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate app password: %w", err)
+	}
+	password := base64.RawURLEncoding.EncodeToString(b)
+	if name == "" {
+		name = "app password"
+	}
+	if _, err := tx.Exec("INSERT INTO app_passwords (user_id, name, token_hash) VALUES (?, ?, ?)", userID, name, hashAppPassword(password)); err != nil {
+		return "", fmt.Errorf("failed to save app password: %w", err)
+	}
+	return password, nil
+}
+
+// appPasswordTouch is how out of date the last use of an app password can get, so that clients sending a lot of
+// requests don't each take the write connection just to record it
+const appPasswordTouch = 5 * time.Minute
+
+// appPasswordUser returns the user the request's app password belongs to, from basic auth or a bearer token. It's
+// looked up through readDB, and its last use is recorded through db if it's more than appPasswordTouch old
+func appPasswordUser(r *http.Request, readDB *sql.DB, db *sql.DB) (int64, error) {
+	query := "SELECT app_passwords.id, users.id, COALESCE(app_passwords.last_used_at, '') FROM app_passwords " +
+		"JOIN users ON users.id = app_passwords.user_id WHERE token_hash = ? AND users.disabled_at IS NULL"
+	var args []interface{}
+	if email, password, ok := r.BasicAuth(); ok {
+		query += " AND users.email = ?"
+		args = []interface{}{hashAppPassword(password), email}
+	} else if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		args = []interface{}{hashAppPassword(strings.TrimSpace(token))}
+	} else {
+		return 0, fmt.Errorf("no app password given")
+	}
+	var id, userID int64
+	var lastUsed string
+	if err := readDB.QueryRow(query, args...).Scan(&id, &userID, &lastUsed); err != nil {
+		return 0, fmt.Errorf("failed to find app password: %w", err)
+	}
+	now := time.Now().UTC()
+	if used, err := time.Parse(timeLayout, lastUsed); err != nil || now.Sub(used) > appPasswordTouch {
+		if _, err := db.Exec("UPDATE app_passwords SET last_used_at = ? WHERE id = ?", now.Format(timeLayout), id); err != nil {
+			log.Printf("failed to record use of app password %v: %s", id, err)
+		}
+	}
+	return userID, nil
+}
+
+// lists the session user's app passwords (GET), makes one with the POSTed name, or revokes the one with the POSTed
+// revoke id
+func appPasswordsHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	userID, err := checkSesh(w, r, db)
+	if err != nil {
+		log.Printf("failed to validate user session: %s", err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("failed to begin transaction: %s", err)
+		return
+	}
+	defer tx.Rollback()
+
+	a := apppasswordspage{UserID: userID, Passwords: make([]appPasswordInfo, 0)}
+	if r.Method == http.MethodPost {
+		if revoke := r.PostFormValue("revoke"); revoke != "" {
+			id, _ := strconv.ParseInt(revoke, 10, 64)
+			if _, err := tx.Exec("DELETE FROM app_passwords WHERE id = ? AND user_id = ?", id, userID); err != nil {
+				log.Printf("failed to revoke app password %v: %s", id, err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		} else if a.New, err = newAppPassword(userID, r.PostFormValue("name"), tx); err != nil {
+			log.Printf("%s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	rows, err := tx.Query("SELECT id, name, created_at, COALESCE(last_used_at, '') FROM app_passwords WHERE user_id = ? ORDER BY id", userID)
+	if err != nil {
+		log.Printf("failed to get app passwords: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for rows.Next() {
+		var p appPasswordInfo
+		if err := rows.Scan(&p.ID, &p.Name, &p.CreatedAt, &p.LastUsedAt); err != nil {
+			rows.Close()
+			log.Printf("failed to scan app password: %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		a.Passwords = append(a.Passwords, p)
+	}
+	rows.Close()
+	if err := tx.Commit(); err != nil {
+		log.Printf("%s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := a.render(w); err != nil {
+		log.Printf("failed to render html: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,615 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// a backup directory holds snapshots, each a directory named after the time it was taken, like
+// 20261019T150405.000Z, with a copy of the database made through SQLite's online backup API and a manifest.json
+// listing the photo files it refers to. The files themselves are kept once in blobs/, named after the sha256 of
+// their bytes, and shared between snapshots. Stored files never change once written, so a file with the same path,
+// size and modification time as in the previous snapshot is taken to be the same blob and only new files are
+// copied. Each copy is checked against the checksum taken at upload before the snapshot counts, except for encrypted
+// photos when the server doesn't have their master key: backups copy the encrypted bytes and don't need it. A
+// snapshot is built under a .partial name and only renamed into place once complete. Backing up, restoring and
+// pruning hold an flock on .lock in the backup directory, so a prune never takes the snapshot or new blobs of a backup
+// that's still going on, or the snapshot being restored
+
+const (
+	backupTimeLayout = "20060102T150405.000Z"
+	backupDBName     = "photoApp.db"
+	backupManifest   = "manifest.json"
+	backupBlobs      = "blobs"
+	backupLock       = ".lock"
+)
+
+// backupDir is where backups go, set by -backup-dir
+var backupDir string
+
+// snapshotManifest is what manifest.json holds
+type snapshotManifest struct {
+	Created  time.Time    `json:"created"`
+	Database string       `json:"database"` // sha256 of the database copy
+	Files    []backupFile `json:"files"`
+	// paths the database refers to that couldn't be backed up, because the file was missing or corrupt
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+type backupFile struct {
+	Path    string    `json:"path"`
+	Blob    string    `json:"blob"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// backupReport says what a backup did
+type backupReport struct {
+	Snapshot string
+	Files    int   // files in the snapshot
+	Copied   int   // files that weren't in an earlier snapshot
+	Bytes    int64 // bytes copied
+	Skipped  int
+}
+
+func (r backupReport) String() string {
+	return fmt.Sprintf("snapshot %s: %v files, %v new (%s), %v skipped", r.Snapshot, r.Files, r.Copied, formatBytes(r.Bytes), r.Skipped)
+}
+
+// copyDatabase copies src into dst with SQLite's online backup API. src is read as one consistent snapshot, and
+// writers carry on meanwhile since the database is in WAL mode
+func copyDatabase(dst *sql.DB, src *sql.DB) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	dstConn, err := dst.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get connection: %w", err)
+	}
+	defer dstConn.Close()
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get connection: %w", err)
+	}
+	defer srcConn.Close()
+
+	return dstConn.Raw(func(dstDriver any) error {
+		return srcConn.Raw(func(srcDriver any) error {
+			d, ok := dstDriver.(*sqlite3.SQLiteConn)
+			s, ok2 := srcDriver.(*sqlite3.SQLiteConn)
+			if !ok || !ok2 {
+				return fmt.Errorf("backups need an SQLite database")
+			}
+			b, err := d.Backup("main", s, "main")
+			if err != nil {
+				return fmt.Errorf("failed to start backup: %w", err)
+			}
+			if _, err := b.Step(-1); err != nil {
+				b.Finish()
+				return fmt.Errorf("failed to copy database: %w", err)
+			}
+			return b.Finish()
+		})
+	})
+}
+
+// hashFile returns the hex encoded sha256 of the bytes of the file at p
+func hashFile(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// copies the file at p into blobs, named after the sha256 of its bytes, and returns the hash and the size
+func storeBlob(blobs string, p string) (string, int64, error) {
+	src, err := os.Open(p)
+	if err != nil {
+		return "", 0, err
+	}
+	defer src.Close()
+	tmp, err := os.CreateTemp(blobs, ".incoming-*")
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), src)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to copy %s: %w", p, err)
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if err := os.Rename(tmp.Name(), filepath.Join(blobs, sum)); err != nil {
+		return "", 0, fmt.Errorf("failed to move blob into place: %w", err)
+	}
+	return sum, n, nil
+}
+
+// returns the names of the complete snapshots in dir, oldest first
+func listSnapshots(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+	names := make([]string, 0)
+	for _, e := range entries {
+		if _, err := time.Parse(backupTimeLayout, e.Name()); e.IsDir() && err == nil {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func readManifest(snapshot string) (snapshotManifest, error) {
+	var m snapshotManifest
+	b, err := os.ReadFile(filepath.Join(snapshot, backupManifest))
+	if err != nil {
+		return m, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return m, fmt.Errorf("failed to parse manifest of %s: %w", snapshot, err)
+	}
+	return m, nil
+}
+
+// lockBackupDir waits for the lock on dir and returns a function releasing it. The lock goes away with the process
+// holding it, so a backup that crashed doesn't leave dir locked
+func lockBackupDir(dir string) (func(), error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create backup directory: %w", err)
+	}
+	f, err := os.OpenFile(filepath.Join(dir, backupLock), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open backup lock: %w", err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock backup directory: %w", err)
+	}
+	return func() { f.Close() }, nil
+}
+
+// backup takes a snapshot of db and the photo files it refers to in dir
+func backup(db *sql.DB, dir string) (backupReport, error) {
+	report := backupReport{}
+	unlock, err := lockBackupDir(dir)
+	if err != nil {
+		return report, err
+	}
+	defer unlock()
+	blobs := filepath.Join(dir, backupBlobs)
+	if err := os.MkdirAll(blobs, 0700); err != nil {
+		return report, fmt.Errorf("failed to create backup directory: %w", err)
+	}
+	created := time.Now().UTC()
+	report.Snapshot = created.Format(backupTimeLayout)
+	final := filepath.Join(dir, report.Snapshot)
+	if _, err := os.Stat(final); err == nil {
+		return report, fmt.Errorf("snapshot %s already exists", report.Snapshot)
+	}
+	partial := filepath.Join(dir, "."+report.Snapshot+".partial")
+	if err := os.Mkdir(partial, 0700); err != nil {
+		return report, fmt.Errorf("failed to create snapshot: %w", err)
+	}
+	defer os.RemoveAll(partial)
+
+	// previous files, so unchanged ones aren't copied again
+	previous := make(map[string]backupFile)
+	if names, err := listSnapshots(dir); err == nil && len(names) > 0 {
+		if m, err := readManifest(filepath.Join(dir, names[len(names)-1])); err == nil {
+			for _, f := range m.Files {
+				previous[f.Path] = f
+			}
+		}
+	}
+
+	dbCopy := filepath.Join(partial, backupDBName)
+	copyDB, err := sql.Open("sqlite3", dbCopy)
+	if err != nil {
+		return report, fmt.Errorf("failed to create database copy: %w", err)
+	}
+	defer copyDB.Close()
+	if err := copyDatabase(copyDB, db); err != nil {
+		return report, err
+	}
+	// the copy is a single file, whatever mode the database it came from was in
+	if _, err := copyDB.Exec("PRAGMA journal_mode = DELETE"); err != nil {
+		return report, fmt.Errorf("failed to take database copy out of WAL mode: %w", err)
+	}
+
+	// the files are read from the copy, so they match the database exactly
+	type storedPhoto struct {
+		path     string
+		checksum string
+		key      blobKey
+	}
+	rows, err := copyDB.Query("SELECT path, MAX(checksum), MAX(key_id), MAX(wrapped_key) FROM photos WHERE path IS NOT NULL GROUP BY path ORDER BY path")
+	if err != nil {
+		return report, fmt.Errorf("failed to get photos to back up: %w", err)
+	}
+	photos := make([]storedPhoto, 0)
+	for rows.Next() {
+		var p storedPhoto
+		var keyID sql.NullString
+		var wrapped []byte
+		if err := rows.Scan(&p.path, &p.checksum, &keyID, &wrapped); err != nil {
+			rows.Close()
+			return report, fmt.Errorf("failed to scan photo: %w", err)
+		}
+		p.key = scanBlobKey(keyID, wrapped)
+		photos = append(photos, p)
+	}
+	rows.Close()
+	if err := copyDB.Close(); err != nil {
+		return report, fmt.Errorf("failed to close database copy: %w", err)
+	}
+
+	m := snapshotManifest{Created: created, Files: make([]backupFile, 0, len(photos))}
+	if m.Database, err = hashFile(dbCopy); err != nil {
+		return report, fmt.Errorf("failed to hash database copy: %w", err)
+	}
+	for _, p := range photos {
+		info, err := os.Stat(p.path)
+		if err != nil {
+			log.Printf("not backing up %s: %s", p.path, err)
+			m.Skipped = append(m.Skipped, p.path)
+			continue
+		}
+		f := backupFile{Path: p.path, Size: info.Size(), ModTime: info.ModTime().UTC()}
+		if prev, ok := previous[p.path]; ok && prev.Size == f.Size && prev.ModTime.Equal(f.ModTime) {
+			if _, err := os.Stat(filepath.Join(blobs, prev.Blob)); err == nil {
+				f.Blob = prev.Blob
+				m.Files = append(m.Files, f)
+				continue
+			}
+		}
+
+		sum, n, err := storeBlob(blobs, p.path)
+		if err != nil {
+			return report, fmt.Errorf("failed to back up %s: %w", p.path, err)
+		}
+		// the copy has to hold the photo that was uploaded, not just whatever bytes were on disk. That takes decrypting
+		// an encrypted photo, which is left unchecked without the master key it was encrypted with
+		if p.checksum != "" && (p.key.Wrapped == nil || encryptionKey != nil && encryptionKey.id == p.key.ID) {
+			got, err := hashBlob(filepath.Join(blobs, sum), p.key)
+			if err != nil && !errors.Is(err, errBlobCorrupt) {
+				return report, fmt.Errorf("failed to verify backup of %s: %w", p.path, err)
+			}
+			if err != nil || got != p.checksum {
+				log.Printf("not backing up %s: it doesn't match its checksum", p.path)
+				m.Skipped = append(m.Skipped, p.path)
+				continue
+			}
+		}
+		f.Blob = sum
+		m.Files = append(m.Files, f)
+		report.Copied++
+		report.Bytes += n
+	}
+	report.Files, report.Skipped = len(m.Files), len(m.Skipped)
+
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return report, fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	if _, err := writeFileAtomic(filepath.Join(partial, backupManifest), bytes.NewReader(b)); err != nil {
+		return report, fmt.Errorf("failed to write manifest: %w", err)
+	}
+	if err := os.Rename(partial, final); err != nil {
+		return report, fmt.Errorf("failed to move snapshot into place: %w", err)
+	}
+	return report, nil
+}
+
+// pruneBackups removes all but the newest keep snapshots in dir, any snapshot that never finished, and the blobs
+// that no snapshot left refers to
+func pruneBackups(dir string, keep int) (int, error) {
+	unlock, err := lockBackupDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+	names, err := listSnapshots(dir)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for len(names) > keep {
+		if err := os.RemoveAll(filepath.Join(dir, names[0])); err != nil {
+			return removed, fmt.Errorf("failed to remove snapshot %s: %w", names[0], err)
+		}
+		names = names[1:]
+		removed++
+	}
+	partials, err := filepath.Glob(filepath.Join(dir, ".*.partial"))
+	if err != nil {
+		return removed, err
+	}
+	for _, p := range partials {
+		os.RemoveAll(p)
+	}
+
+	used := make(map[string]bool)
+	for _, name := range names {
+		m, err := readManifest(filepath.Join(dir, name))
+		if err != nil {
+			// without the manifest there's no telling which blobs are in use
+			return removed, err
+		}
+		for _, f := range m.Files {
+			used[f.Blob] = true
+		}
+	}
+	blobs, err := os.ReadDir(filepath.Join(dir, backupBlobs))
+	if err != nil && !os.IsNotExist(err) {
+		return removed, fmt.Errorf("failed to list blobs: %w", err)
+	}
+	for _, b := range blobs {
+		if !used[b.Name()] {
+			if err := os.Remove(filepath.Join(dir, backupBlobs, b.Name())); err != nil {
+				return removed, fmt.Errorf("failed to remove blob %s: %w", b.Name(), err)
+			}
+		}
+	}
+	return removed, nil
+}
+
+// snapshotAt returns the newest snapshot in dir taken at or before t
+func snapshotAt(dir string, t time.Time) (string, error) {
+	names, err := listSnapshots(dir)
+	if err != nil {
+		return "", err
+	}
+	for i := len(names) - 1; i >= 0; i-- {
+		taken, _ := time.Parse(backupTimeLayout, names[i])
+		if !taken.After(t) {
+			return names[i], nil
+		}
+	}
+	return "", fmt.Errorf("no snapshot in %s from before %s", dir, t.Format(time.RFC3339))
+}
+
+// validateSnapshot checks that a snapshot is whole: the database copy is the one that was taken and passes
+// SQLite's checks, every blob is there with the bytes it was stored with, and every photo file the database refers
+// to is accounted for
+func validateSnapshot(dir string, name string) (snapshotManifest, error) {
+	snapshot := filepath.Join(dir, name)
+	m, err := readManifest(snapshot)
+	if err != nil {
+		return m, err
+	}
+	dbCopy := filepath.Join(snapshot, backupDBName)
+	sum, err := hashFile(dbCopy)
+	if err != nil {
+		return m, fmt.Errorf("failed to read database copy: %w", err)
+	}
+	if sum != m.Database {
+		return m, fmt.Errorf("database copy in %s has changed since it was taken", name)
+	}
+	for _, f := range m.Files {
+		sum, err := hashFile(filepath.Join(dir, backupBlobs, f.Blob))
+		if err != nil {
+			return m, fmt.Errorf("failed to read backup of %s: %w", f.Path, err)
+		}
+		if sum != f.Blob {
+			return m, fmt.Errorf("backup of %s is corrupt", f.Path)
+		}
+	}
+
+	copyDB, err := sql.Open("sqlite3", "file:"+dbCopy+"?mode=ro")
+	if err != nil {
+		return m, fmt.Errorf("failed to open database copy: %w", err)
+	}
+	defer copyDB.Close()
+	var result string
+	if err := copyDB.QueryRow("PRAGMA integrity_check").Scan(&result); err != nil {
+		return m, fmt.Errorf("failed to check database copy: %w", err)
+	}
+	if result != "ok" {
+		return m, fmt.Errorf("database copy in %s is damaged: %s", name, result)
+	}
+	accounted := make(map[string]bool)
+	for _, f := range m.Files {
+		accounted[f.Path] = true
+	}
+	for _, p := range m.Skipped {
+		accounted[p] = true
+	}
+	rows, err := copyDB.Query("SELECT DISTINCT path FROM photos WHERE path IS NOT NULL")
+	if err != nil {
+		return m, fmt.Errorf("failed to get photos of database copy: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			return m, fmt.Errorf("failed to scan photo: %w", err)
+		}
+		if !accounted[p] {
+			return m, fmt.Errorf("snapshot %s is missing %s", name, p)
+		}
+	}
+	return m, rows.Err()
+}
+
+// restore validates a snapshot, then puts back the photo files it has and copies its database over db. Files
+// uploaded since the snapshot was taken are left where they are, for fsck -repair to quarantine
+func restore(db *sql.DB, dir string, name string) error {
+	// so the snapshot can't be pruned from under us
+	unlock, err := lockBackupDir(dir)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	m, err := validateSnapshot(dir, name)
+	if err != nil {
+		return fmt.Errorf("not restoring: %w", err)
+	}
+	for _, f := range m.Files {
+		if info, err := os.Stat(f.Path); err == nil && info.Size() == f.Size {
+			if sum, err := hashFile(f.Path); err == nil && sum == f.Blob {
+				continue
+			}
+		}
+		blob, err := os.Open(filepath.Join(dir, backupBlobs, f.Blob))
+		if err != nil {
+			return fmt.Errorf("failed to open backup of %s: %w", f.Path, err)
+		}
+		if err := os.MkdirAll(filepath.Dir(f.Path), 0700); err != nil {
+			blob.Close()
+			return fmt.Errorf("failed to create directory for %s: %w", f.Path, err)
+		}
+		_, err = writeFileAtomic(f.Path, blob)
+		blob.Close()
+		if err != nil {
+			return fmt.Errorf("failed to restore %s: %w", f.Path, err)
+		}
+	}
+
+	copyDB, err := sql.Open("sqlite3", "file:"+filepath.Join(dir, name, backupDBName)+"?mode=ro")
+	if err != nil {
+		return fmt.Errorf("failed to open database copy: %w", err)
+	}
+	defer copyDB.Close()
+	// the backup API swaps the pages in under the database's own lock, so open connections see the restored data
+	if err := copyDatabase(db, copyDB); err != nil {
+		return err
+	}
+	return nil
+}
+
+// startBackups takes a snapshot every interval and prunes all but the newest keep, until the program exits
+func startBackups(db *sql.DB, dir string, interval time.Duration, keep int) {
+	go func() {
+		for {
+			time.Sleep(interval)
+			report, err := backup(db, dir)
+			if err != nil {
+				log.Printf("failed to back up: %s", err)
+				continue
+			}
+			log.Printf("backed up %s", report)
+			if _, err := pruneBackups(dir, keep); err != nil {
+				log.Printf("failed to prune backups: %s", err)
+			}
+		}
+	}()
+}
+
+// backup [-keep n] takes a snapshot into -backup-dir and then prunes all but the newest n, backup -list lists the
+// snapshots there
+func backupCommand(args []string, db *sql.DB) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	keep := fs.Int("keep", 0, "number of snapshots to keep, 0 to keep them all")
+	list := fs.Bool("list", false, "list snapshots instead of taking one")
+	fs.Parse(args)
+	if backupDir == "" {
+		return fmt.Errorf("no backup directory, set one with -backup-dir")
+	}
+
+	if *list {
+		names, err := listSnapshots(backupDir)
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			m, err := readManifest(filepath.Join(backupDir, name))
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s\t%v files\t%v skipped\n", name, len(m.Files), len(m.Skipped))
+		}
+		return nil
+	}
+	report, err := backup(db, backupDir)
+	if err != nil {
+		return err
+	}
+	fmt.Println(report)
+	if *keep > 0 {
+		removed, err := pruneBackups(backupDir, *keep)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("removed %v old snapshots\n", removed)
+	}
+	return nil
+}
+
+// restore [-snapshot name | -at time] [-check] puts back the newest snapshot, the one given, or the newest one taken
+// at or before the given time. The current state is backed up first, so a restore can be undone. With -check the
+// snapshot is only validated
+func restoreCommand(args []string, db *sql.DB) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	name := fs.String("snapshot", "", "snapshot to restore")
+	at := fs.String("at", "", "restore the state as of this time, as 2006-01-02T15:04:05Z07:00 or 2006-01-02 15:04:05 in UTC")
+	checkOnly := fs.Bool("check", false, "validate the snapshot without restoring it")
+	fs.Parse(args)
+	if backupDir == "" {
+		return fmt.Errorf("no backup directory, set one with -backup-dir")
+	}
+
+	if *name == "" {
+		t := time.Now()
+		if *at != "" {
+			var err error
+			if t, err = time.Parse(time.RFC3339, *at); err != nil {
+				if t, err = time.Parse(timeLayout, *at); err != nil {
+					return fmt.Errorf("failed to parse -at %q", *at)
+				}
+			}
+		}
+		var err error
+		if *name, err = snapshotAt(backupDir, t); err != nil {
+			return err
+		}
+	}
+	if *checkOnly {
+		m, err := validateSnapshot(backupDir, *name)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("snapshot %s is good: %v files, %v skipped\n", *name, len(m.Files), len(m.Skipped))
+		return nil
+	}
+
+	report, err := backup(db, backupDir)
+	if err != nil {
+		return fmt.Errorf("failed to back up current state before restoring: %w", err)
+	}
+	fmt.Printf("backed up current state as %s\n", report)
+	if err := restore(db, backupDir, *name); err != nil {
+		return err
+	}
+	fmt.Printf("restored snapshot %s, restart the server to apply any newer migrations\n", *name)
+	return nil
+}
@@ -1,8 +0,0 @@
-drop table album_permissions;
-drop table tags;
-drop table photos;
-drop table albums;
-drop table sessions;
-drop table users;
-drop table invites;
-
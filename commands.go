@@ -0,0 +1,96 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// besides serving the site, the binary runs admin commands given after the global flags, e.g.
+// photoApp -db photoAppDB fsck -repair
+func runCommand(args []string, db *sql.DB) error {
+	switch args[0] {
+	case "fsck":
+		return fsckCommand(args[1:], db)
+	case "migrate":
+		return migrateCommand(args[1:], db)
+	case "quota":
+		return quotaCommand(args[1:], db)
+	case "keygen":
+		return keygenCommand(args[1:])
+	case "rotate-key":
+		return rotateKeyCommand(args[1:], db)
+	case "backup":
+		return backupCommand(args[1:], db)
+	case "restore":
+		return restoreCommand(args[1:], db)
+	case "import":
+		return importCommand(args[1:], db)
+	case "watch":
+		return watchCommand(args[1:], db)
+	case "user":
+		return userCommand(args[1:], db)
+	case "album":
+		return albumCommand(args[1:], db)
+	case "stats":
+		return statsCommand(args[1:], db)
+	case "memories":
+		return memoriesCommand(args[1:], db)
+	case "loadtest":
+		return loadTestCommand(args[1:])
+	default:
+		return fmt.Errorf("unknown command %q", args[0])
+	}
+}
+
+func fsckCommand(args []string, db *sql.DB) error {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "mark broken photos and quarantine orphaned files")
+	fs.Parse(args)
+
+	report, err := fsck(db, os.Getenv("SILSILA_PHOTO_PATH"), *repair)
+	if err != nil {
+		return err
+	}
+	fmt.Print(report)
+	if !report.ok() && !*repair {
+		return fmt.Errorf("photo store has problems, run fsck -repair to fix them")
+	}
+	return nil
+}
+
+// prints a new master key to put in a key file or SILSILA_MASTER_KEY
+func keygenCommand(args []string) error {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	fs.Parse(args)
+
+	key, err := generateMasterKey()
+	if err != nil {
+		return err
+	}
+	fmt.Println(key)
+	return nil
+}
+
+// re-wraps every data key under the current master key with the one in -new-key-file. Afterwards the server has to
+// be started with the new key
+func rotateKeyCommand(args []string, db *sql.DB) error {
+	fs := flag.NewFlagSet("rotate-key", flag.ExitOnError)
+	newKeyFile := fs.String("new-key-file", "", "file holding the master key to switch to")
+	fs.Parse(args)
+	if *newKeyFile == "" {
+		return fmt.Errorf("usage: rotate-key -new-key-file <file>")
+	}
+
+	next, err := loadMasterKey(*newKeyFile)
+	if err != nil {
+		return err
+	}
+	n, err := rotateKey(db, next)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("re-wrapped %v data keys with master key %s\n", n, next.id)
+	return nil
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// /dav/ serves the albums a user can see as a network drive over WebDAV. Every album they own or were given
+// permission to is a folder, named like the folders of photoapp sync, and every photo in it is a file named after
+// the name it was uploaded with; an album or photo sharing its name with another one gets its id added. Changes go
+// through the same code as the pages do:
+//   - PUT uploads through addPhoto into an album the user can contribute to, replacing the photo of that name if
+//     there is one
+//   - DELETE moves a photo or album to the trash
+//   - MKCOL at the top makes an album with newAlbum
+//   - MOVE renames an album, or moves a photo to another album
+//
+// Clients log in with the user's email and an app password. Files whose names start with a dot, which Finder and
+// Windows leave behind everywhere, are refused, and so are uploads of nothing, which some clients make before
+// sending the actual file
+
+// davLocks holds the WebDAV locks of every user. Each user gets their own, since their paths are their own too
+var davLocks = struct {
+	sync.Mutex
+	users map[int64]webdav.LockSystem
+}{users: make(map[int64]webdav.LockSystem)}
+
+func davLockSystem(userID int64) webdav.LockSystem {
+	davLocks.Lock()
+	defer davLocks.Unlock()
+	ls, ok := davLocks.users[userID]
+	if !ok {
+		ls = webdav.NewMemLS()
+		davLocks.users[userID] = ls
+	}
+	return ls
+}
+
+// davFS is the drive of one user. Changes go through db, and looking around, which clients do a lot more of, goes
+// through readDB so it doesn't wait behind uploads
+type davFS struct {
+	db     *sql.DB
+	readDB *sql.DB
+	userID int64
+}
+
+// davInfo describes an album folder or a photo file
+type davInfo struct {
+	id      int64
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (i davInfo) Name() string       { return i.name }
+func (i davInfo) Size() int64        { return i.size }
+func (i davInfo) ModTime() time.Time { return i.modTime }
+func (i davInfo) IsDir() bool        { return i.dir }
+func (i davInfo) Sys() interface{}   { return nil }
+func (i davInfo) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0700
+	}
+	return 0600
+}
+
+// gives every name in infos that's already been used the id of what it names, before the extension
+func uniqueNames(infos []davInfo) {
+	used := make(map[string]bool)
+	for i := range infos {
+		if used[infos[i].name] {
+			ext := path.Ext(infos[i].name)
+			if infos[i].dir {
+				ext = ""
+			}
+			infos[i].name = fmt.Sprintf("%s (%v)%s", strings.TrimSuffix(infos[i].name, ext), infos[i].id, ext)
+		}
+		used[infos[i].name] = true
+	}
+}
+
+// returns the albums the user can see, leaving out smart albums since their photos can't be changed like files
+func (d davFS) albums(tx *sql.Tx) ([]davInfo, error) {
+	rows, err := tx.Query("SELECT id, name, COALESCE((SELECT MAX(added_at) FROM album_photos WHERE album_id = albums.id), '') FROM albums "+
+		"WHERE trashed_at IS NULL AND query IS NULL AND (user_id = ? OR id IN (SELECT album_id FROM album_permissions WHERE user_id = ?)) ORDER BY id",
+		d.userID, d.userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get albums: %w", err)
+	}
+	defer rows.Close()
+	albums := make([]davInfo, 0)
+	for rows.Next() {
+		a := davInfo{dir: true}
+		var modified string
+		if err := rows.Scan(&a.id, &a.name, &modified); err != nil {
+			return nil, fmt.Errorf("failed to scan album: %w", err)
+		}
+		a.name = folderName(a.name, a.id)
+		a.modTime, _ = time.Parse(timeLayout, modified)
+		albums = append(albums, a)
+	}
+	uniqueNames(albums)
+	return albums, rows.Err()
+}
+
+// returns the photos in an album
+func (d davFS) photos(albumID int64, tx *sql.Tx) ([]davInfo, error) {
+	rows, err := tx.Query("SELECT photos.id, COALESCE(filename, ''), COALESCE(size, 0), uploaded_at FROM photos "+
+		"JOIN album_photos ON photos.id = album_photos.photo_id WHERE album_id = ? AND trashed_at IS NULL AND path IS NOT NULL "+
+		"ORDER BY position", albumID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get photos of album %v: %w", albumID, err)
+	}
+	defer rows.Close()
+	photos := make([]davInfo, 0)
+	for rows.Next() {
+		var p davInfo
+		var uploaded string
+		if err := rows.Scan(&p.id, &p.name, &p.size, &uploaded); err != nil {
+			return nil, fmt.Errorf("failed to scan photo: %w", err)
+		}
+		p.name = strings.ReplaceAll(path.Base("/"+p.name), "\\", "-")
+		if p.name == "/" || strings.HasPrefix(p.name, ".") {
+			p.name = strconv.FormatInt(p.id, 10) + p.name
+		}
+		p.modTime, _ = time.Parse(timeLayout, uploaded)
+		photos = append(photos, p)
+	}
+	uniqueNames(photos)
+	return photos, rows.Err()
+}
+
+// splits a drive path into the album folder and photo file names in it
+func davSplit(name string) []string {
+	name = strings.Trim(path.Clean("/"+name), "/")
+	if name == "" {
+		return nil
+	}
+	return strings.Split(name, "/")
+}
+
+func hiddenName(parts []string) bool {
+	for _, p := range parts {
+		if strings.HasPrefix(p, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve finds the album and photo a path names. Either is the zero davInfo if the path doesn't go that far
+func (d davFS) resolve(parts []string, tx *sql.Tx) (davInfo, davInfo, error) {
+	var album, photo davInfo
+	if len(parts) == 0 {
+		return album, photo, nil
+	}
+	if len(parts) > 2 || hiddenName(parts) {
+		return album, photo, os.ErrNotExist
+	}
+	albums, err := d.albums(tx)
+	if err != nil {
+		return album, photo, err
+	}
+	if album = findInfo(albums, parts[0]); album.id == 0 {
+		return album, photo, os.ErrNotExist
+	}
+	if len(parts) == 1 {
+		return album, photo, nil
+	}
+	photos, err := d.photos(album.id, tx)
+	if err != nil {
+		return album, photo, err
+	}
+	if photo = findInfo(photos, parts[1]); photo.id == 0 {
+		return album, photo, os.ErrNotExist
+	}
+	return album, photo, nil
+}
+
+func findInfo(infos []davInfo, name string) davInfo {
+	for _, i := range infos {
+		if i.name == name {
+			return i
+		}
+	}
+	return davInfo{}
+}
+
+func (d davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	parts := davSplit(name)
+	if len(parts) != 1 || hiddenName(parts) {
+		return os.ErrPermission
+	}
+	return inTx(d.db, func(tx *sql.Tx) error {
+		if _, _, err := d.resolve(parts, tx); err == nil {
+			return os.ErrExist
+		} else if err != os.ErrNotExist {
+			return err
+		}
+		_, err := newAlbum(parts[0], d.userID, tx)
+		return err
+	})
+}
+
+func (d davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	parts := davSplit(name)
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return d.create(parts)
+	}
+
+	var f webdav.File
+	err := inTx(d.readDB, func(tx *sql.Tx) error {
+		album, photo, err := d.resolve(parts, tx)
+		if err != nil {
+			return err
+		}
+		switch {
+		case len(parts) == 0:
+			albums, err := d.albums(tx)
+			f = &davDir{info: davInfo{name: "/", dir: true}, entries: albums}
+			return err
+		case len(parts) == 1:
+			photos, err := d.photos(album.id, tx)
+			f = &davDir{info: album, entries: photos}
+			return err
+		}
+		file, err := store.WithTx(tx).PhotoFile(photo.id)
+		if err != nil {
+			return err
+		}
+		blob, err := openBlob(file.Path, file.Key)
+		if err != nil {
+			return fmt.Errorf("failed to open photo %v: %w", photo.id, err)
+		}
+		f = &davPhoto{ReadSeekCloser: blob, info: photo}
+		return nil
+	})
+	return f, err
+}
+
+// create opens an upload to the album folder and photo file named in parts
+func (d davFS) create(parts []string) (webdav.File, error) {
+	if len(parts) != 2 || hiddenName(parts) {
+		return nil, os.ErrPermission
+	}
+	u := &davUpload{fs: d, name: parts[1]}
+	err := inTx(d.db, func(tx *sql.Tx) error {
+		album, photo, err := d.resolve(parts, tx)
+		if album.id == 0 {
+			return err
+		}
+		if !checkContributor(album.id, d.userID, tx) {
+			return os.ErrPermission
+		}
+		u.albumID, u.replaces = album.id, photo.id
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if u.tmp, err = os.CreateTemp("", "photoapp-dav-*"); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func (d davFS) RemoveAll(ctx context.Context, name string) error {
+	parts := davSplit(name)
+	return inTx(d.db, func(tx *sql.Tx) error {
+		album, photo, err := d.resolve(parts, tx)
+		if err != nil {
+			return err
+		}
+		switch len(parts) {
+		case 0:
+			return os.ErrPermission
+		case 1:
+			if !checkOwner(album.id, d.userID, tx) {
+				return os.ErrPermission
+			}
+			return trashAlbum(album.id, tx)
+		}
+		if !checkPhotoContributor(photo.id, d.userID, tx) {
+			return os.ErrPermission
+		}
+		return trashPhoto(photo.id, tx)
+	})
+}
+
+func (d davFS) Rename(ctx context.Context, oldName string, newName string) error {
+	from, to := davSplit(oldName), davSplit(newName)
+	if len(from) != len(to) || hiddenName(to) {
+		return os.ErrPermission
+	}
+	return inTx(d.db, func(tx *sql.Tx) error {
+		album, photo, err := d.resolve(from, tx)
+		if err != nil {
+			return err
+		}
+		if _, _, err := d.resolve(to, tx); err == nil {
+			return os.ErrExist
+		}
+		switch len(to) {
+		case 0:
+			return os.ErrPermission
+		case 1:
+			if !checkOwner(album.id, d.userID, tx) {
+				return os.ErrPermission
+			}
+			return store.WithTx(tx).RenameAlbum(album.id, to[0])
+		}
+		// photos keep the name they were uploaded with, so they can only be moved to another album
+		target, _, err := d.resolve(to[:1], tx)
+		if err != nil {
+			return err
+		}
+		if from[1] != to[1] || album.id == target.id || !checkContributor(album.id, d.userID, tx) || !checkContributor(target.id, d.userID, tx) {
+			return os.ErrPermission
+		}
+		if err := addToAlbum(photo.id, target.id, tx); err != nil {
+			return err
+		}
+		return removeFromAlbum(photo.id, album.id, tx)
+	})
+}
+
+func (d davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	parts := davSplit(name)
+	var info os.FileInfo
+	err := inTx(d.readDB, func(tx *sql.Tx) error {
+		album, photo, err := d.resolve(parts, tx)
+		switch len(parts) {
+		case 0:
+			info = davInfo{name: "/", dir: true}
+		case 1:
+			info = album
+		default:
+			info = photo
+		}
+		return err
+	})
+	return info, err
+}
+
+// davDir is an open album folder, or the top of the drive
+type davDir struct {
+	info    davInfo
+	entries []davInfo
+	read    int
+}
+
+func (d *davDir) Close() error                                 { return nil }
+func (d *davDir) Read(p []byte) (int, error)                   { return 0, os.ErrInvalid }
+func (d *davDir) Write(p []byte) (int, error)                  { return 0, os.ErrPermission }
+func (d *davDir) Seek(offset int64, whence int) (int64, error) { return 0, os.ErrInvalid }
+func (d *davDir) Stat() (os.FileInfo, error)                   { return d.info, nil }
+
+func (d *davDir) Readdir(count int) ([]os.FileInfo, error) {
+	rest := d.entries[d.read:]
+	if count > 0 {
+		if len(rest) == 0 {
+			return nil, io.EOF
+		}
+		rest = rest[:min(count, len(rest))]
+	}
+	d.read += len(rest)
+	infos := make([]os.FileInfo, len(rest))
+	for i := range rest {
+		infos[i] = rest[i]
+	}
+	return infos, nil
+}
+
+// davPhoto is a photo opened for reading
+type davPhoto struct {
+	io.ReadSeekCloser
+	info davInfo
+}
+
+func (p *davPhoto) Write(b []byte) (int, error)        { return 0, os.ErrPermission }
+func (p *davPhoto) Readdir(int) ([]os.FileInfo, error) { return nil, os.ErrInvalid }
+func (p *davPhoto) Stat() (os.FileInfo, error)         { return p.info, nil }
+
+// davUpload collects an upload in a temporary file, which goes through addPhoto once it's closed
+type davUpload struct {
+	fs       davFS
+	albumID  int64
+	name     string
+	replaces int64
+	tmp      *os.File
+}
+
+func (u *davUpload) Read(b []byte) (int, error)                   { return u.tmp.Read(b) }
+func (u *davUpload) Write(b []byte) (int, error)                  { return u.tmp.Write(b) }
+func (u *davUpload) Seek(offset int64, whence int) (int64, error) { return u.tmp.Seek(offset, whence) }
+func (u *davUpload) Readdir(int) ([]os.FileInfo, error)           { return nil, os.ErrInvalid }
+
+func (u *davUpload) Stat() (os.FileInfo, error) {
+	info, err := u.tmp.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return davInfo{name: u.name, size: info.Size(), modTime: info.ModTime()}, nil
+}
+
+func (u *davUpload) Close() error {
+	defer os.Remove(u.tmp.Name())
+	defer u.tmp.Close()
+	info, err := u.tmp.Stat()
+	if err != nil || info.Size() == 0 {
+		return err
+	}
+	if _, err := u.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, _, err := addPhoto(u.albumID, u.fs.userID, u.name, u.tmp, u.fs.db); err != nil {
+		return err
+	}
+	if u.replaces == 0 {
+		return nil
+	}
+	return inTx(u.fs.db, func(tx *sql.Tx) error { return removeFromAlbum(u.replaces, u.albumID, tx) })
+}
+
+// davHandler returns the handler serving the drive of the user whose app password the request carries, with
+// changes going to the db it's given and reads to readDB
+func davHandler(readDB *sql.DB) func(http.ResponseWriter, *http.Request, *sql.DB) {
+	return func(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+		userID, err := appPasswordUser(r, readDB, db)
+		if err != nil {
+			log.Printf("failed to authenticate WebDAV request: %s", err)
+			w.Header().Set("WWW-Authenticate", `Basic realm="photoapp"`)
+			http.Error(w, "log in with your email and an app password", http.StatusUnauthorized)
+			return
+		}
+		h := webdav.Handler{
+			Prefix:     "/dav",
+			FileSystem: davFS{db: db, readDB: readDB, userID: userID},
+			LockSystem: davLockSystem(userID),
+			Logger: func(r *http.Request, err error) {
+				if err != nil && !os.IsNotExist(err) {
+					log.Printf("failed WebDAV %s %s: %s", r.Method, r.URL.Path, err)
+				}
+			},
+		}
+		h.ServeHTTP(w, r)
+	}
+}
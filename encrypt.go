@@ -0,0 +1,395 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// photo files can optionally be encrypted with AES-GCM. Every file gets its own random data key, which is stored in
+// photos.wrapped_key encrypted under the master key named by photos.key_id. The master key itself never touches the
+// photo directory: it comes from the -key-file flag or the SILSILA_MASTER_KEY environment variable, so rotating it only
+// means re-wrapping the data keys, never rewriting the photos. Photos stored while encryption was off keep a NULL
+// wrapped_key and are read as plain files.
+//
+// An encrypted file is blobMagic followed by the photo in sealed chunks of blobChunkSize bytes. Each chunk's nonce is
+// its index plus a flag marking the last chunk, so chunks can't be reordered, dropped or cut off without failing to
+// open, and any part of the file can be decrypted without reading what comes before it
+
+const (
+	blobMagic     = "SILENC1\n"
+	blobChunkSize = 64 * 1024
+	blobOverhead  = 16 // GCM tag size
+)
+
+// masterKey wraps and unwraps the data keys of photo files
+type masterKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// errBlobCorrupt is returned when an encrypted photo file fails to decrypt
+var errBlobCorrupt = errors.New("encrypted photo is corrupt")
+
+// encryptionKey is the master key new photos are encrypted under, nil when encryption is off
+var encryptionKey *masterKey
+
+// blobKey is a photo file's data key as stored in the photos table. The zero value means the file isn't encrypted
+type blobKey struct {
+	ID      string // id of the master key that wrapped the data key
+	Wrapped []byte
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// parses a base64 encoded 256 bit master key
+func parseMasterKey(encoded string) (*masterKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode master key: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("master key is %v bytes, want 32", len(key))
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up master key: %w", err)
+	}
+	// the id lets us tell which key wrapped a data key without storing anything secret
+	sum := sha256.Sum256(key)
+	return &masterKey{id: hex.EncodeToString(sum[:8]), aead: aead}, nil
+}
+
+// loads the master key from keyFile, or from SILSILA_MASTER_KEY if keyFile is empty. It returns nil if neither is
+// set, meaning photos aren't encrypted
+func loadMasterKey(keyFile string) (*masterKey, error) {
+	if keyFile != "" {
+		b, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %w", err)
+		}
+		return parseMasterKey(string(b))
+	}
+	if encoded, ok := os.LookupEnv("SILSILA_MASTER_KEY"); ok {
+		return parseMasterKey(encoded)
+	}
+	return nil, nil
+}
+
+// returns a new random master key, base64 encoded the way loadMasterKey expects it
+func generateMasterKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("failed to generate key: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+func (m *masterKey) wrap(dataKey []byte) ([]byte, error) {
+	nonce := make([]byte, m.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return m.aead.Seal(nonce, nonce, dataKey, []byte(m.id)), nil
+}
+
+func (m *masterKey) unwrap(key blobKey) ([]byte, error) {
+	if key.ID != m.id {
+		return nil, fmt.Errorf("data key was wrapped by master key %s, not %s", key.ID, m.id)
+	}
+	n := m.aead.NonceSize()
+	if len(key.Wrapped) < n {
+		return nil, errors.New("wrapped data key is too short")
+	}
+	dataKey, err := m.aead.Open(nil, key.Wrapped[:n], key.Wrapped[n:], []byte(m.id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	return dataKey, nil
+}
+
+// returns the data key of a photo file, ready to use
+func (k blobKey) aead() (cipher.AEAD, error) {
+	if encryptionKey == nil {
+		return nil, errors.New("photo is encrypted but no master key was given")
+	}
+	dataKey, err := encryptionKey.unwrap(k)
+	if err != nil {
+		return nil, err
+	}
+	return newAEAD(dataKey)
+}
+
+// sealBlob returns src as it should be written to disk and the key to store with it. Without a master key that's src
+// itself and the zero blobKey
+func sealBlob(src io.Reader) (io.Reader, blobKey, error) {
+	if encryptionKey == nil {
+		return src, blobKey{}, nil
+	}
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, blobKey{}, fmt.Errorf("failed to generate data key: %w", err)
+	}
+	wrapped, err := encryptionKey.wrap(dataKey)
+	if err != nil {
+		return nil, blobKey{}, err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, blobKey{}, err
+	}
+	return &encryptReader{src: src, aead: aead}, blobKey{ID: encryptionKey.id, Wrapped: wrapped}, nil
+}
+
+// openBlob opens a photo file for reading, decrypting it if it has a key
+func openBlob(p string, key blobKey) (io.ReadSeekCloser, error) {
+	f, err := os.Open(p)
+	if err != nil || key.Wrapped == nil {
+		return f, err
+	}
+	aead, err := key.aead()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r, err := newDecryptReader(f, aead)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// scans the key_id and wrapped_key columns of a photo
+func scanBlobKey(keyID sql.NullString, wrapped []byte) blobKey {
+	if !keyID.Valid {
+		return blobKey{}
+	}
+	return blobKey{ID: keyID.String, Wrapped: wrapped}
+}
+
+// the nonce of the i-th chunk of a file
+func chunkNonce(i int64, last bool) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[3:11], uint64(i))
+	if last {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// returns the size of the photo in an encrypted file of the given size
+func plainSize(sealed int64) int64 {
+	sealed -= int64(len(blobMagic))
+	chunks := (sealed + blobChunkSize + blobOverhead - 1) / (blobChunkSize + blobOverhead)
+	return sealed - chunks*blobOverhead
+}
+
+// encryptReader reads src and returns it encrypted. It reads one chunk ahead so it knows which chunk is the last
+type encryptReader struct {
+	src     io.Reader
+	aead    cipher.AEAD
+	chunk   int64
+	next    []byte // plaintext of the chunk to seal next
+	out     []byte // sealed data waiting to be read
+	started bool
+	done    bool
+}
+
+func (e *encryptReader) Read(p []byte) (int, error) {
+	for len(e.out) == 0 {
+		if e.done {
+			return 0, io.EOF
+		}
+		if err := e.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, e.out)
+	e.out = e.out[n:]
+	return n, nil
+}
+
+func (e *encryptReader) fill() error {
+	if !e.started {
+		e.started = true
+		e.out = []byte(blobMagic)
+		next, err := readChunk(e.src)
+		e.next = next
+		return err
+	}
+	following, err := readChunk(e.src)
+	if err != nil {
+		return err
+	}
+	last := len(following) == 0
+	e.out = e.aead.Seal(nil, chunkNonce(e.chunk, last), e.next, nil)
+	e.chunk++
+	e.next = following
+	e.done = last
+	return nil
+}
+
+// reads up to a chunk from src, returning a short or empty chunk at the end
+func readChunk(src io.Reader) ([]byte, error) {
+	buf := make([]byte, blobChunkSize)
+	n, err := io.ReadFull(src, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return buf[:n], err
+}
+
+// decryptReader decrypts an encrypted file a chunk at a time, so large photos can be streamed and served in ranges
+type decryptReader struct {
+	f      *os.File
+	aead   cipher.AEAD
+	sealed int64 // size of the file after the header
+	chunks int64
+	size   int64 // size of the photo
+	pos    int64
+	loaded int64 // index of the chunk in plain, -1 before the first read
+	plain  []byte
+}
+
+func newDecryptReader(f *os.File, aead cipher.AEAD) (*decryptReader, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, len(blobMagic))
+	if _, err := io.ReadFull(f, header); err != nil || string(header) != blobMagic {
+		return nil, fmt.Errorf("%w: missing header", errBlobCorrupt)
+	}
+	r := &decryptReader{f: f, aead: aead, sealed: info.Size() - int64(len(blobMagic)), size: plainSize(info.Size()), loaded: -1}
+	if r.sealed < blobOverhead {
+		return nil, fmt.Errorf("%w: truncated", errBlobCorrupt)
+	}
+	r.chunks = (r.sealed + blobChunkSize + blobOverhead - 1) / (blobChunkSize + blobOverhead)
+	// checking the last chunk up front means a truncated file fails here rather than part way through a response
+	if err := r.load(r.chunks - 1); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *decryptReader) load(i int64) error {
+	off := i * (blobChunkSize + blobOverhead)
+	n := int64(blobChunkSize + blobOverhead)
+	if i == r.chunks-1 {
+		n = r.sealed - off
+	}
+	buf := make([]byte, n)
+	if _, err := r.f.ReadAt(buf, int64(len(blobMagic))+off); err != nil {
+		return fmt.Errorf("failed to read encrypted photo: %w", err)
+	}
+	plain, err := r.aead.Open(buf[:0], chunkNonce(i, i == r.chunks-1), buf, nil)
+	if err != nil {
+		return fmt.Errorf("%w: failed to decrypt chunk %v: %s", errBlobCorrupt, i, err)
+	}
+	r.plain, r.loaded = plain, i
+	return nil
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	if r.pos >= r.size {
+		return 0, io.EOF
+	}
+	i := r.pos / blobChunkSize
+	if i != r.loaded {
+		if err := r.load(i); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain[r.pos-i*blobChunkSize:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *decryptReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek to negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *decryptReader) Close() error {
+	return r.f.Close()
+}
+
+// rotateKey re-wraps the data keys wrapped by the current master key with next. The photo files aren't touched
+func rotateKey(db *sql.DB, next *masterKey) (int, error) {
+	if encryptionKey == nil {
+		return 0, errors.New("no current master key given")
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT DISTINCT wrapped_key FROM photos WHERE key_id = ?", encryptionKey.id)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get data keys: %w", err)
+	}
+	keys := make([][]byte, 0)
+	for rows.Next() {
+		var wrapped []byte
+		if err := rows.Scan(&wrapped); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("failed to scan data key: %w", err)
+		}
+		keys = append(keys, wrapped)
+	}
+	rows.Close()
+
+	for _, wrapped := range keys {
+		dataKey, err := encryptionKey.unwrap(blobKey{ID: encryptionKey.id, Wrapped: wrapped})
+		if err != nil {
+			return 0, err
+		}
+		rewrapped, err := next.wrap(dataKey)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec("UPDATE photos SET key_id = ?, wrapped_key = ? WHERE key_id = ? AND wrapped_key = ?",
+			next.id, rewrapped, encryptionKey.id, wrapped); err != nil {
+			return 0, fmt.Errorf("failed to save re-wrapped data key: %w", err)
+		}
+	}
+
+	var left int
+	if err := tx.QueryRow("SELECT count(*) FROM photos WHERE key_id IS NOT NULL AND key_id != ?", next.id).Scan(&left); err != nil {
+		return 0, fmt.Errorf("failed to count photos under other keys: %w", err)
+	}
+	if left > 0 {
+		return 0, fmt.Errorf("%v photos are encrypted under a key other than the current one, nothing was rotated", left)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	return len(keys), nil
+}
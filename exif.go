@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// timeLayout is how capture and upload times are stored in the photos table. It matches sqlite's
+// CURRENT_TIMESTAMP so both sort and group the same way in queries
+const timeLayout = "2006-01-02 15:04:05"
+
+// exifInfo is what a photo's EXIF data says about where, when and with what it was taken
+type exifInfo struct {
+	Taken       time.Time // zero if the photo doesn't say
+	HasLocation bool
+	Latitude    float64
+	Longitude   float64
+	Camera      string // make and model, empty if the photo doesn't say
+}
+
+// readExif reads the time and place a photo was taken and the camera it was taken with from its EXIF data
+func readExif(r io.Reader) (exifInfo, error) {
+	info := exifInfo{}
+	x, err := exif.Decode(r)
+	if err != nil {
+		return info, fmt.Errorf("failed to decode exif data: %w", err)
+	}
+	if t, err := x.DateTime(); err == nil {
+		info.Taken = t
+	}
+	if lat, long, err := x.LatLong(); err == nil {
+		info.HasLocation, info.Latitude, info.Longitude = true, lat, long
+	}
+	var maker, model string
+	if tag, err := x.Get(exif.Make); err == nil {
+		maker, _ = tag.StringVal()
+	}
+	if tag, err := x.Get(exif.Model); err == nil {
+		model, _ = tag.StringVal()
+	}
+	maker, model = strings.Trim(maker, " \x00"), strings.Trim(model, " \x00")
+	// plenty of cameras already start their model with the make, "Canon" "Canon EOS R6"
+	if strings.HasPrefix(strings.ToLower(model), strings.ToLower(maker)) {
+		maker = ""
+	}
+	info.Camera = strings.TrimSpace(maker + " " + model)
+	return info, nil
+}
+
+// formatDate turns a stored timestamp into a date for display, or returns it unchanged if it can't be parsed
+func formatDate(s string) string {
+	t, err := time.Parse(timeLayout, s)
+	if err != nil {
+		return s
+	}
+	return t.Format("Jan 2, 2006")
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// a user can ask for everything they have as one zip archive. exports: id!|user_id|token|state|path|size|error|
+// requested_at|finished_at|expires_at tracks each request from pending through running to done or failed, and
+// finally expired. The exporter builds pending archives in the background into exportsDir in the photo directory,
+// and removes them again once they expire. An archive holds:
+//
+//	account.json              the user, the albums they own or were given access to, and the photos they're tagged in
+//	photos/<id>-<filename>    every photo the user owns, decrypted, including those in the trash
+//	photos/<id>-<filename>.json   what's known about the photo: details, times, albums and tags
+//
+// TODO: photos have no comments yet, once they do they belong in the sidecars
+
+// exportsDir is the directory in the photo directory that finished exports are kept in
+const exportsDir = "exports"
+
+// exportTTL is how long a finished export can be downloaded, set by -export-ttl
+var exportTTL = 7 * 24 * time.Hour
+
+type exportAccount struct {
+	ID         int64         `json:"id"`
+	Email      string        `json:"email"`
+	QuotaBytes *int64        `json:"quotaBytes,omitempty"`
+	ExportedAt string        `json:"exportedAt"`
+	Albums     []exportAlbum `json:"albums"`
+	Photos     int           `json:"photos"`
+	TaggedIn   []int64       `json:"taggedIn"`
+	photoIndex map[int64]int // photos by id
+	photos     []exportPhoto // sidecars, kept out of account.json
+	files      map[int64]photoFile
+}
+
+type exportAlbum struct {
+	ID          int64   `json:"id"`
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	Role        string  `json:"role"` // owner, or the role the user was given
+	SortMode    string  `json:"sortMode"`
+	Query       string  `json:"query,omitempty"` // set for smart albums, which have no photos of their own
+	TrashedAt   string  `json:"trashedAt,omitempty"`
+	Photos      []int64 `json:"photos"`
+}
+
+type exportPhoto struct {
+	ID         int64            `json:"id"`
+	File       string           `json:"file"` // name of the photo in the archive, empty if it couldn't be exported
+	Filename   string           `json:"filename"`
+	Title      string           `json:"title"`
+	Caption    string           `json:"caption"`
+	AltText    string           `json:"altText"`
+	Keywords   string           `json:"keywords"`
+	CapturedAt string           `json:"capturedAt,omitempty"`
+	UploadedAt string           `json:"uploadedAt"`
+	TrashedAt  string           `json:"trashedAt,omitempty"`
+	Checksum   string           `json:"sha256"`
+	Size       int64            `json:"size"`
+	Albums     []exportAlbumRef `json:"albums"`
+	Tags       []string         `json:"tags"`
+}
+
+type exportAlbumRef struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+// exportInfo holds what the export page shows about an export
+type exportInfo struct {
+	Token       string
+	State       string
+	Size        string
+	Error       string
+	RequestedAt string
+	ExpiresAt   string
+}
+
+type exportpage struct {
+	UserID  int64
+	Exports []exportInfo
+	Busy    bool // an export is pending or running
+}
+
+func (e exportpage) render(w http.ResponseWriter) error {
+	return templates.ExecuteTemplate(w, "export.html", e)
+}
+
+// requestExport queues an export of everything userID has, unless one is already on its way
+func requestExport(userID int64, tx *sql.Tx) error {
+	var n int
+	if err := tx.QueryRow("SELECT count(*) FROM exports WHERE user_id = ? AND state IN ('pending', 'running')", userID).Scan(&n); err != nil {
+		return fmt.Errorf("failed to get exports of user %v: %w", userID, err)
+	}
+	if n > 0 {
+		return nil
+	}
+	if _, err := tx.Exec("INSERT INTO exports (user_id, token) VALUES (?, ?)", userID, randString(32)); err != nil {
+		return fmt.Errorf("failed to request export for user %v: %w", userID, err)
+	}
+	return nil
+}
+
+// gathers everything that goes into userID's export in one transaction, so the archive is consistent
+func collectExport(userID int64, tx *sql.Tx) (exportAccount, error) {
+	a := exportAccount{ID: userID, ExportedAt: time.Now().UTC().Format(timeLayout), Albums: make([]exportAlbum, 0),
+		photoIndex: make(map[int64]int), photos: make([]exportPhoto, 0), files: make(map[int64]photoFile)}
+	var quota sql.NullInt64
+	if err := tx.QueryRow("SELECT email, quota_bytes FROM users WHERE id = ?", userID).Scan(&a.Email, &quota); err != nil {
+		return a, fmt.Errorf("failed to get user %v: %w", userID, err)
+	}
+	if quota.Valid {
+		a.QuotaBytes = &quota.Int64
+	}
+
+	albumRows, err := tx.Query("SELECT id, name, description, sort_mode, COALESCE(query, ''), COALESCE(trashed_at, ''), "+
+		"CASE WHEN user_id = ? THEN 'owner' ELSE (SELECT MAX(role) FROM album_permissions WHERE album_id = albums.id AND user_id = ?) END "+
+		"FROM albums WHERE user_id = ? OR id IN (SELECT album_id FROM album_permissions WHERE user_id = ?) ORDER BY id",
+		userID, userID, userID, userID)
+	if err != nil {
+		return a, fmt.Errorf("failed to get albums: %w", err)
+	}
+	for albumRows.Next() {
+		al := exportAlbum{Photos: make([]int64, 0)}
+		if err := albumRows.Scan(&al.ID, &al.Name, &al.Description, &al.SortMode, &al.Query, &al.TrashedAt, &al.Role); err != nil {
+			albumRows.Close()
+			return a, fmt.Errorf("failed to scan album: %w", err)
+		}
+		a.Albums = append(a.Albums, al)
+	}
+	albumRows.Close()
+	for i := range a.Albums {
+		if a.Albums[i].Photos, err = queryIDs(tx, "SELECT photo_id FROM album_photos WHERE album_id = ? ORDER BY position, photo_id", a.Albums[i].ID); err != nil {
+			return a, fmt.Errorf("failed to get photos of album %v: %w", a.Albums[i].ID, err)
+		}
+	}
+
+	photoRows, err := tx.Query("SELECT id, filename, title, caption, alt_text, keywords, COALESCE(captured_at, ''), uploaded_at, COALESCE(trashed_at, ''), "+
+		"checksum, size, COALESCE(path, ''), key_id, wrapped_key FROM photos WHERE user_id = ? ORDER BY id", userID)
+	if err != nil {
+		return a, fmt.Errorf("failed to get photos: %w", err)
+	}
+	for photoRows.Next() {
+		p := exportPhoto{Albums: make([]exportAlbumRef, 0), Tags: make([]string, 0)}
+		var f photoFile
+		var keyID sql.NullString
+		var wrapped []byte
+		if err := photoRows.Scan(&p.ID, &p.Filename, &p.Title, &p.Caption, &p.AltText, &p.Keywords, &p.CapturedAt, &p.UploadedAt, &p.TrashedAt,
+			&p.Checksum, &p.Size, &f.Path, &keyID, &wrapped); err != nil {
+			photoRows.Close()
+			return a, fmt.Errorf("failed to scan photo: %w", err)
+		}
+		f.Key = scanBlobKey(keyID, wrapped)
+		a.files[p.ID] = f
+		a.photoIndex[p.ID] = len(a.photos)
+		a.photos = append(a.photos, p)
+	}
+	photoRows.Close()
+	a.Photos = len(a.photos)
+
+	memberRows, err := tx.Query("SELECT album_photos.photo_id, albums.id, albums.name FROM album_photos "+
+		"JOIN albums ON albums.id = album_photos.album_id JOIN photos ON photos.id = album_photos.photo_id "+
+		"WHERE photos.user_id = ? ORDER BY albums.id", userID)
+	if err != nil {
+		return a, fmt.Errorf("failed to get albums of photos: %w", err)
+	}
+	for memberRows.Next() {
+		var photoID int64
+		var al exportAlbumRef
+		if err := memberRows.Scan(&photoID, &al.ID, &al.Name); err != nil {
+			memberRows.Close()
+			return a, fmt.Errorf("failed to scan album of photo: %w", err)
+		}
+		p := &a.photos[a.photoIndex[photoID]]
+		p.Albums = append(p.Albums, al)
+	}
+	memberRows.Close()
+
+	for i := range a.photos {
+		if a.photos[i].Tags, err = store.WithTx(tx).PhotoTags(a.photos[i].ID); err != nil {
+			return a, err
+		}
+	}
+	if a.TaggedIn, err = store.WithTx(tx).TaggedPhotos(userID); err != nil {
+		return a, err
+	}
+	return a, nil
+}
+
+// returns a name for a photo in the archive that can't step outside photos/
+func exportFileName(p exportPhoto) string {
+	name := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r < ' ' {
+			return '_'
+		}
+		return r
+	}, path.Base(p.Filename))
+	if name == "." || name == "/" || name == "" {
+		return strconv.FormatInt(p.ID, 10)
+	}
+	return strconv.FormatInt(p.ID, 10) + "-" + name
+}
+
+// writes the archive for a to dst
+func writeExport(dst io.Writer, a exportAccount) error {
+	zw := zip.NewWriter(dst)
+	writeJSON := func(name string, v interface{}) error {
+		w, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+
+	for _, p := range a.photos {
+		f := a.files[p.ID]
+		if f.Path != "" {
+			name := "photos/" + exportFileName(p)
+			if err := copyExportPhoto(zw, name, f, p); err != nil {
+				// one unreadable photo shouldn't cost the user the rest, fsck reports it
+				log.Printf("failed to export photo %v: %s", p.ID, err)
+			} else {
+				p.File = name
+			}
+		}
+		if err := writeJSON("photos/"+exportFileName(p)+".json", p); err != nil {
+			return fmt.Errorf("failed to write sidecar of photo %v: %w", p.ID, err)
+		}
+	}
+	if err := writeJSON("account.json", a); err != nil {
+		return fmt.Errorf("failed to write account file: %w", err)
+	}
+	return zw.Close()
+}
+
+// adds a photo to the archive as it was uploaded. Photos are compressed already, so they're stored as they are
+func copyExportPhoto(zw *zip.Writer, name string, f photoFile, p exportPhoto) error {
+	src, err := openBlob(f.Path, f.Key)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	modified, _ := time.Parse(timeLayout, p.UploadedAt)
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: modified})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, src)
+	return err
+}
+
+// builds the archive for one export, returning where it was written and how big it is
+func buildExport(db *sql.DB, userID int64, token string) (string, int64, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	a, err := collectExport(userID, tx)
+	tx.Rollback()
+	if err != nil {
+		return "", 0, err
+	}
+
+	dir := filepath.Join(os.Getenv("SILSILA_PHOTO_PATH"), exportsDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", 0, fmt.Errorf("failed to create exports directory: %w", err)
+	}
+	dst := filepath.Join(dir, token+".zip")
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeExport(pw, a))
+	}()
+	size, err := writeFileAtomic(dst, pr)
+	pr.CloseWithError(err)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to write export: %w", err)
+	}
+	return dst, size, nil
+}
+
+// runExports builds every pending export, then removes the archives of exports that have expired and any file in
+// the exports directory that no export points at
+func runExports(db *sql.DB) error {
+	for {
+		var id, userID int64
+		var token string
+		err := db.QueryRow("SELECT id, user_id, token FROM exports WHERE state = 'pending' ORDER BY id LIMIT 1").Scan(&id, &userID, &token)
+		if err == sql.ErrNoRows {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get pending exports: %w", err)
+		}
+		if _, err := db.Exec("UPDATE exports SET state = 'running' WHERE id = ?", id); err != nil {
+			return fmt.Errorf("failed to start export %v: %w", id, err)
+		}
+		dst, size, err := buildExport(db, userID, token)
+		now := time.Now().UTC()
+		if err != nil {
+			log.Printf("failed to export user %v: %s", userID, err)
+			_, err = db.Exec("UPDATE exports SET state = 'failed', error = ?, finished_at = ? WHERE id = ?", err.Error(), now.Format(timeLayout), id)
+		} else {
+			_, err = db.Exec("UPDATE exports SET state = 'done', path = ?, size = ?, finished_at = ?, expires_at = ? WHERE id = ?",
+				dst, size, now.Format(timeLayout), now.Add(exportTTL).Format(timeLayout), id)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to finish export %v: %w", id, err)
+		}
+	}
+
+	_, err := db.Exec("UPDATE exports SET state = 'expired', path = NULL WHERE state = 'done' AND expires_at < ?",
+		time.Now().UTC().Format(timeLayout))
+	if err != nil {
+		return fmt.Errorf("failed to expire exports: %w", err)
+	}
+	rows, err := db.Query("SELECT path FROM exports WHERE state = 'done'")
+	if err != nil {
+		return fmt.Errorf("failed to get finished exports: %w", err)
+	}
+	keep := make(map[string]bool)
+	for rows.Next() {
+		var p string
+		if err := rows.Scan(&p); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan export: %w", err)
+		}
+		keep[filepath.Clean(p)] = true
+	}
+	rows.Close()
+	dir := filepath.Join(os.Getenv("SILSILA_PHOTO_PATH"), exportsDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to list exports: %w", err)
+	}
+	for _, e := range entries {
+		if p := filepath.Join(dir, e.Name()); !keep[p] {
+			if err := os.Remove(p); err != nil {
+				log.Printf("failed to remove old export %s: %s", p, err)
+			}
+		}
+	}
+	return nil
+}
+
+// startExporter builds requested exports and clears out expired ones every interval, until the program exits.
+// Exports that were running when the program last stopped are started over
+func startExporter(db *sql.DB, interval time.Duration) {
+	if _, err := db.Exec("UPDATE exports SET state = 'pending' WHERE state = 'running'"); err != nil {
+		log.Printf("failed to restart interrupted exports: %s", err)
+	}
+	go func() {
+		for {
+			if err := runExports(db); err != nil {
+				log.Printf("failed to run exports: %s", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// shows the session user's exports, and requests a new one when posted to
+func exportHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	userID, err := checkSesh(w, r, db)
+	if err != nil {
+		log.Printf("failed to validate user session: %s", err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("failed to begin transaction: %s", err)
+		return
+	}
+	defer tx.Rollback()
+
+	if r.Method == http.MethodPost {
+		if err := requestExport(userID, tx); err != nil {
+			log.Printf("%s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			log.Printf("%s", err)
+		}
+		http.Redirect(w, r, "/export/", http.StatusFound)
+		return
+	}
+
+	e := exportpage{UserID: userID, Exports: make([]exportInfo, 0)}
+	rows, err := tx.Query("SELECT token, state, size, error, requested_at, COALESCE(expires_at, '') FROM exports "+
+		"WHERE user_id = ? ORDER BY id DESC", userID)
+	if err != nil {
+		log.Printf("failed to get exports: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var x exportInfo
+		var size int64
+		if err := rows.Scan(&x.Token, &x.State, &size, &x.Error, &x.RequestedAt, &x.ExpiresAt); err != nil {
+			log.Printf("failed to scan export: %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		x.Size = formatBytes(size)
+		e.Busy = e.Busy || x.State == "pending" || x.State == "running"
+		e.Exports = append(e.Exports, x)
+	}
+
+	if err := e.render(w); err != nil {
+		log.Printf("failed to render html: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serves the archive of a finished export (/export/download/<token>) to the user it belongs to
+func exportDownloadHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	userID, err := checkSesh(w, r, db)
+	if err != nil {
+		log.Printf("failed to validate user session: %s", err)
+		return
+	}
+
+	var ownerID int64
+	var archive, requestedAt string
+	err = db.QueryRow("SELECT user_id, path, requested_at FROM exports WHERE token = ? AND state = 'done' AND expires_at >= ?",
+		path.Base(r.URL.Path), time.Now().UTC().Format(timeLayout)).Scan(&ownerID, &archive, &requestedAt)
+	if err != nil || ownerID != userID {
+		log.Printf("user %v can't download export %s: %v", userID, path.Base(r.URL.Path), err)
+		http.Error(w, "that export doesn't exist or has expired", http.StatusNotFound)
+		return
+	}
+
+	f, err := os.Open(archive)
+	if err != nil {
+		log.Printf("failed to open export: %s", err)
+		http.Error(w, "failed to open export", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	day, _, _ := strings.Cut(requestedAt, " ")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"photoapp-export-%s.zip\"", day))
+	w.Header().Set("Content-Type", "application/zip")
+	http.ServeContent(w, r, "", time.Time{}, f)
+}
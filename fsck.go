@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// quarantineDir is where fsck -repair moves files in the photo directory that no photo points at
+const quarantineDir = "quarantine"
+
+// orphanGrace is how old a file has to be before fsck calls it an orphan. Uploads are written to the photo directory
+// before their row is committed, so a newer file may well belong to an upload that's still going on
+const orphanGrace = time.Hour
+
+// fsckReport lists everything fsck found wrong with the photo store
+type fsckReport struct {
+	Checked int
+	Missing []int64  // photos whose file doesn't exist
+	Corrupt []int64  // photos whose file doesn't match the checksum taken at upload
+	Orphans []string // files in the photo directory that no photo points at
+}
+
+func (r fsckReport) ok() bool {
+	return len(r.Missing) == 0 && len(r.Corrupt) == 0 && len(r.Orphans) == 0
+}
+
+func (r fsckReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "checked %v photos: %v missing, %v corrupt, %v orphaned files\n", r.Checked, len(r.Missing), len(r.Corrupt), len(r.Orphans))
+	for _, id := range r.Missing {
+		fmt.Fprintf(&b, "missing: photo %v\n", id)
+	}
+	for _, id := range r.Corrupt {
+		fmt.Fprintf(&b, "corrupt: photo %v\n", id)
+	}
+	for _, p := range r.Orphans {
+		fmt.Fprintf(&b, "orphan: %s\n", p)
+	}
+	return b.String()
+}
+
+// hashBlob returns the hex encoded sha256 of the photo stored at p, decrypting it with key if it's encrypted
+func hashBlob(p string, key blobKey) (string, error) {
+	f, err := openBlob(p, key)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fsck cross-checks the photos table against the files in dir. With repair set, photos with a missing or corrupt
+// file are marked broken, photos that check out again are unmarked, photos from before checksums were taken get
+// one, and orphaned files are moved to the quarantine directory
+func fsck(db *sql.DB, dir string, repair bool) (fsckReport, error) {
+	report := fsckReport{}
+
+	type storedPhoto struct {
+		id       int64
+		path     string
+		checksum string
+		key      blobKey
+	}
+	rows, err := db.Query("SELECT id, path, checksum, key_id, wrapped_key FROM photos WHERE path IS NOT NULL")
+	if err != nil {
+		return report, fmt.Errorf("failed to get photos: %w", err)
+	}
+	photos := make([]storedPhoto, 0)
+	for rows.Next() {
+		var p storedPhoto
+		var keyID sql.NullString
+		var wrapped []byte
+		if err := rows.Scan(&p.id, &p.path, &p.checksum, &keyID, &wrapped); err != nil {
+			rows.Close()
+			return report, fmt.Errorf("failed to scan photo: %w", err)
+		}
+		p.key = scanBlobKey(keyID, wrapped)
+		photos = append(photos, p)
+	}
+	rows.Close()
+
+	known := make(map[string]bool)
+	for _, p := range photos {
+		known[filepath.Clean(p.path)] = true
+		report.Checked++
+
+		broken := ""
+		sum, err := hashBlob(p.path, p.key)
+		switch {
+		case os.IsNotExist(err):
+			broken = "missing"
+			report.Missing = append(report.Missing, p.id)
+		case errors.Is(err, errBlobCorrupt):
+			broken = "corrupt"
+			report.Corrupt = append(report.Corrupt, p.id)
+		case err != nil:
+			return report, fmt.Errorf("failed to read photo %v: %w", p.id, err)
+		case p.checksum != "" && sum != p.checksum:
+			broken = "corrupt"
+			report.Corrupt = append(report.Corrupt, p.id)
+		}
+		if !repair {
+			continue
+		}
+		if p.checksum == "" && broken == "" {
+			if _, err := db.Exec("UPDATE photos SET checksum = ? WHERE id = ?", sum, p.id); err != nil {
+				return report, fmt.Errorf("failed to save checksum of photo %v: %w", p.id, err)
+			}
+		}
+		if _, err := db.Exec("UPDATE photos SET broken = NULLIF(?, '') WHERE id = ?", broken, p.id); err != nil {
+			return report, fmt.Errorf("failed to mark photo %v: %w", p.id, err)
+		}
+	}
+
+	// files waiting in the cleanup queue are on their way out and aren't orphans
+	queued, err := db.Query("SELECT path FROM file_cleanup")
+	if err != nil {
+		return report, fmt.Errorf("failed to read cleanup queue: %w", err)
+	}
+	for queued.Next() {
+		var p string
+		if err := queued.Scan(&p); err != nil {
+			queued.Close()
+			return report, fmt.Errorf("failed to scan cleanup queue: %w", err)
+		}
+		known[filepath.Clean(p)] = true
+	}
+	queued.Close()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return report, fmt.Errorf("failed to list photo directory: %w", err)
+	}
+	for _, e := range entries {
+		p := filepath.Join(dir, e.Name())
+		// .upload-* files are uploads still being written by writeFileAtomic
+		if e.IsDir() || known[p] || strings.HasPrefix(e.Name(), ".upload-") {
+			continue
+		}
+		info, err := e.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return report, fmt.Errorf("failed to get info about %s: %w", p, err)
+		}
+		if time.Since(info.ModTime()) < orphanGrace {
+			continue
+		}
+		report.Orphans = append(report.Orphans, p)
+		if !repair {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Join(dir, quarantineDir), 0700); err != nil {
+			return report, fmt.Errorf("failed to create quarantine directory: %w", err)
+		}
+		if err := os.Rename(p, filepath.Join(dir, quarantineDir, e.Name())); err != nil {
+			return report, fmt.Errorf("failed to quarantine %s: %w", p, err)
+		}
+	}
+	return report, nil
+}
+
+// startFsck checks the photo store every interval and logs what it finds, without repairing anything
+func startFsck(db *sql.DB, dir string, interval time.Duration) {
+	go func() {
+		for {
+			time.Sleep(interval)
+			report, err := fsck(db, dir, false)
+			if err != nil {
+				log.Printf("failed to check photo store: %s", err)
+				continue
+			}
+			if !report.ok() {
+				log.Printf("photo store check found problems:\n%s", report)
+			}
+		}
+	}()
+}
@@ -1,15 +1,8 @@
-CREATE TABLE users (id INTEGER PRIMARY KEY, email TEXT UNIQUE, password TEXT UNIQUE);
-CREATE TABLE albums (id INTEGER PRIMARY KEY, user_id INTEGER REFERENCES users(id), name TEXT NOT NULL);
-CREATE TABLE photos (id INTEGER PRIMARY KEY, album_id INTEGER REFERENCES albums(id), user_id INTEGER REFERENCES users(id), path TEXT UNIQUE);
-CREATE TABLE album_permissions (album_id INTEGER REFERENCES albums(id), user_id INTEGER REFERENCES users(id));
-CREATE TABLE sessions (user_id INTEGER REFERENCES users(id), session_id TEXT UNIQUE);
-CREATE TABLE tags (photo_id INTEGER REFERENCES photos(id), user_id INTEGER REFERENCES users(id));
-CREATE TABLE invites (email TEXT UNIQUE, link TEXT UNIQUE);
-INSERT INTO users (email, password) VALUES ('u1@e.com', '$2a$10$TCRWGbqSjIeS7IXZ.L/PYefrGuQoIclp/OYwSRIORIa4137lEI/BC');
-INSERT INTO users (email, password) VALUES ('u2@e.com', '$2a$10$7rZ2bP0DV2t6qWPZZYT8MeouCGVYtfRMe1s50iq97YvLilYauK6FS'); 
-INSERT INTO albums (user_id, name) VALUES (1, '1 main');
-INSERT INTO albums (user_id, name) VALUES (2, '2 main');
-INSERT INTO album_permissions (album_id, user_id) VALUES (1,1);
-INSERT INTO album_permissions (album_id, user_id) VALUES (2,2);
-INSERT INTO photos (album_id, user_id, path) VALUES (1, 1, '/Users/ben/Documents/photoApp/Photos/1.jpg');
-INSERT INTO photos (album_id, user_id, path) VALUES (1, 1, '/Users/ben/Documents/photoApp/Photos/2.png');
\ No newline at end of file
+-- sample data for a development database, load it once the migrations have run and the sample users have been made
+-- with the user command, which gives each of them their first album:
+--   photoapp user create -email u1@e.com -password <password>
+--   photoapp user create -email u2@e.com -password <password>
+INSERT INTO photos (user_id, path, filename) VALUES (1, '/Users/ben/Documents/photoApp/Photos/1.jpg', '1.jpg');
+INSERT INTO photos (user_id, path, filename) VALUES (1, '/Users/ben/Documents/photoApp/Photos/2.png', '2.png');
+INSERT INTO album_photos (album_id, photo_id, position) VALUES (1, 1, 1);
+INSERT INTO album_photos (album_id, photo_id, position) VALUES (1, 2, 2);
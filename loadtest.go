@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// the load test runs the same mix of uploads and page views against a scratch database twice, once opened the way
+// the app used to open it, with a single pool on the driver's defaults, and once the way it opens it now, so the two
+// can be compared. The app's own database isn't touched
+
+type loadResult struct {
+	setup      string
+	writes     int64
+	reads      int64
+	lockErrors int64
+	errors     int64
+	elapsed    time.Duration
+}
+
+// runs workers against read and write for d, each doing a write with probability writeShare and a read otherwise
+func runLoad(setup string, read *sql.DB, write *sql.DB, workers int, d time.Duration, writeShare float64) (loadResult, error) {
+	res := loadResult{setup: setup}
+	if err := migrateUp(write, 0); err != nil {
+		return res, err
+	}
+	var userID, albumID int64
+	if err := write.QueryRow("INSERT INTO users (email) VALUES ('load@example.com') RETURNING id").Scan(&userID); err != nil {
+		return res, fmt.Errorf("failed to add user: %w", err)
+	}
+	if err := write.QueryRow("INSERT INTO albums (user_id, name) VALUES (?, 'load') RETURNING id", userID).Scan(&albumID); err != nil {
+		return res, fmt.Errorf("failed to add album: %w", err)
+	}
+
+	count := func(err error) {
+		var sqliteErr sqlite3.Error
+		switch {
+		case err == nil:
+		case errors.As(err, &sqliteErr) && (sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked):
+			atomic.AddInt64(&res.lockErrors, 1)
+		default:
+			atomic.AddInt64(&res.errors, 1)
+		}
+	}
+	deadline := time.Now().Add(d)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(rng *rand.Rand) {
+			defer wg.Done()
+			for time.Now().Before(deadline) {
+				if rng.Float64() < writeShare {
+					err := loadWrite(write, userID, albumID)
+					if err == nil {
+						atomic.AddInt64(&res.writes, 1)
+					}
+					count(err)
+				} else {
+					err := loadRead(read, albumID)
+					if err == nil {
+						atomic.AddInt64(&res.reads, 1)
+					}
+					count(err)
+				}
+			}
+		}(rand.New(rand.NewSource(int64(i))))
+	}
+	start := time.Now()
+	wg.Wait()
+	res.elapsed = time.Since(start)
+	return res, nil
+}
+
+// does what an upload does to the database
+func loadWrite(db *sql.DB, userID int64, albumID int64) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// uploads read before they write, which is where a transaction that didn't take the lock up front gets stuck
+	s := newSQLiteStore(db).WithTx(tx)
+	if _, err := s.HasRole(albumID, userID, "contributor"); err != nil {
+		return err
+	}
+	if err := checkQuotas(userID, albumID, tx); err != nil {
+		return err
+	}
+	photoID, err := s.CreatePhoto(userID, "load.jpg")
+	if err != nil {
+		return err
+	}
+	if err := addToAlbum(photoID, albumID, tx); err != nil {
+		return err
+	}
+	if err := s.SetPhotoFile(photoID, photoFile{Path: fmt.Sprintf("/load/%v", photoID), Size: 1}); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// does what showing an album does to the database
+func loadRead(db *sql.DB, albumID int64) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var n int
+	if err := tx.QueryRow("SELECT count(*) FROM album_photos WHERE album_id = ?", albumID).Scan(&n); err != nil {
+		return err
+	}
+	rows, err := tx.Query("SELECT photos.id, title, caption, alt_text FROM photos JOIN album_photos ON photos.id = album_photos.photo_id "+
+		"WHERE album_id = ? AND trashed_at IS NULL ORDER BY position DESC LIMIT 50", albumID)
+	if err != nil {
+		return err
+	}
+	_, err = scanPhotoInfos(rows)
+	rows.Close()
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// loadtest [-workers n] [-duration d] [-writes share] compares throughput and lock errors of the old and the
+// current way of opening the database
+func loadTestCommand(args []string) error {
+	fs := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	workers := fs.Int("workers", 32, "number of concurrent clients")
+	d := fs.Duration("duration", 10*time.Second, "how long to run each setup for")
+	writeShare := fs.Float64("writes", 0.3, "share of requests that write, between 0 and 1")
+	fs.Parse(args)
+
+	dir, err := os.MkdirTemp("", "photoapp-loadtest-")
+	if err != nil {
+		return fmt.Errorf("failed to create scratch directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	results := make([]loadResult, 0, 2)
+	for _, setup := range []string{"defaults", "tuned"} {
+		dbPath := filepath.Join(dir, setup+".db")
+		var read, write *sql.DB
+		if setup == "defaults" {
+			write, err = sql.Open("sqlite3", dbPath)
+			read = write
+		} else {
+			read, write, err = openSQLite(dbPath)
+		}
+		if err != nil {
+			return err
+		}
+		res, err := runLoad(setup, read, write, *workers, *d, *writeShare)
+		read.Close()
+		write.Close()
+		if err != nil {
+			return fmt.Errorf("failed to run %s setup: %w", setup, err)
+		}
+		results = append(results, res)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintf(tw, "setup\tops/s\twrites\treads\tlock errors\tother errors\t\n")
+	for _, res := range results {
+		ops := float64(res.writes+res.reads) / res.elapsed.Seconds()
+		fmt.Fprintf(tw, "%s\t%.0f\t%v\t%v\t%v\t%v\t\n", res.setup, ops, res.writes, res.reads, res.lockErrors, res.errors)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+)
+
+// a photo is stored once and listed in albums through album_photos: album_id|photo_id|position|added_at
+// a photo that isn't in any album anymore goes to its owner's trash
+
+// adds a photo to the end of an album, doing nothing if it's already there
+func addToAlbum(photoID int64, albumID int64, tx *sql.Tx) error {
+	_, err := tx.Exec("INSERT OR IGNORE INTO album_photos (album_id, photo_id, position) "+
+		"VALUES (?, ?, (SELECT COALESCE(MAX(position), 0) + 1 FROM album_photos WHERE album_id = ?))", albumID, photoID, albumID)
+	if err != nil {
+		return fmt.Errorf("failed to add photo %v to album %v: %w", photoID, albumID, err)
+	}
+	return nil
+}
+
+// takes a photo out of an album. If that was the last album the photo was in, it's moved to the trash
+func removeFromAlbum(photoID int64, albumID int64, tx *sql.Tx) error {
+	if _, err := tx.Exec("DELETE FROM album_photos WHERE album_id = ? AND photo_id = ?", albumID, photoID); err != nil {
+		return fmt.Errorf("failed to remove photo %v from album %v: %w", photoID, albumID, err)
+	}
+	return trashIfOrphaned(photoID, tx)
+}
+
+// moves a photo to the trash if it isn't in an album anymore
+func trashIfOrphaned(photoID int64, tx *sql.Tx) error {
+	_, err := tx.Exec("UPDATE photos SET trashed_at = CURRENT_TIMESTAMP "+
+		"WHERE id = ? AND trashed_at IS NULL AND NOT EXISTS (SELECT 1 FROM album_photos WHERE photo_id = ?)", photoID, photoID)
+	if err != nil {
+		return fmt.Errorf("failed to move photo %v to the trash: %w", photoID, err)
+	}
+	return nil
+}
+
+// checks if the photo is listed in the album
+func inAlbum(photoID int64, albumID int64, tx *sql.Tx) bool {
+	var n int
+	if err := tx.QueryRow("SELECT count(*) FROM album_photos WHERE photo_id = ? AND album_id = ?", photoID, albumID).Scan(&n); err != nil {
+		log.Printf("failed to access album_photos: %s", err)
+		return false
+	}
+	return n > 0
+}
+
+// checks if the given user has contributor rights in any album the photo is in
+func checkPhotoContributor(photoID int64, userID int64, tx *sql.Tx) bool {
+	rows, err := tx.Query("SELECT album_id FROM album_photos WHERE photo_id = ?", photoID)
+	if err != nil {
+		log.Printf("failed to get albums of photo %v: %s", photoID, err)
+		return false
+	}
+	albums := make([]int64, 0)
+	for rows.Next() {
+		var albumID int64
+		if err := rows.Scan(&albumID); err != nil {
+			log.Printf("failed to scan album id: %s", err)
+			rows.Close()
+			return false
+		}
+		albums = append(albums, albumID)
+	}
+	rows.Close()
+	for _, albumID := range albums {
+		if checkContributor(albumID, userID, tx) {
+			return true
+		}
+	}
+	return false
+}
+
+// albumRef is an album as listed in menus and links
+type albumRef struct {
+	ID   int64
+	Name string
+}
+
+// lists the albums a photo is in
+func photoAlbums(photoID int64, tx *sql.Tx) ([]albumRef, error) {
+	rows, err := tx.Query("SELECT albums.id, albums.name FROM albums JOIN album_photos ON albums.id = album_photos.album_id "+
+		"WHERE album_photos.photo_id = ? AND albums.trashed_at IS NULL ORDER BY albums.id", photoID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get albums of photo %v: %w", photoID, err)
+	}
+	defer rows.Close()
+	return scanAlbumRefs(rows)
+}
+
+// lists the albums the user can add photos to, which smart albums aren't
+func contributorAlbums(userID int64, tx *sql.Tx) ([]albumRef, error) {
+	rows, err := tx.Query("SELECT id, name FROM albums WHERE trashed_at IS NULL AND query IS NULL AND (user_id = ? "+
+		"OR id IN (SELECT album_id FROM album_permissions WHERE user_id = ? AND role = 'contributor')) ORDER BY id", userID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get albums of user %v: %w", userID, err)
+	}
+	defer rows.Close()
+	return scanAlbumRefs(rows)
+}
+
+func scanAlbumRefs(rows *sql.Rows) ([]albumRef, error) {
+	albums := make([]albumRef, 0)
+	for rows.Next() {
+		var a albumRef
+		if err := rows.Scan(&a.ID, &a.Name); err != nil {
+			return nil, fmt.Errorf("failed to scan album: %w", err)
+		}
+		albums = append(albums, a)
+	}
+	return albums, rows.Err()
+}
+
+// parses the photo id at the end of the URL and the album ids named by the given form fields
+func parseMembershipForm(r *http.Request, fields ...string) (int64, []int64, error) {
+	photoID, err := strconv.ParseInt(path.Base(r.URL.Path), 10, 64)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to get photo id: %w", err)
+	}
+	albums := make([]int64, len(fields))
+	for i, field := range fields {
+		albums[i], err = strconv.ParseInt(r.PostFormValue(field), 10, 64)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to get album id from %s: %w", field, err)
+		}
+	}
+	return photoID, albums, nil
+}
+
+// changeMembership runs change on the photo and albums named in the request after making sure the session user
+// is a contributor to every one of those albums and to an album the photo is already in, then redirects to the
+// page change returns
+func changeMembership(w http.ResponseWriter, r *http.Request, db *sql.DB, change func(photoID int64, albums []int64, tx *sql.Tx) (string, error), fields ...string) {
+	userID, err := checkSesh(w, r, db)
+	if err != nil {
+		log.Printf("failed to validate user session: %s", err)
+		return
+	}
+	photoID, albums, err := parseMembershipForm(r, fields...)
+	if err != nil {
+		log.Printf("%s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("failed to begin transaction: %s", err)
+		return
+	}
+	defer tx.Rollback()
+
+	for _, albumID := range albums {
+		if !checkContributor(albumID, userID, tx) {
+			log.Printf("user %v isn't a contributor to album %v", userID, albumID)
+			http.Error(w, "you don't have contributor rights for that album", http.StatusForbidden)
+			return
+		}
+	}
+	if !checkPhotoContributor(photoID, userID, tx) {
+		log.Printf("user %v isn't a contributor to any album with photo %v", userID, photoID)
+		http.Error(w, "you don't have contributor rights for that photo", http.StatusForbidden)
+		return
+	}
+	next, err := change(photoID, albums, tx)
+	if err != nil {
+		log.Printf("%s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("%s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, next, http.StatusFound)
+}
+
+// the photo page, opened in the context of the given album
+func photoURL(photoID int64, albumID int64) string {
+	return fmt.Sprintf("/photo/%d?album=%d", photoID, albumID)
+}
+
+// moves a photo from the POSTed "from" album to the "to" album
+func movePhotoHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	changeMembership(w, r, db, func(photoID int64, albums []int64, tx *sql.Tx) (string, error) {
+		if albums[0] == albums[1] || !inAlbum(photoID, albums[0], tx) {
+			return photoURL(photoID, albums[0]), nil
+		}
+		if err := addToAlbum(photoID, albums[1], tx); err != nil {
+			return "", err
+		}
+		return photoURL(photoID, albums[1]), removeFromAlbum(photoID, albums[0], tx)
+	}, "from", "to")
+}
+
+// adds a photo to the POSTed "to" album as well as the ones it's already in
+func copyPhotoHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	changeMembership(w, r, db, func(photoID int64, albums []int64, tx *sql.Tx) (string, error) {
+		return photoURL(photoID, albums[0]), addToAlbum(photoID, albums[0], tx)
+	}, "to")
+}
+
+// takes a photo out of the POSTed album, sending it to the trash if it isn't in any other album
+func removePhotoHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	changeMembership(w, r, db, func(photoID int64, albums []int64, tx *sql.Tx) (string, error) {
+		return path.Join("/album/", strconv.FormatInt(albums[0], 10)), removeFromAlbum(photoID, albums[0], tx)
+	}, "album")
+}
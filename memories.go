@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// memories are the photos taken on today's date in earlier years, in albums the user can see. Once a day
+// prepareMemories picks each user's memories into memory_days and memories, so they don't change through the day, and
+// emails them to the users who asked for a digest. A user can dismiss a day's memories or hide a photo from them for
+// good (see migrations/0014_memories.up.sql)
+
+// memoryLimit is the most photos a day's memories hold
+const memoryLimit = 24
+
+// memoryKeep is how long prepared memories are kept
+const memoryKeep = 7 * 24 * time.Hour
+
+// dayLayout is the format of memory_days.day
+const dayLayout = "2006-01-02"
+
+// digestMailer sends memory digests, set up by -smtp-addr. When it's nil no email is sent
+var digestMailer mailer
+
+// publicURL is where the site is reached, set by -public-url, for links in emails
+var publicURL string
+
+// mailer sends emails
+type mailer interface {
+	Send(to string, subject string, body string) error
+}
+
+// smtpMailer sends plain text emails through an SMTP server
+type smtpMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+// newSMTPMailer returns a mailer sending from the address from through the SMTP server at addr (host:port),
+// logging in if user isn't empty
+func newSMTPMailer(addr string, from string, user string, password string) (smtpMailer, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return smtpMailer{}, fmt.Errorf("bad smtp address %q: %w", addr, err)
+	}
+	m := smtpMailer{addr: addr, from: from}
+	if user != "" {
+		m.auth = smtp.PlainAuth("", user, password, host)
+	}
+	return m, nil
+}
+
+func (m smtpMailer) Send(to string, subject string, body string) error {
+	msg := "From: " + m.from + "\r\nTo: " + to + "\r\nSubject: " + subject +
+		"\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n" + strings.ReplaceAll(body, "\n", "\r\n")
+	if err := smtp.SendMail(m.addr, m.auth, m.from, []string{to}, []byte(msg)); err != nil {
+		return fmt.Errorf("failed to send email to %s: %w", to, err)
+	}
+	return nil
+}
+
+// memory is a photo from the same day in an earlier year
+type memory struct {
+	photoInfo
+	TakenAt  string
+	YearsAgo int
+}
+
+// memoryDates returns the month and day (MM-DD) of the photos that are memories on day. Photos from the 29th of
+// February turn up on the 28th in other years
+func memoryDates(day time.Time) []string {
+	dates := []string{day.Format("01-02")}
+	if day.Month() == time.February && day.Day() == 28 && day.AddDate(0, 0, 1).Month() == time.March {
+		dates = append(dates, "02-29")
+	}
+	return dates
+}
+
+// pickMemories saves userID's memories for day, unless they've been picked already
+func pickMemories(userID int64, day time.Time, tx *sql.Tx) error {
+	var n int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM memory_days WHERE user_id = ? AND day = ?", userID, day.Format(dayLayout)).Scan(&n); err != nil {
+		return fmt.Errorf("failed to check memories of user %v: %w", userID, err)
+	}
+	if n > 0 {
+		return nil
+	}
+	if _, err := tx.Exec("INSERT INTO memory_days (user_id, day) VALUES (?, ?)", userID, day.Format(dayLayout)); err != nil {
+		return fmt.Errorf("failed to save memories of user %v: %w", userID, err)
+	}
+
+	dates := memoryDates(day)
+	args := []interface{}{userID, userID, userID}
+	for _, d := range dates {
+		args = append(args, d)
+	}
+	args = append(args, strconv.Itoa(day.Year())+"-01-01", memoryLimit)
+	ids, err := queryIDs(tx, "SELECT photos.id FROM photos WHERE photos.trashed_at IS NULL "+
+		"AND photos.id IN (SELECT photo_id FROM album_photos WHERE album_id IN ("+accessibleAlbumsSQL+")) "+
+		"AND photos.id NOT IN (SELECT photo_id FROM hidden_memories WHERE user_id = ?) "+
+		"AND substr("+takenSQL+", 6, 5) IN (?"+strings.Repeat(", ?", len(dates)-1)+") AND "+takenSQL+" < ? "+
+		"ORDER BY "+takenSQL+" DESC, photos.id LIMIT ?", args...)
+	if err != nil {
+		return fmt.Errorf("failed to find memories of user %v: %w", userID, err)
+	}
+	for _, id := range ids {
+		if _, err := tx.Exec("INSERT INTO memories (user_id, day, photo_id) VALUES (?, ?, ?)", userID, day.Format(dayLayout), id); err != nil {
+			return fmt.Errorf("failed to save memory of user %v: %w", userID, err)
+		}
+	}
+	return nil
+}
+
+// prepareMemories picks the memories of every user who isn't disabled for day, drops the ones older than
+// memoryKeep, and emails the day's memories to the users who asked for a digest if m isn't nil
+func prepareMemories(db *sql.DB, day time.Time, m mailer) error {
+	var users []int64
+	err := inTx(db, func(tx *sql.Tx) error {
+		var err error
+		users, err = queryIDs(tx, "SELECT id FROM users WHERE disabled_at IS NULL")
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get users: %w", err)
+	}
+	// one user's memories failing doesn't hold up everyone else's
+	failed := 0
+	for _, userID := range users {
+		if err := inTx(db, func(tx *sql.Tx) error { return pickMemories(userID, day, tx) }); err != nil {
+			log.Printf("%s", err)
+			failed++
+		}
+	}
+	var pickErr error
+	if failed > 0 {
+		pickErr = fmt.Errorf("failed to pick memories of %v of %v users", failed, len(users))
+	}
+	err = inTx(db, func(tx *sql.Tx) error {
+		_, err := tx.Exec("DELETE FROM memory_days WHERE day < ?", day.Add(-memoryKeep).Format(dayLayout))
+		return err
+	})
+	if err != nil {
+		return errors.Join(pickErr, fmt.Errorf("failed to drop old memories: %w", err))
+	}
+	if m == nil {
+		return pickErr
+	}
+	return errors.Join(pickErr, sendDigests(db, day, m))
+}
+
+// sendDigests emails day's memories to the users who asked for a digest and haven't had one for day yet
+func sendDigests(db *sql.DB, day time.Time, m mailer) error {
+	type recipient struct {
+		userID int64
+		email  string
+	}
+	recipients := make([]recipient, 0)
+	err := inTx(db, func(tx *sql.Tx) error {
+		rows, err := tx.Query("SELECT users.id, users.email FROM memory_days JOIN users ON users.id = memory_days.user_id "+
+			"WHERE memory_days.day = ? AND memory_days.emailed_at IS NULL AND memory_days.dismissed_at IS NULL "+
+			"AND users.memory_digest_since IS NOT NULL AND users.disabled_at IS NULL", day.Format(dayLayout))
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var r recipient
+			if err := rows.Scan(&r.userID, &r.email); err != nil {
+				return err
+			}
+			recipients = append(recipients, r)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get digest recipients: %w", err)
+	}
+	// sending can take a while, so it happens with no transaction holding the write connection. A digest that can't
+	// be sent is tried again on the next run, and doesn't stop the others
+	failed := 0
+	for _, r := range recipients {
+		if err := sendDigest(db, r.userID, r.email, day, m); err != nil {
+			log.Printf("%s", err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to send memories to %v of %v users", failed, len(recipients))
+	}
+	return nil
+}
+
+// sendDigest emails day's memories to userID at email and marks them emailed
+func sendDigest(db *sql.DB, userID int64, email string, day time.Time, m mailer) error {
+	var memories []memory
+	err := inTx(db, func(tx *sql.Tx) (err error) {
+		memories, err = dayMemories(userID, day, tx)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to get memories of user %v: %w", userID, err)
+	}
+	if len(memories) > 0 {
+		if err := m.Send(email, "On this day", memoryDigest(memories)); err != nil {
+			return fmt.Errorf("failed to send memories to user %v: %w", userID, err)
+		}
+	}
+	// days without memories are marked too so they aren't looked at again
+	err = inTx(db, func(tx *sql.Tx) error {
+		_, err := tx.Exec("UPDATE memory_days SET emailed_at = ? WHERE user_id = ? AND day = ?",
+			time.Now().UTC().Format(timeLayout), userID, day.Format(dayLayout))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to mark memories of user %v emailed: %w", userID, err)
+	}
+	return nil
+}
+
+// memoryDigest returns the body of an email with memories in it
+func memoryDigest(memories []memory) string {
+	var b strings.Builder
+	b.WriteString("Photos from this day in earlier years:\n\n")
+	for _, m := range memories {
+		title := m.Title
+		if title == "" {
+			title = "a photo"
+		}
+		fmt.Fprintf(&b, "%s, %s: %s\n", yearsAgo(m.YearsAgo), formatDate(m.TakenAt), title)
+		if publicURL != "" {
+			fmt.Fprintf(&b, "%s/photo/%v\n", strings.TrimRight(publicURL, "/"), m.ID)
+		}
+	}
+	return b.String()
+}
+
+// yearsAgo describes how many years ago a memory is from
+func yearsAgo(n int) string {
+	if n == 1 {
+		return "1 year ago"
+	}
+	return strconv.Itoa(n) + " years ago"
+}
+
+// dayMemories returns userID's memories for day that are still to be shown: the day hasn't been dismissed, and the
+// photos aren't hidden, trashed or out of the user's reach since they were picked
+func dayMemories(userID int64, day time.Time, tx *sql.Tx) ([]memory, error) {
+	rows, err := tx.Query("SELECT photos.id, photos.title, photos.caption, photos.alt_text, "+takenSQL+" FROM memories "+
+		"JOIN memory_days ON memory_days.user_id = memories.user_id AND memory_days.day = memories.day "+
+		"JOIN photos ON photos.id = memories.photo_id "+
+		"WHERE memories.user_id = ? AND memories.day = ? AND memory_days.dismissed_at IS NULL AND photos.trashed_at IS NULL "+
+		"AND photos.id NOT IN (SELECT photo_id FROM hidden_memories WHERE user_id = ?) "+
+		"AND photos.id IN (SELECT photo_id FROM album_photos WHERE album_id IN ("+accessibleAlbumsSQL+")) "+
+		"ORDER BY "+takenSQL+" DESC, photos.id", userID, day.Format(dayLayout), userID, userID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get memories of user %v: %w", userID, err)
+	}
+	defer rows.Close()
+	memories := make([]memory, 0)
+	for rows.Next() {
+		var m memory
+		if err := rows.Scan(&m.ID, &m.Title, &m.Caption, &m.AltText, &m.TakenAt); err != nil {
+			return nil, fmt.Errorf("failed to scan memory: %w", err)
+		}
+		if taken, err := time.Parse(timeLayout, m.TakenAt); err == nil {
+			m.YearsAgo = day.Year() - taken.Year()
+		}
+		memories = append(memories, m)
+	}
+	return memories, rows.Err()
+}
+
+// startMemories prepares the day's memories every interval in the background, so they're ready soon after midnight
+func startMemories(db *sql.DB, m mailer, interval time.Duration) {
+	go func() {
+		for {
+			if err := prepareMemories(db, time.Now(), m); err != nil {
+				log.Printf("failed to prepare memories: %s", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// prepares the memories of a day now, emailing digests if -smtp-addr is set
+func memoriesCommand(args []string, db *sql.DB) error {
+	fs := flag.NewFlagSet("memories", flag.ExitOnError)
+	date := fs.String("date", "", "day to prepare memories for as YYYY-MM-DD, defaults to today")
+	fs.Parse(args)
+
+	day := time.Now()
+	if *date != "" {
+		var err error
+		if day, err = time.Parse(dayLayout, *date); err != nil {
+			return fmt.Errorf("bad date %q: %w", *date, err)
+		}
+	}
+	return prepareMemories(db, day, digestMailer)
+}
+
+// POSTs to /memories/dismiss (with the day shown), /memories/hide (with a photo) and /memories/digest (on or off)
+// dismiss the session user's memories, hide a photo from them, and turn the email digest on or off
+func memoriesHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	userID, err := checkSesh(w, r, db)
+	if err != nil {
+		log.Printf("failed to validate user session: %s", err)
+		return
+	}
+	home := path.Join("/home/", strconv.FormatInt(userID, 10))
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, home, http.StatusFound)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("failed to begin transaction: %s", err)
+		return
+	}
+	defer tx.Rollback()
+
+	switch path.Base(r.URL.Path) {
+	case "dismiss":
+		_, err = tx.Exec("UPDATE memory_days SET dismissed_at = ? WHERE user_id = ? AND day = ?",
+			time.Now().UTC().Format(timeLayout), userID, r.PostFormValue("day"))
+	case "hide":
+		var photoID int64
+		if photoID, err = strconv.ParseInt(r.PostFormValue("photo"), 10, 64); err != nil {
+			http.Error(w, "bad photo id", http.StatusBadRequest)
+			return
+		}
+		// only photos that have come up as memories can be hidden from them
+		_, err = tx.Exec("INSERT INTO hidden_memories (user_id, photo_id) SELECT ?, ? "+
+			"WHERE EXISTS (SELECT 1 FROM memories WHERE user_id = ? AND photo_id = ?) "+
+			"AND NOT EXISTS (SELECT 1 FROM hidden_memories WHERE user_id = ? AND photo_id = ?)",
+			userID, photoID, userID, photoID, userID, photoID)
+	case "digest":
+		if r.PostFormValue("digest") == "on" {
+			_, err = tx.Exec("UPDATE users SET memory_digest_since = ? WHERE id = ? AND memory_digest_since IS NULL",
+				time.Now().UTC().Format(timeLayout), userID)
+		} else {
+			_, err = tx.Exec("UPDATE users SET memory_digest_since = NULL WHERE id = ?", userID)
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("failed to change memories of user %v: %s", userID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, home, http.StatusFound)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"flag"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// the schema is built by the numbered scripts in migrations/, NNNN_name.up.sql to apply a version and
+// NNNN_name.down.sql to undo it. schema_migrations: version!|name|applied_at records which have run. Every change to
+// the schema is a new migration; applied ones are never edited
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+type migration struct {
+	version int
+	name    string
+	up      string
+	down    string
+}
+
+// reads the embedded migrations, ordered by version
+func loadMigrations() ([]migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list migrations: %w", err)
+	}
+	byVersion := make(map[int]*migration)
+	for _, e := range entries {
+		base := e.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(base, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(base, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("migration %s isn't named NNNN_name.up.sql or NNNN_name.down.sql", base)
+		}
+		stem := strings.TrimSuffix(base, "."+direction+".sql")
+		num, name, ok := strings.Cut(stem, "_")
+		version, err := strconv.Atoi(num)
+		if !ok || err != nil || version <= 0 {
+			return nil, fmt.Errorf("migration %s doesn't start with a version number", base)
+		}
+		script, err := migrationFiles.ReadFile(path.Join("migrations", base))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %s: %w", base, err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{version: version, name: name}
+			byVersion[version] = m
+		} else if m.name != name {
+			return nil, fmt.Errorf("migration %v is named both %s and %s", version, m.name, name)
+		}
+		if direction == "up" {
+			m.up = string(script)
+		} else {
+			m.down = string(script)
+		}
+	}
+
+	migrations := make([]migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.up == "" || m.down == "" {
+			return nil, fmt.Errorf("migration %v_%s needs both an up and a down script", m.version, m.name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].version < migrations[j].version })
+	return migrations, nil
+}
+
+// returns the versions that have been applied to db, creating schema_migrations if it doesn't exist yet
+func appliedMigrations(db *sql.DB) (map[int]string, error) {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, name TEXT NOT NULL, " +
+		"applied_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP)")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create schema_migrations: %w", err)
+	}
+	rows, err := db.Query("SELECT version, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get applied migrations: %w", err)
+	}
+	defer rows.Close()
+	applied := make(map[int]string)
+	for rows.Next() {
+		var version int
+		var appliedAt string
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan applied migration: %w", err)
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// runs one direction of a migration and records it in the same transaction, so a failed script leaves no trace.
+// SQLite migrations rebuild tables by copying and dropping them, which foreign keys would cascade through, so they're
+// turned off on the connection for the duration and checked once the migration has run
+func runMigration(db *sql.DB, m migration, up bool) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get connection: %w", err)
+	}
+	defer conn.Close()
+	// foreign_keys can't be changed inside a transaction
+	if _, err := conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF"); err != nil {
+		return fmt.Errorf("failed to turn off foreign keys: %w", err)
+	}
+	defer conn.ExecContext(ctx, "PRAGMA foreign_keys = ON")
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	script, record, args := m.down, "DELETE FROM schema_migrations WHERE version = ?", []interface{}{m.version}
+	if up {
+		script, record, args = m.up, "INSERT INTO schema_migrations (version, name) VALUES (?, ?)", []interface{}{m.version, m.name}
+	}
+	// databases from before foreign keys were enforced can have rows pointing nowhere, only new ones are an error
+	violations, err := foreignKeyViolations(tx)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(script); err != nil {
+		if strings.Contains(err.Error(), "no such module: fts5") {
+			return fmt.Errorf("failed to run migration %v_%s: %w (photoapp has to be built with -tags sqlite_fts5)", m.version, m.name, err)
+		}
+		return fmt.Errorf("failed to run migration %v_%s: %w", m.version, m.name, err)
+	}
+	if _, err := tx.Exec(record, args...); err != nil {
+		return fmt.Errorf("failed to record migration %v_%s: %w", m.version, m.name, err)
+	}
+	after, err := foreignKeyViolations(tx)
+	if err != nil {
+		return err
+	}
+	if after > violations {
+		return fmt.Errorf("migration %v_%s left %v rows referring to rows that don't exist", m.version, m.name, after-violations)
+	}
+	return tx.Commit()
+}
+
+// returns the number of rows that refer to a row that doesn't exist
+func foreignKeyViolations(tx *sql.Tx) (int, error) {
+	rows, err := tx.Query("PRAGMA foreign_key_check")
+	if err != nil {
+		return 0, fmt.Errorf("failed to check foreign keys: %w", err)
+	}
+	defer rows.Close()
+	n := 0
+	for rows.Next() {
+		n++
+	}
+	return n, rows.Err()
+}
+
+// applies every migration up to and including target that hasn't been applied yet, or all of them if target is 0
+func migrateUp(db *sql.DB, target int) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if target > 0 && m.version > target {
+			break
+		}
+		if _, ok := applied[m.version]; ok {
+			continue
+		}
+		if err := runMigration(db, m, true); err != nil {
+			return err
+		}
+		log.Printf("applied migration %04d_%s", m.version, m.name)
+	}
+	return nil
+}
+
+// undoes every applied migration above target, newest first
+func migrateDown(db *sql.DB, target int) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+	for i := len(migrations) - 1; i >= 0; i-- {
+		m := migrations[i]
+		if m.version <= target {
+			break
+		}
+		if _, ok := applied[m.version]; !ok {
+			continue
+		}
+		if err := runMigration(db, m, false); err != nil {
+			return err
+		}
+		log.Printf("reverted migration %04d_%s", m.version, m.name)
+	}
+	return nil
+}
+
+// migrate up [-to version] applies pending migrations, migrate down [-to version] reverts the newest one or everything
+// above version, and migrate status lists every migration and whether it has been applied
+func migrateCommand(args []string, db *sql.DB) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: migrate up|down|status [-to version]")
+	}
+	fs := flag.NewFlagSet("migrate "+args[0], flag.ExitOnError)
+	to := fs.Int("to", -1, "version to migrate to")
+	fs.Parse(args[1:])
+
+	switch args[0] {
+	case "up":
+		return migrateUp(db, max(*to, 0))
+	case "down":
+		target := *to
+		if target < 0 {
+			applied, err := appliedMigrations(db)
+			if err != nil {
+				return err
+			}
+			// without -to, only the newest migration is reverted
+			for version := range applied {
+				target = max(target, version)
+			}
+			target = max(target-1, 0)
+		}
+		return migrateDown(db, target)
+	case "status":
+		migrations, err := loadMigrations()
+		if err != nil {
+			return err
+		}
+		applied, err := appliedMigrations(db)
+		if err != nil {
+			return err
+		}
+		for _, m := range migrations {
+			state := "pending"
+			if appliedAt, ok := applied[m.version]; ok {
+				state = "applied " + appliedAt
+			}
+			fmt.Printf("%04d_%s\t%s\n", m.version, m.name, state)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate command %q", args[0])
+	}
+}
@@ -0,0 +1,7 @@
+DROP TABLE album_permissions;
+DROP TABLE tags;
+DROP TABLE photos;
+DROP TABLE albums;
+DROP TABLE sessions;
+DROP TABLE users;
+DROP TABLE invites;
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS users (id INTEGER PRIMARY KEY, email TEXT UNIQUE, password TEXT UNIQUE);
+CREATE TABLE IF NOT EXISTS albums (id INTEGER PRIMARY KEY, user_id INTEGER REFERENCES users(id), name TEXT NOT NULL);
+CREATE TABLE IF NOT EXISTS photos (id INTEGER PRIMARY KEY, album_id INTEGER REFERENCES albums(id), user_id INTEGER REFERENCES users(id), path TEXT UNIQUE);
+CREATE TABLE IF NOT EXISTS album_permissions (album_id INTEGER REFERENCES albums(id), user_id INTEGER REFERENCES users(id));
+CREATE TABLE IF NOT EXISTS sessions (user_id INTEGER REFERENCES users(id), session_id TEXT UNIQUE);
+CREATE TABLE IF NOT EXISTS tags (photo_id INTEGER REFERENCES photos(id), user_id INTEGER REFERENCES users(id));
+CREATE TABLE IF NOT EXISTS invites (email TEXT UNIQUE, link TEXT UNIQUE);
@@ -0,0 +1,18 @@
+DROP TABLE file_cleanup;
+
+-- a photo that's in several albums goes back to the first one
+CREATE TABLE photos_old (id INTEGER PRIMARY KEY, album_id INTEGER REFERENCES albums(id), user_id INTEGER REFERENCES users(id), path TEXT UNIQUE);
+INSERT INTO photos_old (id, album_id, user_id, path)
+	SELECT id, (SELECT MIN(album_id) FROM album_photos WHERE photo_id = photos.id), user_id, path FROM photos
+	WHERE id IN (SELECT MIN(id) FROM photos GROUP BY path) OR path IS NULL;
+DROP TABLE photos;
+DROP TABLE album_photos;
+ALTER TABLE photos_old RENAME TO photos;
+
+ALTER TABLE album_permissions DROP COLUMN role;
+ALTER TABLE albums DROP COLUMN quota_bytes;
+ALTER TABLE albums DROP COLUMN trashed_at;
+ALTER TABLE albums DROP COLUMN sort_mode;
+ALTER TABLE albums DROP COLUMN cover_photo_id;
+ALTER TABLE albums DROP COLUMN description;
+ALTER TABLE users DROP COLUMN quota_bytes;
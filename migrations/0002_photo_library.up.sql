@@ -0,0 +1,18 @@
+-- photo details, albums shared between photos, trash, integrity checks, quotas and encryption
+ALTER TABLE users ADD COLUMN quota_bytes INTEGER;
+ALTER TABLE albums ADD COLUMN description TEXT NOT NULL DEFAULT '';
+ALTER TABLE albums ADD COLUMN cover_photo_id INTEGER REFERENCES photos(id);
+ALTER TABLE albums ADD COLUMN sort_mode TEXT NOT NULL DEFAULT 'upload';
+ALTER TABLE albums ADD COLUMN trashed_at TEXT;
+ALTER TABLE albums ADD COLUMN quota_bytes INTEGER;
+ALTER TABLE album_permissions ADD COLUMN role TEXT NOT NULL DEFAULT 'contributor';
+
+-- photos lose album_id to album_photos, and path isn't unique anymore since duplicates share a file
+CREATE TABLE photos_new (id INTEGER PRIMARY KEY, user_id INTEGER REFERENCES users(id), path TEXT, title TEXT NOT NULL DEFAULT '', caption TEXT NOT NULL DEFAULT '', alt_text TEXT NOT NULL DEFAULT '', captured_at TEXT, uploaded_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP, filename TEXT NOT NULL DEFAULT '', trashed_at TEXT, checksum TEXT NOT NULL DEFAULT '', size INTEGER NOT NULL DEFAULT 0, broken TEXT, key_id TEXT, wrapped_key BLOB);
+CREATE TABLE album_photos (album_id INTEGER REFERENCES albums(id), photo_id INTEGER REFERENCES photos(id), position INTEGER NOT NULL DEFAULT 0, added_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP, UNIQUE (album_id, photo_id));
+INSERT INTO photos_new (id, user_id, path) SELECT id, user_id, path FROM photos;
+INSERT INTO album_photos (album_id, photo_id, position) SELECT album_id, id, id FROM photos WHERE album_id IS NOT NULL;
+DROP TABLE photos;
+ALTER TABLE photos_new RENAME TO photos;
+
+CREATE TABLE file_cleanup (path TEXT NOT NULL, queued_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP);
@@ -0,0 +1 @@
+-- the removed rows pointed at nothing, so there's nothing to put back
@@ -0,0 +1,10 @@
+-- foreign keys weren't enforced before 0004, so deletes could leave rows pointing at users, albums and photos that
+-- are gone. Whatever belonged to a missing user goes with them, and photo files are queued for removal
+INSERT INTO file_cleanup (path) SELECT path FROM photos WHERE path IS NOT NULL AND user_id NOT IN (SELECT id FROM users);
+DELETE FROM photos WHERE user_id NOT IN (SELECT id FROM users);
+DELETE FROM albums WHERE user_id NOT IN (SELECT id FROM users);
+DELETE FROM sessions WHERE user_id NOT IN (SELECT id FROM users);
+DELETE FROM album_permissions WHERE user_id NOT IN (SELECT id FROM users) OR album_id NOT IN (SELECT id FROM albums);
+DELETE FROM tags WHERE user_id NOT IN (SELECT id FROM users) OR photo_id NOT IN (SELECT id FROM photos);
+DELETE FROM album_photos WHERE album_id NOT IN (SELECT id FROM albums) OR photo_id NOT IN (SELECT id FROM photos);
+UPDATE albums SET cover_photo_id = NULL WHERE cover_photo_id NOT IN (SELECT id FROM photos);
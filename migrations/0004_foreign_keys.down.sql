@@ -0,0 +1,33 @@
+DROP TRIGGER photos_queue_file;
+
+CREATE TABLE albums_old (id INTEGER PRIMARY KEY, user_id INTEGER REFERENCES users(id), name TEXT NOT NULL, description TEXT NOT NULL DEFAULT '', cover_photo_id INTEGER REFERENCES photos(id), sort_mode TEXT NOT NULL DEFAULT 'upload', trashed_at TEXT, quota_bytes INTEGER);
+INSERT INTO albums_old (id, user_id, name, description, cover_photo_id, sort_mode, trashed_at, quota_bytes)
+	SELECT id, user_id, name, description, cover_photo_id, sort_mode, trashed_at, quota_bytes FROM albums;
+DROP TABLE albums;
+ALTER TABLE albums_old RENAME TO albums;
+
+CREATE TABLE photos_old (id INTEGER PRIMARY KEY, user_id INTEGER REFERENCES users(id), path TEXT, title TEXT NOT NULL DEFAULT '', caption TEXT NOT NULL DEFAULT '', alt_text TEXT NOT NULL DEFAULT '', captured_at TEXT, uploaded_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP, filename TEXT NOT NULL DEFAULT '', trashed_at TEXT, checksum TEXT NOT NULL DEFAULT '', size INTEGER NOT NULL DEFAULT 0, broken TEXT, key_id TEXT, wrapped_key BLOB);
+INSERT INTO photos_old (id, user_id, path, title, caption, alt_text, captured_at, uploaded_at, filename, trashed_at, checksum, size, broken, key_id, wrapped_key)
+	SELECT id, user_id, path, title, caption, alt_text, captured_at, uploaded_at, filename, trashed_at, checksum, size, broken, key_id, wrapped_key FROM photos;
+DROP TABLE photos;
+ALTER TABLE photos_old RENAME TO photos;
+
+CREATE TABLE album_photos_old (album_id INTEGER REFERENCES albums(id), photo_id INTEGER REFERENCES photos(id), position INTEGER NOT NULL DEFAULT 0, added_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP, UNIQUE (album_id, photo_id));
+INSERT INTO album_photos_old (album_id, photo_id, position, added_at) SELECT album_id, photo_id, position, added_at FROM album_photos;
+DROP TABLE album_photos;
+ALTER TABLE album_photos_old RENAME TO album_photos;
+
+CREATE TABLE album_permissions_old (album_id INTEGER REFERENCES albums(id), user_id INTEGER REFERENCES users(id), role TEXT NOT NULL DEFAULT 'contributor');
+INSERT INTO album_permissions_old (album_id, user_id, role) SELECT album_id, user_id, role FROM album_permissions;
+DROP TABLE album_permissions;
+ALTER TABLE album_permissions_old RENAME TO album_permissions;
+
+CREATE TABLE sessions_old (user_id INTEGER REFERENCES users(id), session_id TEXT UNIQUE);
+INSERT INTO sessions_old (user_id, session_id) SELECT user_id, session_id FROM sessions;
+DROP TABLE sessions;
+ALTER TABLE sessions_old RENAME TO sessions;
+
+CREATE TABLE tags_old (photo_id INTEGER REFERENCES photos(id), user_id INTEGER REFERENCES users(id));
+INSERT INTO tags_old (photo_id, user_id) SELECT photo_id, user_id FROM tags;
+DROP TABLE tags;
+ALTER TABLE tags_old RENAME TO tags;
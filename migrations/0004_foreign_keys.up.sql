@@ -0,0 +1,49 @@
+-- every reference gets a deliberate ON DELETE: deleting a user deletes everything they own, deleting an album or a
+-- photo deletes its memberships, permissions and tags, and deleting an album's cover photo unsets the cover.
+-- SQLite can't change a foreign key in place, so the tables are rebuilt
+CREATE TABLE albums_new (id INTEGER PRIMARY KEY, user_id INTEGER REFERENCES users(id) ON DELETE CASCADE, name TEXT NOT NULL, description TEXT NOT NULL DEFAULT '', cover_photo_id INTEGER REFERENCES photos(id) ON DELETE SET NULL, sort_mode TEXT NOT NULL DEFAULT 'upload', trashed_at TEXT, quota_bytes INTEGER);
+INSERT INTO albums_new (id, user_id, name, description, cover_photo_id, sort_mode, trashed_at, quota_bytes)
+	SELECT id, user_id, name, description, cover_photo_id, sort_mode, trashed_at, quota_bytes FROM albums;
+DROP TABLE albums;
+ALTER TABLE albums_new RENAME TO albums;
+
+CREATE TABLE photos_new (id INTEGER PRIMARY KEY, user_id INTEGER REFERENCES users(id) ON DELETE CASCADE, path TEXT, title TEXT NOT NULL DEFAULT '', caption TEXT NOT NULL DEFAULT '', alt_text TEXT NOT NULL DEFAULT '', captured_at TEXT, uploaded_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP, filename TEXT NOT NULL DEFAULT '', trashed_at TEXT, checksum TEXT NOT NULL DEFAULT '', size INTEGER NOT NULL DEFAULT 0, broken TEXT, key_id TEXT, wrapped_key BLOB);
+INSERT INTO photos_new (id, user_id, path, title, caption, alt_text, captured_at, uploaded_at, filename, trashed_at, checksum, size, broken, key_id, wrapped_key)
+	SELECT id, user_id, path, title, caption, alt_text, captured_at, uploaded_at, filename, trashed_at, checksum, size, broken, key_id, wrapped_key FROM photos;
+DROP TABLE photos;
+ALTER TABLE photos_new RENAME TO photos;
+
+CREATE TABLE album_photos_new (album_id INTEGER REFERENCES albums(id) ON DELETE CASCADE, photo_id INTEGER REFERENCES photos(id) ON DELETE CASCADE, position INTEGER NOT NULL DEFAULT 0, added_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP, UNIQUE (album_id, photo_id));
+INSERT INTO album_photos_new (album_id, photo_id, position, added_at) SELECT album_id, photo_id, position, added_at FROM album_photos;
+DROP TABLE album_photos;
+ALTER TABLE album_photos_new RENAME TO album_photos;
+
+CREATE TABLE album_permissions_new (album_id INTEGER REFERENCES albums(id) ON DELETE CASCADE, user_id INTEGER REFERENCES users(id) ON DELETE CASCADE, role TEXT NOT NULL DEFAULT 'contributor');
+INSERT INTO album_permissions_new (album_id, user_id, role) SELECT album_id, user_id, role FROM album_permissions;
+DROP TABLE album_permissions;
+ALTER TABLE album_permissions_new RENAME TO album_permissions;
+
+CREATE TABLE sessions_new (user_id INTEGER REFERENCES users(id) ON DELETE CASCADE, session_id TEXT UNIQUE);
+INSERT INTO sessions_new (user_id, session_id) SELECT user_id, session_id FROM sessions;
+DROP TABLE sessions;
+ALTER TABLE sessions_new RENAME TO sessions;
+
+CREATE TABLE tags_new (photo_id INTEGER REFERENCES photos(id) ON DELETE CASCADE, user_id INTEGER REFERENCES users(id) ON DELETE CASCADE);
+INSERT INTO tags_new (photo_id, user_id) SELECT photo_id, user_id FROM tags;
+DROP TABLE tags;
+ALTER TABLE tags_new RENAME TO tags;
+
+-- cascades look rows up by the referring column
+CREATE INDEX albums_user_id ON albums (user_id);
+CREATE INDEX photos_user_id ON photos (user_id);
+CREATE INDEX album_photos_photo_id ON album_photos (photo_id);
+CREATE INDEX album_permissions_user_id ON album_permissions (user_id);
+CREATE INDEX sessions_user_id ON sessions (user_id);
+CREATE INDEX tags_photo_id ON tags (photo_id);
+CREATE INDEX tags_user_id ON tags (user_id);
+
+-- however a photo gets deleted, its file is queued for removal in the same transaction
+CREATE TRIGGER photos_queue_file AFTER DELETE ON photos WHEN old.path IS NOT NULL
+BEGIN
+	INSERT INTO file_cleanup (path) VALUES (old.path);
+END;
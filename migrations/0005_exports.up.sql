@@ -0,0 +1,3 @@
+-- takeout archives users ask for, built in the background and downloadable until they expire
+CREATE TABLE exports (id INTEGER PRIMARY KEY, user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE, token TEXT NOT NULL UNIQUE, state TEXT NOT NULL DEFAULT 'pending', path TEXT, size INTEGER NOT NULL DEFAULT 0, error TEXT NOT NULL DEFAULT '', requested_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP, finished_at TEXT, expires_at TEXT);
+CREATE INDEX exports_user_id ON exports (user_id);
@@ -0,0 +1,2 @@
+ALTER TABLE photos DROP COLUMN latitude;
+ALTER TABLE photos DROP COLUMN longitude;
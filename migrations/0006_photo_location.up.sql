@@ -0,0 +1,3 @@
+-- where a photo was taken, from its EXIF data or an imported sidecar
+ALTER TABLE photos ADD COLUMN latitude REAL;
+ALTER TABLE photos ADD COLUMN longitude REAL;
@@ -0,0 +1,2 @@
+-- folders the server imports new photos from, for a user or into a particular album
+CREATE TABLE watch_folders (id INTEGER PRIMARY KEY, user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE, album_id INTEGER REFERENCES albums(id) ON DELETE CASCADE, path TEXT NOT NULL UNIQUE, created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP);
@@ -0,0 +1,2 @@
+-- a disabled user can't log in, but keeps their albums and photos
+ALTER TABLE users ADD COLUMN disabled_at TEXT;
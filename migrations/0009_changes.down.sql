@@ -0,0 +1,7 @@
+DROP TRIGGER albums_changes_insert;
+DROP TRIGGER albums_changes_update;
+DROP TRIGGER album_permissions_changes_insert;
+DROP TRIGGER album_photos_changes_insert;
+DROP TRIGGER album_photos_changes_delete;
+DROP TRIGGER photos_changes_update;
+DROP TABLE changes;
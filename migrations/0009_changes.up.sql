@@ -0,0 +1,36 @@
+-- every change to an album or to which photos are in it, for sync clients to catch up from. A row with no photo_id
+-- means the album itself changed; either way the client looks up what the album or photo is like now. Rows are never
+-- deleted, so ids only go up and can be used as cursors
+CREATE TABLE changes (id INTEGER PRIMARY KEY, album_id INTEGER NOT NULL, photo_id INTEGER, changed_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP);
+CREATE INDEX changes_album_id ON changes (album_id, id);
+
+-- what's there already is where clients start from
+INSERT INTO changes (album_id) SELECT id FROM albums ORDER BY id;
+INSERT INTO changes (album_id, photo_id) SELECT album_id, photo_id FROM album_photos ORDER BY album_id, position;
+
+CREATE TRIGGER albums_changes_insert AFTER INSERT ON albums
+BEGIN
+	INSERT INTO changes (album_id) VALUES (new.id);
+END;
+CREATE TRIGGER albums_changes_update AFTER UPDATE OF name, trashed_at, user_id ON albums
+	WHEN old.name IS NOT new.name OR old.trashed_at IS NOT new.trashed_at OR old.user_id IS NOT new.user_id
+BEGIN
+	INSERT INTO changes (album_id) VALUES (new.id);
+END;
+CREATE TRIGGER album_permissions_changes_insert AFTER INSERT ON album_permissions
+BEGIN
+	INSERT INTO changes (album_id) VALUES (new.album_id);
+END;
+CREATE TRIGGER album_photos_changes_insert AFTER INSERT ON album_photos
+BEGIN
+	INSERT INTO changes (album_id, photo_id) VALUES (new.album_id, new.photo_id);
+END;
+CREATE TRIGGER album_photos_changes_delete AFTER DELETE ON album_photos
+BEGIN
+	INSERT INTO changes (album_id, photo_id) VALUES (old.album_id, old.photo_id);
+END;
+CREATE TRIGGER photos_changes_update AFTER UPDATE OF trashed_at, checksum ON photos
+	WHEN old.trashed_at IS NOT new.trashed_at OR old.checksum IS NOT new.checksum
+BEGIN
+	INSERT INTO changes (album_id, photo_id) SELECT album_id, new.id FROM album_photos WHERE photo_id = new.id;
+END;
@@ -0,0 +1,4 @@
+-- passwords for apps like WebDAV clients, made by the user and revoked one at a time without changing their own
+-- password. Only a hash is kept, the password itself is shown once when it's made
+CREATE TABLE app_passwords (id INTEGER PRIMARY KEY, user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE, name TEXT NOT NULL, token_hash TEXT NOT NULL UNIQUE, created_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP, last_used_at TEXT);
+CREATE INDEX app_passwords_user_id ON app_passwords (user_id);
@@ -0,0 +1,12 @@
+DROP TRIGGER photos_search_insert;
+DROP TRIGGER photos_search_update;
+DROP TRIGGER photos_search_delete;
+DROP TRIGGER tags_search_insert;
+DROP TRIGGER tags_search_delete;
+DROP TRIGGER users_search_update;
+DROP TRIGGER albums_search_insert;
+DROP TRIGGER albums_search_update;
+DROP TRIGGER albums_search_delete;
+DROP TABLE photo_search;
+DROP TABLE album_search;
+ALTER TABLE photos DROP COLUMN keywords;
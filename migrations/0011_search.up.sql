@@ -0,0 +1,54 @@
+-- full-text search over photos and albums with FTS5, which the sqlite3 driver only has when built with
+-- -tags sqlite_fts5. The indexes use the photo and album ids as their rowids and triggers keep them up to date;
+-- photo_search.tags holds the emails of the users tagged in a photo
+ALTER TABLE photos ADD COLUMN keywords TEXT NOT NULL DEFAULT '';
+CREATE VIRTUAL TABLE photo_search USING fts5(title, caption, alt_text, filename, keywords, tags, tokenize = 'unicode61 remove_diacritics 2', prefix = '2 3');
+CREATE VIRTUAL TABLE album_search USING fts5(name, description, tokenize = 'unicode61 remove_diacritics 2', prefix = '2 3');
+
+INSERT INTO photo_search (rowid, title, caption, alt_text, filename, keywords, tags)
+	SELECT id, title, caption, alt_text, filename, keywords,
+		COALESCE((SELECT group_concat(email, ' ') FROM tags JOIN users ON users.id = tags.user_id WHERE tags.photo_id = photos.id), '')
+	FROM photos;
+INSERT INTO album_search (rowid, name, description) SELECT id, name, description FROM albums;
+
+CREATE TRIGGER photos_search_insert AFTER INSERT ON photos
+BEGIN
+	INSERT INTO photo_search (rowid, title, caption, alt_text, filename, keywords, tags)
+		VALUES (new.id, new.title, new.caption, new.alt_text, new.filename, new.keywords, '');
+END;
+CREATE TRIGGER photos_search_update AFTER UPDATE OF title, caption, alt_text, filename, keywords ON photos
+BEGIN
+	UPDATE photo_search SET title = new.title, caption = new.caption, alt_text = new.alt_text, filename = new.filename,
+		keywords = new.keywords WHERE rowid = new.id;
+END;
+CREATE TRIGGER photos_search_delete AFTER DELETE ON photos
+BEGIN
+	DELETE FROM photo_search WHERE rowid = old.id;
+END;
+CREATE TRIGGER tags_search_insert AFTER INSERT ON tags
+BEGIN
+	UPDATE photo_search SET tags = COALESCE((SELECT group_concat(email, ' ') FROM tags JOIN users ON users.id = tags.user_id
+		WHERE tags.photo_id = new.photo_id), '') WHERE rowid = new.photo_id;
+END;
+CREATE TRIGGER tags_search_delete AFTER DELETE ON tags
+BEGIN
+	UPDATE photo_search SET tags = COALESCE((SELECT group_concat(email, ' ') FROM tags JOIN users ON users.id = tags.user_id
+		WHERE tags.photo_id = old.photo_id), '') WHERE rowid = old.photo_id;
+END;
+CREATE TRIGGER users_search_update AFTER UPDATE OF email ON users
+BEGIN
+	UPDATE photo_search SET tags = COALESCE((SELECT group_concat(email, ' ') FROM tags JOIN users ON users.id = tags.user_id
+		WHERE tags.photo_id = photo_search.rowid), '') WHERE rowid IN (SELECT photo_id FROM tags WHERE user_id = new.id);
+END;
+CREATE TRIGGER albums_search_insert AFTER INSERT ON albums
+BEGIN
+	INSERT INTO album_search (rowid, name, description) VALUES (new.id, new.name, new.description);
+END;
+CREATE TRIGGER albums_search_update AFTER UPDATE OF name, description ON albums
+BEGIN
+	UPDATE album_search SET name = new.name, description = new.description WHERE rowid = new.id;
+END;
+CREATE TRIGGER albums_search_delete AFTER DELETE ON albums
+BEGIN
+	DELETE FROM album_search WHERE rowid = old.id;
+END;
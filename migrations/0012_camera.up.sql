@@ -0,0 +1,2 @@
+-- the make and model of the camera that took a photo, from its EXIF data
+ALTER TABLE photos ADD COLUMN camera TEXT;
@@ -0,0 +1,2 @@
+DROP TRIGGER album_photos_smart_albums;
+ALTER TABLE albums DROP COLUMN query;
@@ -0,0 +1,8 @@
+-- a smart album is an album defined by a stored query (see query.go) instead of by the photos put in it, so nothing
+-- can be added to one
+ALTER TABLE albums ADD COLUMN query TEXT;
+CREATE TRIGGER album_photos_smart_albums BEFORE INSERT ON album_photos
+	WHEN (SELECT query FROM albums WHERE id = new.album_id) IS NOT NULL
+BEGIN
+	SELECT RAISE(ABORT, 'photos can''t be added to a smart album');
+END;
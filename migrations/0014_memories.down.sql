@@ -0,0 +1,4 @@
+DROP TABLE hidden_memories;
+DROP TABLE memories;
+DROP TABLE memory_days;
+ALTER TABLE users DROP COLUMN memory_digest_since;
@@ -0,0 +1,7 @@
+-- "on this day": every day each user gets the photos taken on the same date in earlier years, prepared once and kept
+-- for a week. A user can dismiss a day's memories or hide a photo from them for good, and get them emailed from
+-- memory_digest_since on
+ALTER TABLE users ADD COLUMN memory_digest_since TEXT;
+CREATE TABLE memory_days (user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE, day TEXT NOT NULL, dismissed_at TEXT, emailed_at TEXT, PRIMARY KEY (user_id, day));
+CREATE TABLE memories (user_id INTEGER NOT NULL, day TEXT NOT NULL, photo_id INTEGER NOT NULL REFERENCES photos(id) ON DELETE CASCADE, PRIMARY KEY (user_id, day, photo_id), FOREIGN KEY (user_id, day) REFERENCES memory_days(user_id, day) ON DELETE CASCADE);
+CREATE TABLE hidden_memories (user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE, photo_id INTEGER NOT NULL REFERENCES photos(id) ON DELETE CASCADE, PRIMARY KEY (user_id, photo_id));
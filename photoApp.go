@@ -1,18 +1,11 @@
 package main
 
-/*
-type photoInfo struct {
-	photoID   int
-	albumID   int
-	userID    int
-	tagged_id int
-	time	time.Time
-}
-*/
-
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"html/template"
@@ -22,42 +15,40 @@ import (
 	"log"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
-	"path/filepath"
 	"strconv"
+	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	"golang.org/x/crypto/bcrypt"
 )
 
-// these functions are to be used with a database that includes following tables (! = primary key):
-// users: id!|email|password	albums: id!|user_id|name	     photos: id!|album_id|user_id|path		album_permissions: album_id|user_id	tags: photo_id|tagged_id
-// sessions: user_id|session_id
+// these functions are to be used with a database built by the migrations in migrations/, which has the following
+// tables (! = primary key):
+// users: id!|email|password|quota_bytes|disabled_at|memory_digest_since	albums: id!|user_id|name|description|cover_photo_id|sort_mode|trashed_at|quota_bytes|query
+// photos: id!|user_id|path|title|caption|alt_text|captured_at|uploaded_at|filename|trashed_at|checksum|size|broken|key_id|wrapped_key|latitude|longitude|keywords|camera
+// album_photos: album_id|photo_id|position|added_at	album_permissions: album_id|user_id|role
+// tags: photo_id|user_id	sessions: user_id|session_id	file_cleanup: path|queued_at	schema_migrations: version!|name|applied_at
+// memory_days: user_id!|day!|dismissed_at|emailed_at	memories: user_id!|day!|photo_id!	hidden_memories: user_id!|photo_id!
+// deleting a user deletes everything they own, and deleting an album or a photo deletes whatever refers to it
 // create a new user along with an initial album
 func newUser(email string, password string, tx *sql.Tx) (int64, error) {
-	passwordBytes := []byte(password)
-	hashedPassword, err := bcrypt.GenerateFromPassword(passwordBytes, 1)
-	if err != nil {
-		return 0, fmt.Errorf("failed to hash password: %w", err)
-	}
-	r, err := tx.Exec("INSERT INTO users (email, password) VALUES (?, ?)", email, hashedPassword)
+	hashedPassword, err := hashPassword(password)
 	if err != nil {
-		return 0, fmt.Errorf("failed to add user: %w", err)
+		return 0, err
 	}
-	userID, err := r.LastInsertId()
+	userID, err := store.WithTx(tx).CreateUser(email, hashedPassword)
 	if err != nil {
-		return 0, fmt.Errorf("failed to get new user id: %w", err)
+		return 0, err
 	}
 	mainAlbum := fmt.Sprintf("%s's Photos", email)
-	r, err = tx.Exec("insert into albums (user_id, name) values (?, ?)", userID, mainAlbum)
+	albumID, err := store.WithTx(tx).CreateAlbum(userID, mainAlbum)
 	if err != nil {
 		return 0, fmt.Errorf("failed to create user album: %w", err)
 	}
-	albumID, err := r.LastInsertId()
-	if err != nil {
-		return 0, fmt.Errorf("failed to get album id: %w", err)
-	}
 	err = givePerm(albumID, userID, tx)
 	if err != nil {
 		return 0, fmt.Errorf("failed to give user permission to main album: %w", err)
@@ -65,78 +56,222 @@ func newUser(email string, password string, tx *sql.Tx) (int64, error) {
 	return userID, nil
 }
 
-func newAlbum(name string, userID int64, tx *sql.Tx) error {
-	r, err := tx.Exec("insert into albums (name, user_id) values (?, ?)", name, userID)
+// hashes a password to store in users.password
+func hashPassword(password string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
-		return fmt.Errorf("failed to create album: %w", err)
+		return "", fmt.Errorf("failed to hash password: %w", err)
 	}
-	albumID, err := r.LastInsertId()
+	return string(hashed), nil
+}
+
+// create a new album and give its owner permission to it
+func newAlbum(name string, userID int64, tx *sql.Tx) (int64, error) {
+	albumID, err := store.WithTx(tx).CreateAlbum(userID, name)
 	if err != nil {
-		return fmt.Errorf("failed to get album id: %w", err)
+		return 0, err
 	}
 	err = givePerm(albumID, userID, tx)
 	if err != nil {
-		return fmt.Errorf("failed to give user permission to album: %w", err)
+		return 0, fmt.Errorf("failed to give user permission to album: %w", err)
 	}
-	return nil
+	return albumID, nil
 }
 
 // checks if the given user has permission to access the given album
 func checkPerm(albumID int64, userID int64, tx *sql.Tx) bool {
-	//retrieve all albums that a user has access to
-	permittedAlbumRows, err := tx.Query("select album_id from album_permissions where user_id = ? and album_id = ?", userID, albumID)
-	defer permittedAlbumRows.Close()
+	ok, err := store.WithTx(tx).HasPermission(albumID, userID)
 	if err != nil {
-		log.Printf("failed to access album_permissions: %s", err)
+		log.Printf("%s", err)
 	}
-	// copy all album ids that the specified user has access to into a slice
-	return permittedAlbumRows.Next()
+	return ok
 }
 
-// add a photo to a specified album if the calling user has permission according to the album_permissions table
-func addPhoto(albumID int64, userID int64, db *sql.DB) (int64, string, error) {
+// add a photo to a specified album if the calling user has permission according to the album_permissions table.
+// filename is the name the photo was uploaded with, the photo is stored under its id unless the same content is
+// already stored, in which case the photo shares that file. The photo's row is only committed once src has been
+// completely written to disk and fits in the user's and album's quotas, and the file is removed again otherwise
+func addPhoto(albumID int64, userID int64, filename string, src io.Reader, db *sql.DB) (int64, string, error) {
+	s, err := stagePhoto(src)
+	if err != nil {
+		return 0, "", err
+	}
+	defer s.discard()
+	var photoID int64
+	var storedPath string
+	err = inTx(db, func(tx *sql.Tx) (err error) {
+		photoID, storedPath, err = s.add(albumID, userID, filename, tx)
+		return err
+	})
+	if err != nil {
+		return 0, "", err
+	}
+	s.keep()
+	return photoID, storedPath, nil
+	//add a tag feature to this function?
+}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	tx, err := db.BeginTx(ctx, nil)
+// stagedPhoto is a photo that has been written to disk but isn't in the database yet. Writing, encrypting and
+// reading the file all happen before the transaction that adds it, so uploads don't hold the write connection while
+// they wait on the disk
+type stagedPhoto struct {
+	tmp      string // where the photo was written
+	placed   string // where add moved it to, removed by discard unless the transaction committed
+	checksum string
+	size     int64
+	key      blobKey
+	exif     exifInfo
+	hasExif  bool
+}
+
+// stagePhoto writes src to a temporary file in the photo directory, encrypted if there's a key, and reads what it
+// needs to know about it. The caller has to call discard once it's done with it
+func stagePhoto(src io.Reader) (*stagedPhoto, error) {
+	h := sha256.New()
+	sealed, key, err := sealBlob(io.TeeReader(src, h))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt photo: %w", err)
+	}
+	tmp, size, err := stageFile(os.Getenv("SILSILA_PHOTO_PATH"), sealed)
 	if err != nil {
-		return 0, "", fmt.Errorf("failed to begin transaction: %w", err)
+		return nil, fmt.Errorf("failed to store photo: %w", err)
+	}
+	if key.Wrapped != nil {
+		size = plainSize(size)
+	}
+	s := &stagedPhoto{tmp: tmp, checksum: hex.EncodeToString(h.Sum(nil)), size: size, key: key}
+	// photos without exif data fall back to their upload time wherever capture time is used
+	if f, err := openBlob(tmp, key); err == nil {
+		if info, err := readExif(f); err == nil {
+			s.exif, s.hasExif = info, true
+		}
+		f.Close()
 	}
-	//if checkPerm(albumID, userID, tx) == true {
-	res, err := tx.Exec("INSERT INTO photos (user_id, album_id) VALUES (?, ?)", userID, albumID)
+	return s, nil
+}
+
+// add creates the photo in albumID for userID as part of tx, and moves its file into place unless the same content
+// is already stored
+func (s *stagedPhoto) add(albumID int64, userID int64, filename string, tx *sql.Tx) (int64, string, error) {
+	photoID, err := store.WithTx(tx).CreatePhoto(userID, filename)
 	if err != nil {
-		return 0, "", fmt.Errorf("failed to insert photo: %w", err)
+		return 0, "", err
+	}
+	if err = addToAlbum(photoID, albumID, tx); err != nil {
+		return 0, "", err
+	}
+	if s.hasExif {
+		if !s.exif.Taken.IsZero() {
+			if _, err = tx.Exec("UPDATE photos SET captured_at = ? WHERE id = ?", s.exif.Taken.Format(timeLayout), photoID); err != nil {
+				log.Printf("failed to save capture time of photo %v: %s", photoID, err)
+			}
+		}
+		if s.exif.HasLocation {
+			if err = setLocation(photoID, s.exif.Latitude, s.exif.Longitude, tx); err != nil {
+				log.Printf("%s", err)
+			}
+		}
+		if s.exif.Camera != "" {
+			if _, err = tx.Exec("UPDATE photos SET camera = ? WHERE id = ?", s.exif.Camera, photoID); err != nil {
+				log.Printf("failed to save camera of photo %v: %s", photoID, err)
+			}
+		}
 	}
 
-	photoID, err := res.LastInsertId()
+	// a duplicate shares the existing file and its key, as long as both are encrypted or both aren't
+	storedPath := path.Join(os.Getenv("SILSILA_PHOTO_PATH"), strconv.FormatInt(photoID, 10)) //TODO: get image format
+	key := s.key
+	var existing string
+	var existingKeyID sql.NullString
+	var existingWrapped []byte
+	err = tx.QueryRow("SELECT path, key_id, wrapped_key FROM photos WHERE checksum = ? AND size = ? AND broken IS NULL "+
+		"AND path IS NOT NULL AND (key_id IS NULL) = ? LIMIT 1", s.checksum, s.size, s.key.Wrapped == nil).Scan(&existing, &existingKeyID, &existingWrapped)
+	duplicate := false
+	if err == nil {
+		if _, statErr := os.Stat(existing); statErr == nil {
+			storedPath, duplicate = existing, true
+			key = scanBlobKey(existingKeyID, existingWrapped)
+		}
+	} else if err != sql.ErrNoRows {
+		return 0, "", fmt.Errorf("failed to look for duplicates of photo: %w", err)
+	}
+	err = store.WithTx(tx).SetPhotoFile(photoID, photoFile{Path: storedPath, Checksum: s.checksum, Size: s.size, Key: key})
 	if err != nil {
-		return 0, "", fmt.Errorf("failed to get photoID: %w", err)
+		return 0, "", err
+	}
+	if err = checkQuotas(userID, albumID, tx); err != nil {
+		return 0, "", err
+	}
+	if !duplicate {
+		if err := placeFile(s.tmp, storedPath); err != nil {
+			return 0, "", err
+		}
+		s.placed = storedPath
 	}
+	return photoID, storedPath, nil
+}
 
-	dir := os.Getenv("SILSILA_PHOTO_PATH")
+// keep is called once the transaction add was part of has committed, so the file stays where add put it
+func (s *stagedPhoto) keep() {
+	s.placed = ""
+}
 
-	photoPath := path.Join(dir, strconv.FormatInt(photoID, 10)) //TODO: get image format
-	_, err = tx.Exec("UPDATE photos SET path = ? WHERE id = ?", photoPath, photoID)
+// discard removes whatever of the photo's files wasn't kept
+func (s *stagedPhoto) discard() {
+	for _, p := range []string{s.tmp, s.placed} {
+		if p == "" {
+			continue
+		}
+		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+			log.Printf("failed to remove %s after failed upload: %s", p, err)
+		}
+	}
+}
+
+// records where a photo was taken
+func setLocation(photoID int64, lat float64, long float64, tx *sql.Tx) error {
+	if _, err := tx.Exec("UPDATE photos SET latitude = ?, longitude = ? WHERE id = ?", lat, long, photoID); err != nil {
+		return fmt.Errorf("failed to save location of photo %v: %w", photoID, err)
+	}
+	return nil
+}
+
+// checks if the given user owns the given album
+func checkOwner(albumID int64, userID int64, tx *sql.Tx) bool {
+	ownerID, err := store.WithTx(tx).AlbumOwner(albumID)
 	if err != nil {
-		return 0, "", fmt.Errorf("failed to add path to photo table: %w", err)
+		log.Printf("%s", err)
+		return false
 	}
-	//} else {
-	//	return 0, "", fmt.Errorf("user doesn't have permission to access album")
-	//}
-	err = tx.Commit()
+	return ownerID == userID
+}
+
+// checks if the given user may edit photo details in the given album: either they own the album or they
+// were given the contributor role in album_permissions
+func checkContributor(albumID int64, userID int64, tx *sql.Tx) bool {
+	if checkOwner(albumID, userID, tx) {
+		return true
+	}
+	ok, err := store.WithTx(tx).HasRole(albumID, userID, "contributor")
 	if err != nil {
-		return 0, "", fmt.Errorf("failed to commit transaction: %w", err)
+		log.Printf("%s", err)
 	}
-	return photoID, photoPath, nil
-	//add a tag feature to this function?
+	return ok
 }
 
 // give a user permission to view and add photos to an album
 func givePerm(albumID int64, userID int64, tx *sql.Tx) error {
+	return grantRole(albumID, userID, "contributor", tx)
+}
+
+// give a user permission to an album: viewers can look at it, contributors can also add and edit photos
+func grantRole(albumID int64, userID int64, role string, tx *sql.Tx) error {
+	if role != "viewer" && role != "contributor" {
+		return fmt.Errorf("unknown role %q", role)
+	}
 	if checkPerm(albumID, userID, tx) == false {
-		_, err := tx.Exec("insert into album_permissions (album_id, user_id) values (?, ?)", albumID, userID)
-		if err != nil {
-			return fmt.Errorf("failed to give permission: %w", err)
+		if err := store.WithTx(tx).GrantPermission(albumID, userID, role); err != nil {
+			return err
 		}
 	} else {
 		return fmt.Errorf("That user already has permission to access the album!\n")
@@ -144,35 +279,15 @@ func givePerm(albumID int64, userID int64, tx *sql.Tx) error {
 	return nil
 }
 
-func showTags(userID int64, db *sql.DB) ([]int64, []int64, error) {
-	taggedPhotoRows, err := db.Query("SELECT id FROM photos JOIN tags ON photos.id = tags.photo_id WHERE tagged_user_id = ?", userID)
-	defer taggedPhotoRows.Close()
+// returns the photos the user is tagged in and the albums those photos are in
+func showTags(userID int64, s Store) ([]int64, []int64, error) {
+	taggedPhotos, err := s.TaggedPhotos(userID)
 	if err != nil {
-		return nil, nil, fmt.Errorf("failed to access photo tags: %w", err)
+		return nil, nil, err
 	}
-	taggedPhotos := make([]int64, 0)
-	for i := 0; taggedPhotoRows.Next(); i++ {
-		var newElem int64
-		taggedPhotos = append(taggedPhotos, newElem)
-		err := taggedPhotoRows.Scan(&taggedPhotos[i])
-		if err != nil {
-			return nil, nil, fmt.Errorf("failed to scan tagged photo ids: %w", err)
-
-		}
-	}
-	taggedAlbumRows, err := db.Query("SELECT album_id FROM photos JOIN tags ON photos.id = tags.photo_id WHERE tagged_user_id = ?", userID)
-	defer taggedAlbumRows.Close()
+	taggedAlbums, err := s.TaggedAlbums(userID)
 	if err != nil {
-		return taggedPhotos, nil, fmt.Errorf("failed to access tagged albums: %w", err)
-	}
-	taggedAlbums := make([]int64, 0)
-	for i := 0; taggedAlbumRows.Next(); i++ {
-		var newElem int64
-		taggedAlbums = append(taggedAlbums, newElem)
-		err := taggedAlbumRows.Scan(&taggedAlbums[i])
-		if err != nil {
-			return taggedPhotos, nil, fmt.Errorf("failed to scan tagged album")
-		}
+		return taggedPhotos, nil, err
 	}
 	return taggedPhotos, taggedAlbums, nil
 }
@@ -187,34 +302,21 @@ func randString(n int) string {
 	return string(b)
 }
 
-// TODO: move begin transaction code to separate function
 func checkSesh(w http.ResponseWriter, r *http.Request, db *sql.DB) (int64, error) {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	tx, err := db.BeginTx(ctx, nil)
-	if err != nil {
-		return 0, fmt.Errorf("failed to begin transaction: %w", err)
-	}
-
 	cookie, err := r.Cookie("session_cookie")
 	if err != nil {
 		http.Redirect(w, r, "/login/", http.StatusFound)
 		return 0, fmt.Errorf("failed to get cookie from request: %w", err)
 	}
-	row := tx.QueryRow("SELECT user_id FROM sessions WHERE session_id = ?", cookie.Value)
-	var userID int64
-	err = row.Scan(&userID)
+	userID, err := newSQLiteStore(db).SessionUser(cookie.Value)
 	if err != nil {
 		http.Redirect(w, r, "/login/", http.StatusFound)
-		return 0, fmt.Errorf("failed to scan query result: %w", err)
-	}
-	if err := tx.Commit(); err != nil {
-		log.Printf("%s", err)
+		return 0, fmt.Errorf("failed to find session: %w", err)
 	}
 	return userID, nil
 }
 
-var templates = template.Must(template.ParseFiles("templates/home.html", "templates/album.html", "templates/photo.html", "templates/login.html", "templates/register.html", "templates/view.html"))
+var templates = template.Must(template.ParseFiles("templates/home.html", "templates/album.html", "templates/photo.html", "templates/login.html", "templates/register.html", "templates/view.html", "templates/search.html", "templates/trash.html", "templates/export.html", "templates/apppasswords.html", "templates/timeline.html"))
 
 type page interface {
 	render(w http.ResponseWriter, r *http.Request, rows *sql.Rows)
@@ -222,42 +324,137 @@ type page interface {
 
 type homepage struct {
 	UserID int64
-	Albums []int64
+	Albums []albumInfo
+	Used   string
+	Quota  string
+	// the cards of the user's smart albums, whose photos aren't in album_photos
+	Smart map[int64]albumInfo
+	// what's shown only to the user whose home page it is: today's memories and whether they're emailed
+	Self     bool
+	Day      string
+	Memories []memory
+	Digest   bool
+}
+
+// albumInfo holds what the home page needs to show an album card
+type albumInfo struct {
+	ID      int64
+	Name    string
+	CoverID int64
+	Count   int
+	Smart   bool
+}
+
+// sortModes maps the sort modes an album can be shown in to the ORDER BY clause that implements them
+var sortModes = map[string]string{
+	"upload":   "uploaded_at, id",
+	"capture":  "COALESCE(captured_at, uploaded_at), id",
+	"filename": "filename COLLATE NOCASE, id",
+	"manual":   "album_photos.position, id",
+}
+
+// albumCoverSQL selects the cover photo of the album in the surrounding query: the chosen cover if it's still in
+// the album, otherwise the album's first photo, or 0 if the album is empty
+const albumCoverSQL = "COALESCE((SELECT photo_id FROM album_photos JOIN photos ON photos.id = album_photos.photo_id " +
+	"WHERE photo_id = albums.cover_photo_id AND album_id = albums.id AND photos.trashed_at IS NULL), " +
+	"(SELECT MIN(photo_id) FROM album_photos JOIN photos ON photos.id = album_photos.photo_id " +
+	"WHERE album_id = albums.id AND photos.trashed_at IS NULL), 0)"
+
+// photoInfo holds what the templates need to show a photo in a list
+type photoInfo struct {
+	ID      int64
+	Title   string
+	Caption string
+	AltText string
+}
+
+// Alt returns the text for the alt attribute of the photo's img tag, falling back to the title
+func (p photoInfo) Alt() string {
+	if p.AltText != "" {
+		return p.AltText
+	}
+	if p.Title != "" {
+		return p.Title
+	}
+	return "photo " + strconv.FormatInt(p.ID, 10)
+}
+
+// scanPhotoInfos reads rows of (id, title, caption, alt_text)
+func scanPhotoInfos(rows *sql.Rows) ([]photoInfo, error) {
+	photos := make([]photoInfo, 0)
+	for rows.Next() {
+		var p photoInfo
+		if err := rows.Scan(&p.ID, &p.Title, &p.Caption, &p.AltText); err != nil {
+			return nil, err
+		}
+		photos = append(photos, p)
+	}
+	return photos, rows.Err()
 }
 
 type albumpage struct {
-	UserID  int64
-	AlbumID int64
-	Photos  []int64
+	UserID      int64
+	AlbumID     int64
+	Name        string
+	Description string
+	CoverID     int64
+	From        string
+	To          string
+	IsOwner     bool
+	CanEdit     bool
+	SortMode    string
+	Query       string // set for smart albums
+	Photos      []photoInfo
 	//Tags    []string
 }
 
 type photopage struct {
-	AlbumID int64
-	PhotoID int64
-	Path    string
-	Tags    []string
+	AlbumID   int64
+	AlbumName string
+	Albums    []albumRef
+	Targets   []albumRef
+	PhotoID   int64
+	Path      string
+	Tags      []string
+	Title     string
+	Caption   string
+	AltText   string
+	Keywords  string
+	CanEdit   bool
 }
 
+// Alt returns the text for the alt attribute of the photo's img tag, the same way as photoInfo.Alt
+func (p photopage) Alt() string {
+	return photoInfo{ID: p.PhotoID, Title: p.Title, AltText: p.AltText}.Alt()
+}
+
+// viewpage is a grid of photos: a user's photos, or the results of a query when Action is set to where the page's
+// query form goes
 type viewpage struct {
-	UserID int64
-	Photos []int64
+	UserID  int64
+	Heading string
+	Action  string
+	Query   string
+	Error   string
+	Photos  []photoInfo
 }
 
 func (p photopage) render(w http.ResponseWriter) error {
 	return templates.ExecuteTemplate(w, "photo.html", p)
 }
 
-//
+// expects rows of (id, name, cover photo id, photo count)
 func (h homepage) render(w http.ResponseWriter, r *http.Request, rows *sql.Rows) error {
-	albums := make([]int64, 0)
-	for i := 0; rows.Next(); i++ {
-		var newElem int64
-		albums = append(albums, newElem)
-		err := rows.Scan(&albums[i])
-		if err != nil {
+	albums := make([]albumInfo, 0)
+	for rows.Next() {
+		var a albumInfo
+		if err := rows.Scan(&a.ID, &a.Name, &a.CoverID, &a.Count); err != nil {
 			return err
 		}
+		if card, ok := h.Smart[a.ID]; ok {
+			a.CoverID, a.Count, a.Smart = card.CoverID, card.Count, true
+		}
+		albums = append(albums, a)
 	}
 	h.Albums = albums
 
@@ -265,14 +462,9 @@ func (h homepage) render(w http.ResponseWriter, r *http.Request, rows *sql.Rows)
 }
 
 func (a albumpage) render(w http.ResponseWriter, r *http.Request, rows *sql.Rows) error {
-	photos := make([]int64, 0)
-	for i := 0; rows.Next(); i++ {
-		var newElem int64
-		photos = append(photos, newElem)
-		err := rows.Scan(&photos[i])
-		if err != nil {
-			return err
-		}
+	photos, err := scanPhotoInfos(rows)
+	if err != nil {
+		return err
 	}
 	a.Photos = photos
 	fmt.Printf("album photos: %v\n", a.Photos)
@@ -280,14 +472,9 @@ func (a albumpage) render(w http.ResponseWriter, r *http.Request, rows *sql.Rows
 }
 
 func (v viewpage) render(w http.ResponseWriter, r *http.Request, rows *sql.Rows) error {
-	photos := make([]int64, 0)
-	for i := 0; rows.Next(); i++ {
-		var newElem int64
-		photos = append(photos, newElem)
-		err := rows.Scan(&photos[i])
-		if err != nil {
-			return err
-		}
+	photos, err := scanPhotoInfos(rows)
+	if err != nil {
+		return err
 	}
 	v.Photos = photos
 	return templates.ExecuteTemplate(w, "view.html", v)
@@ -316,9 +503,8 @@ func registerHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 			return
 		} else {
 			sessionID := randString(10)
-			_, err = tx.Exec("INSERT INTO sessions (user_id, session_id) VALUES (?, ?)", id, sessionID)
-			if err != nil {
-				log.Printf("failed to insert session id into database: %s", err)
+			if err = store.WithTx(tx).CreateSession(id, sessionID); err != nil {
+				log.Printf("%s", err)
 				http.Redirect(w, r, "/login/", http.StatusInternalServerError)
 			}
 			cookie := http.Cookie{
@@ -343,78 +529,61 @@ func registerHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 }
 
 func loginHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	tx, err := db.BeginTx(ctx, nil)
-	if err != nil {
-		log.Printf("failed to begin transaction: %s", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	if len(r.URL.Query()) > 0 { // is there a better way to check if user credentials were input?
+	if len(r.URL.Query()) > 0 || r.Method == http.MethodPost { // is there a better way to check if user credentials were input?
 		if r.URL.Query().Get("logout") == "yes" {
 			cookie, err := r.Cookie("session_cookie")
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
-			_, err = tx.Exec("DELETE FROM sessions WHERE session_id = ?", cookie.Value)
-			if err != nil {
-				log.Printf("failed to delete session id on logout")
+			if err = inTx(db, func(tx *sql.Tx) error { return store.WithTx(tx).DeleteSession(cookie.Value) }); err != nil {
+				log.Printf("failed to delete session id on logout: %s", err)
 			}
 			http.Redirect(w, r, "/login/", http.StatusFound)
 			return
 		}
 		email := r.FormValue("email")
 		log.Printf("entered email: %s", email)
-		row := tx.QueryRow("SELECT id FROM users WHERE email = ?", email)
 		var id int64
-		err = row.Scan(&id)
+		var storedPassword string
+		var disabled bool
+		err := inTx(db, func(tx *sql.Tx) (err error) {
+			if id, storedPassword, err = store.WithTx(tx).UserByEmail(email); err != nil {
+				return err
+			}
+			disabled, err = store.WithTx(tx).UserDisabled(id)
+			return err
+		})
 		if err != nil {
-			log.Printf("failed to scan row: %s", err)
+			log.Printf("failed to find user %s: %s", email, err)
 			http.Redirect(w, r, "/login/", http.StatusFound)
 			return
 		}
-
-		inputPassword := r.FormValue("password")
-		log.Printf("entered password: %s", inputPassword)
-		inputPasswordBytes := []byte(inputPassword)
-		/*hashedPassword, err := bcrypt.GenerateFromPassword(inputPassword, 1) // what does minimum cost argument mean?
-		if err != nil {
-			log.Printf("failed to hash password: %s", err)
-			http.Redirect(w, r, "/login/", http.StatusUnauthorized)
+		if disabled {
+			log.Printf("refused login of disabled user %s", email)
+			http.Redirect(w, r, "/login/", http.StatusFound)
 			return
 		}
-		*/
-		row = tx.QueryRow("SELECT password FROM users WHERE email = ?", email)
-		var storedPassword string
-		if err = row.Scan(&storedPassword); err != nil {
-			log.Printf("failed to retrieve user password: %s", err)
+
+		// bcrypt is slow on purpose, so the password is checked with no transaction holding the write connection
+		if err = bcrypt.CompareHashAndPassword([]byte(storedPassword), []byte(r.FormValue("password"))); err != nil {
+			log.Printf("user input incorrect password: %s", err)
 			http.Redirect(w, r, "/login/", http.StatusUnauthorized)
 			return
 		}
-		storedPasswordBytes := []byte(storedPassword)
-		if err = bcrypt.CompareHashAndPassword(storedPasswordBytes, inputPasswordBytes); err != nil {
-			log.Printf("user input incorrect password: %s", err)
-			log.Printf("input password: %s | stored password: %s", inputPasswordBytes, storedPasswordBytes)
-			http.Redirect(w, r, "/login/", http.StatusUnauthorized)
+		sessionID := randString(10)
+		if err = inTx(db, func(tx *sql.Tx) error { return store.WithTx(tx).CreateSession(id, sessionID) }); err != nil {
+			log.Printf("%s", err)
+			http.Redirect(w, r, "/login/", http.StatusInternalServerError)
 			return
-		} else {
-			sessionID := randString(10)
-			_, err = tx.Exec("INSERT INTO sessions (user_id, session_id) VALUES (?, ?)", id, sessionID)
-			if err != nil {
-				log.Printf("failed to insert session id into database: %s", err)
-				http.Redirect(w, r, "/login/", http.StatusInternalServerError)
-			}
-			cookie := http.Cookie{
-				Name:  "session_cookie",
-				Value: sessionID,
-				Path:  "/",
-			}
-			http.SetCookie(w, &cookie)
-			http.Redirect(w, r, "/home/"+strconv.FormatInt(id, 10), http.StatusFound)
 		}
+		cookie := http.Cookie{
+			Name:  "session_cookie",
+			Value: sessionID,
+			Path:  "/",
+		}
+		http.SetCookie(w, &cookie)
+		http.Redirect(w, r, "/home/"+strconv.FormatInt(id, 10), http.StatusFound)
 	} else { // if there is no query, send to login page
 		if err := templates.ExecuteTemplate(w, "login.html", homepage{}); err != nil {
 			log.Printf("failed to execute login template: %s", err)
@@ -422,13 +591,10 @@ func loginHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 			return
 		}
 	}
-	if err := tx.Commit(); err != nil {
-		log.Printf("%s", err)
-	}
 }
 
 func homeHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
-	_, err := checkSesh(w, r, db)
+	sessionUserID, err := checkSesh(w, r, db)
 	if err != nil {
 		log.Printf("failed to validate user session: %s", err)
 	}
@@ -458,25 +624,44 @@ func homeHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 			log.Printf("user didn't input album name, no album created")
 			http.Redirect(w, r, path.Join("/home/", id), http.StatusFound)
 		} else {
-			res, err := tx.Exec("INSERT INTO albums (user_id, name) VALUES (?, ?)", h.UserID, albumName)
+			albumID, err := newAlbum(albumName, h.UserID, tx)
 			if err != nil {
 				log.Printf("failed to create new album: %s", err)
 				http.Redirect(w, r, path.Join("/home/", id), http.StatusFound)
 			}
-			albumID, err := res.LastInsertId()
-			if err != nil {
-				log.Printf("failed to get id of new album: %s", err)
-			}
 			log.Printf("album %s with id %v created", albumName, albumID)
 			http.Redirect(w, r, path.Join("/album/", strconv.FormatInt(albumID, 10)), http.StatusFound)
 		}
 	}
 
-	rows, err := tx.Query("SELECT id FROM albums WHERE user_id = ?", h.UserID)
+	if h.Smart, err = smartAlbumCards(h.UserID, tx); err != nil {
+		log.Printf("%s", err)
+	}
+	if h.Self = sessionUserID == h.UserID; h.Self {
+		today := time.Now()
+		h.Day = today.Format(dayLayout)
+		if h.Memories, err = dayMemories(h.UserID, today, tx); err != nil {
+			log.Printf("%s", err)
+		}
+		if err := tx.QueryRow("SELECT memory_digest_since IS NOT NULL FROM users WHERE id = ?", h.UserID).Scan(&h.Digest); err != nil {
+			log.Printf("failed to get memory digest setting of user %v: %s", h.UserID, err)
+		}
+	}
+	rows, err := tx.Query("SELECT id, name, "+albumCoverSQL+", (SELECT COUNT(*) FROM album_photos JOIN photos ON photos.id = album_photos.photo_id "+
+		"WHERE album_id = albums.id AND photos.trashed_at IS NULL) FROM albums WHERE user_id = ? AND trashed_at IS NULL", h.UserID)
 	defer rows.Close()
 	if err != nil {
 		log.Printf("failed to query database for user albums: %s", err)
 	}
+	used, err := userUsage(h.UserID, tx)
+	if err != nil {
+		log.Printf("%s", err)
+	}
+	quota, err := userQuota(h.UserID, tx)
+	if err != nil {
+		log.Printf("%s", err)
+	}
+	h.Used, h.Quota = formatBytes(used), formatQuota(quota)
 	err = h.render(w, r, rows)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -488,7 +673,8 @@ func homeHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 }
 
 func albumHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
-	if _, err := checkSesh(w, r, db); err != nil {
+	sessionUserID, err := checkSesh(w, r, db)
+	if err != nil {
 		log.Printf("failed to validate user session: %s", err)
 	}
 
@@ -509,16 +695,49 @@ func albumHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 
 	a.AlbumID = id
 
-	photoRows, err := tx.Query("SELECT id FROM photos WHERE album_id = ?", a.AlbumID)
-	defer photoRows.Close()
-
-	userRow := tx.QueryRow("SELECT user_id FROM albums WHERE id = ?", id)
+	userRow := tx.QueryRow("SELECT user_id, name, description, "+albumCoverSQL+", sort_mode, trashed_at, COALESCE(query, '') FROM albums WHERE id = ?", id)
 	var userID int64
-	userRow.Scan(&userID)
+	var trashedAt sql.NullString
+	if err := userRow.Scan(&userID, &a.Name, &a.Description, &a.CoverID, &a.SortMode, &trashedAt, &a.Query); err != nil {
+		log.Printf("failed to get details of album %v: %s", id, err)
+	}
+	if trashedAt.Valid {
+		http.Error(w, "this album is in the trash", http.StatusNotFound)
+		return
+	}
 	a.UserID = userID
+	a.IsOwner = userID == sessionUserID
+	a.CanEdit = checkContributor(id, sessionUserID, tx)
+	if a.Query != "" {
+		if err := renderSmartAlbum(w, a, sessionUserID, tx); err != nil {
+			log.Printf("failed to show smart album %v: %s", id, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		if err := tx.Commit(); err != nil {
+			log.Printf("%s", err)
+		}
+		return
+	}
+
+	order, ok := sortModes[a.SortMode]
+	if !ok {
+		a.SortMode, order = "upload", sortModes["upload"]
+	}
+	photoRows, photoErr := tx.Query("SELECT id, title, caption, alt_text FROM photos JOIN album_photos ON photos.id = album_photos.photo_id "+
+		"WHERE album_photos.album_id = ? AND photos.trashed_at IS NULL ORDER BY "+order, a.AlbumID)
+	defer photoRows.Close()
 
+	// the album covers the span of its photos' capture times, using upload time for photos without one
+	var from, to sql.NullString
+	err = tx.QueryRow("SELECT MIN(COALESCE(captured_at, uploaded_at)), MAX(COALESCE(captured_at, uploaded_at)) "+
+		"FROM photos JOIN album_photos ON photos.id = album_photos.photo_id WHERE album_photos.album_id = ? AND photos.trashed_at IS NULL", id).Scan(&from, &to)
 	if err != nil {
-		log.Printf("failed to query user photos: %s", err)
+		log.Printf("failed to get date range of album %v: %s", id, err)
+	}
+	a.From, a.To = formatDate(from.String), formatDate(to.String)
+
+	if photoErr != nil {
+		log.Printf("failed to query user photos: %s", photoErr)
 		return
 	}
 	/*
@@ -535,9 +754,281 @@ func albumHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 	}
 }
 
+// updates an album's description from a POSTed form
+func editAlbumHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	userID, err := checkSesh(w, r, db)
+	if err != nil {
+		log.Printf("failed to validate user session: %s", err)
+		return
+	}
+
+	id := path.Base(r.URL.Path)
+	albumID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		log.Printf("failed to get id of album to edit: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, path.Join("/album/", id), http.StatusFound)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("failed to begin transaction: %s", err)
+		return
+	}
+	defer tx.Rollback()
+
+	if !checkOwner(albumID, userID, tx) {
+		log.Printf("user %v can't edit album %v", userID, albumID)
+		http.Error(w, "only the album owner can edit it", http.StatusForbidden)
+		return
+	}
+	if err = store.WithTx(tx).SetAlbumDescription(albumID, r.PostFormValue("description")); err != nil {
+		log.Printf("%s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("%s", err)
+	}
+	http.Redirect(w, r, path.Join("/album/", id), http.StatusFound)
+}
+
+// sets the cover of an album to the POSTed photo, which has to be in the album
+func albumCoverHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	userID, err := checkSesh(w, r, db)
+	if err != nil {
+		log.Printf("failed to validate user session: %s", err)
+		return
+	}
+
+	id := path.Base(r.URL.Path)
+	albumID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		log.Printf("failed to get id of album to set cover of: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	photoID, err := strconv.ParseInt(r.PostFormValue("photo"), 10, 64)
+	if err != nil {
+		log.Printf("failed to get id of cover photo: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("failed to begin transaction: %s", err)
+		return
+	}
+	defer tx.Rollback()
+
+	if !checkOwner(albumID, userID, tx) {
+		log.Printf("user %v can't set the cover of album %v", userID, albumID)
+		http.Error(w, "only the album owner can choose its cover", http.StatusForbidden)
+		return
+	}
+	res, err := tx.Exec("UPDATE albums SET cover_photo_id = ? WHERE id = ? AND EXISTS (SELECT 1 FROM album_photos WHERE photo_id = ? AND album_id = ?)",
+		photoID, albumID, photoID, albumID)
+	if err != nil {
+		log.Printf("failed to set cover of album %v: %s", albumID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "that photo isn't in this album", http.StatusBadRequest)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("%s", err)
+	}
+	http.Redirect(w, r, path.Join("/album/", id), http.StatusFound)
+}
+
+// renames an album to the POSTed name
+func renameAlbumHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	userID, err := checkSesh(w, r, db)
+	if err != nil {
+		log.Printf("failed to validate user session: %s", err)
+		return
+	}
+
+	id := path.Base(r.URL.Path)
+	albumID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		log.Printf("failed to get id of album to rename: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	name := r.PostFormValue("name")
+	if name == "" {
+		log.Printf("user didn't input album name, album not renamed")
+		http.Redirect(w, r, path.Join("/album/", id), http.StatusFound)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("failed to begin transaction: %s", err)
+		return
+	}
+	defer tx.Rollback()
+
+	if !checkOwner(albumID, userID, tx) {
+		log.Printf("user %v can't rename album %v", userID, albumID)
+		http.Error(w, "only the album owner can rename it", http.StatusForbidden)
+		return
+	}
+	if err = store.WithTx(tx).RenameAlbum(albumID, name); err != nil {
+		log.Printf("%s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("%s", err)
+	}
+	http.Redirect(w, r, path.Join("/album/", id), http.StatusFound)
+}
+
+// saves the POSTed sort mode of an album so it's shown that way from now on
+func sortAlbumHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	userID, err := checkSesh(w, r, db)
+	if err != nil {
+		log.Printf("failed to validate user session: %s", err)
+		return
+	}
+
+	id := path.Base(r.URL.Path)
+	albumID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		log.Printf("failed to get id of album to sort: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	mode := r.PostFormValue("sort")
+	if _, ok := sortModes[mode]; !ok {
+		http.Error(w, fmt.Sprintf("unknown sort mode %q", mode), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("failed to begin transaction: %s", err)
+		return
+	}
+	defer tx.Rollback()
+
+	if !checkContributor(albumID, userID, tx) {
+		log.Printf("user %v can't change the sort mode of album %v", userID, albumID)
+		http.Error(w, "you don't have contributor rights for this album", http.StatusForbidden)
+		return
+	}
+	if _, err = tx.Exec("UPDATE albums SET sort_mode = ? WHERE id = ?", mode, albumID); err != nil {
+		log.Printf("failed to set sort mode of album %v: %s", albumID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("%s", err)
+	}
+	http.Redirect(w, r, path.Join("/album/", id), http.StatusFound)
+}
+
+// stores the manual order of an album's photos. The POSTed order is a comma separated list of photo ids, photos
+// of the album that are left out keep their place after the listed ones
+func reorderAlbumHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	userID, err := checkSesh(w, r, db)
+	if err != nil {
+		log.Printf("failed to validate user session: %s", err)
+		return
+	}
+
+	id := path.Base(r.URL.Path)
+	albumID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		log.Printf("failed to get id of album to reorder: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	order, err := parseIDList(r.PostFormValue("order"))
+	if err != nil {
+		log.Printf("failed to parse photo order: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("failed to begin transaction: %s", err)
+		return
+	}
+	defer tx.Rollback()
+
+	if !checkContributor(albumID, userID, tx) {
+		log.Printf("user %v can't reorder album %v", userID, albumID)
+		http.Error(w, "you don't have contributor rights for this album", http.StatusForbidden)
+		return
+	}
+	// move everything out of the way first so unlisted photos end up after the listed ones in their old order
+	if _, err = tx.Exec("UPDATE album_photos SET position = position + ? WHERE album_id = ?", len(order), albumID); err != nil {
+		log.Printf("failed to reorder album %v: %s", albumID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i, photoID := range order {
+		if _, err = tx.Exec("UPDATE album_photos SET position = ? WHERE photo_id = ? AND album_id = ?", i, photoID, albumID); err != nil {
+			log.Printf("failed to move photo %v in album %v: %s", photoID, albumID, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if _, err = tx.Exec("UPDATE albums SET sort_mode = 'manual' WHERE id = ?", albumID); err != nil {
+		log.Printf("failed to set sort mode of album %v: %s", albumID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("%s", err)
+	}
+	http.Redirect(w, r, path.Join("/album/", id), http.StatusFound)
+}
+
+// parses a comma separated list of ids like "3,1,2"
+func parseIDList(s string) ([]int64, error) {
+	ids := make([]int64, 0)
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		id, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse id %q: %w", field, err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// moves an album to the trash
 func deleteAlbumHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
-	if _, err := checkSesh(w, r, db); err != nil {
+	sessionUserID, err := checkSesh(w, r, db)
+	if err != nil {
 		log.Printf("failed to validate user session: %s", err)
+		return
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -563,19 +1054,21 @@ func deleteAlbumHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 		return
 	}
 
-	if _, err = tx.Exec("DELETE FROM albums WHERE id = ?", albumID); err != nil {
-		log.Printf("failed to delete album %s from database: %s", albumID, err)
-		http.Redirect(w, r, path.Join("/home/", userID), http.StatusFound)
+	if userID != strconv.FormatInt(sessionUserID, 10) {
+		log.Printf("user %v can't delete album %s", sessionUserID, albumID)
+		http.Error(w, "only the album owner can delete it", http.StatusForbidden)
 		return
 	}
 
-	if _, err = tx.Exec("DELETE FROM photos WHERE album_id = ?", albumID); err != nil {
-		log.Printf("failed to delete photos from album %s from database: %s", albumID, err)
+	// photos that are also in other albums stay there, the rest go to the trash with the album
+	id, _ := strconv.ParseInt(albumID, 10, 64)
+	if err = trashAlbum(id, tx); err != nil {
+		log.Printf("%s", err)
 		http.Redirect(w, r, path.Join("/home/", userID), http.StatusFound)
 		return
 	}
 
-	log.Printf("Deleted album %s and its photos", albumID)
+	log.Printf("Moved album %s to the trash", albumID)
 
 	if err := tx.Commit(); err != nil {
 		log.Printf("%s", err)
@@ -585,7 +1078,7 @@ func deleteAlbumHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 
 // serves HTML
 func photoHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
-	_, err := checkSesh(w, r, db)
+	sessionUserID, err := checkSesh(w, r, db)
 	if err != nil {
 		log.Printf("failed to validate user session: %s", err)
 	}
@@ -607,8 +1100,8 @@ func photoHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 	}
 
 	var userID int64
-	if len(r.URL.Query()) > 0 {
-		//if the form has been filled in, create a new album with the entered name
+	if _, ok := r.URL.Query()["tag"]; ok {
+		//if the form has been filled in, tag the entered user
 		taggedEmail := r.FormValue("tag") //TODO: change to username once usernames are implemented
 		//how to handle errors here? does return work? Need to make sure second if statement doesn't execute
 		//after an error
@@ -616,13 +1109,12 @@ func photoHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 			log.Printf("failed to create tag: no user input")
 			http.Redirect(w, r, path.Join("photo", id), http.StatusFound)
 		} else {
-			if err = tx.QueryRow("SELECT id FROM users WHERE email = ?", taggedEmail).Scan(&userID); err != nil {
+			if userID, _, err = store.WithTx(tx).UserByEmail(taggedEmail); err != nil {
 				log.Printf("failed to find user with email %s", taggedEmail)
 				http.Redirect(w, r, path.Join("/photo/", id), http.StatusFound)
 				return
 			}
-			_, err := tx.Exec("INSERT INTO tags (photo_id, user_id) VALUES (?, ?)", p.PhotoID, userID)
-			if err != nil {
+			if err := store.WithTx(tx).AddTag(p.PhotoID, userID); err != nil {
 				log.Printf("failed to tag new user %s: %s", taggedEmail, err)
 				http.Redirect(w, r, path.Join("/photo/", id), http.StatusFound)
 				return
@@ -630,34 +1122,87 @@ func photoHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 		}
 	}
 
-	taggedRows, err := tx.Query("SELECT email FROM users JOIN tags ON users.id = tags.user_id WHERE tags.photo_id = ?", p.PhotoID)
-	defer taggedRows.Close()
-	if err != nil {
-		log.Printf("failed to get tagged users from database: %s", err)
+	if p.Tags, err = store.WithTx(tx).PhotoTags(p.PhotoID); err != nil {
+		log.Printf("%s", err)
 		http.Redirect(w, r, path.Join("/photo/", id), http.StatusFound)
+		return
+	}
+	details, err := store.WithTx(tx).PhotoDetails(p.PhotoID)
+	if err != nil {
+		log.Printf("%s", err)
 	}
-	emails := make([]string, 0)
-	for i := 0; taggedRows.Next(); i++ {
-		var newElem string
-		emails = append(emails, newElem)
-		if err = taggedRows.Scan(&emails[i]); err != nil {
-			log.Printf("failed to scan emails from result of tag query: %s", err)
-			http.Redirect(w, r, path.Join("/photo/", id), http.StatusFound)
+	p.Title, p.Caption, p.AltText, p.Keywords = details.Title, details.Caption, details.AltText, details.Keywords
+	if p.Albums, err = photoAlbums(p.PhotoID, tx); err != nil {
+		log.Printf("%s", err)
+	}
+	//for navigation back to the album level: the album the photo was opened from, or else the first one it's in
+	albumID, _ := strconv.ParseInt(r.URL.Query().Get("album"), 10, 64)
+	for _, a := range p.Albums {
+		if a.ID == albumID || p.AlbumID == 0 {
+			p.AlbumID, p.AlbumName = a.ID, a.Name
 		}
 	}
-	p.Tags = emails
-	//for navigation back to the album level
-	row := tx.QueryRow("SELECT album_id FROM photos WHERE id = ?", id)
-	var albumID int64
-	if err := row.Scan(&albumID); err != nil {
-		log.Printf("failed to scan albumID: %s", err)
+	p.CanEdit = checkPhotoContributor(p.PhotoID, sessionUserID, tx)
+	if p.CanEdit {
+		if p.Targets, err = contributorAlbums(sessionUserID, tx); err != nil {
+			log.Printf("%s", err)
+		}
 	}
-
-	p.AlbumID = albumID
 	err = p.render(w)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("%s", err)
+	}
+}
+
+// updates the title, caption, alt text and keywords of a photo from a POSTed form
+func editPhotoHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	userID, err := checkSesh(w, r, db)
+	if err != nil {
+		log.Printf("failed to validate user session: %s", err)
+		return
+	}
+
+	id := path.Base(r.URL.Path)
+	photoID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		log.Printf("failed to get id of photo to edit: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, path.Join("/photo/", id), http.StatusFound)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("failed to begin transaction: %s", err)
+		return
+	}
+	defer tx.Rollback()
+
+	if !checkPhotoContributor(photoID, userID, tx) {
+		log.Printf("user %v can't edit photo %v", userID, photoID)
+		http.Error(w, "you don't have contributor rights for this photo", http.StatusForbidden)
+		return
+	}
+
+	err = store.WithTx(tx).SetPhotoDetails(photoID, photoDetails{Title: r.PostFormValue("title"), Caption: r.PostFormValue("caption"),
+		AltText: r.PostFormValue("alt"), Keywords: r.PostFormValue("keywords")})
+	if err != nil {
+		log.Printf("%s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("%s", err)
+	}
+	http.Redirect(w, r, path.Join("/photo/", id)+"?"+url.Values{"album": {r.PostFormValue("album")}}.Encode(), http.StatusFound)
 }
 
 // serves images /photos/1 -> /Users/moose1/Documents/photoApp/Photos/1.jpg
@@ -682,56 +1227,60 @@ func photosHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 		log.Printf("failed to convert id string to int: %s", err)
 		return
 	}
-	var path string
-	err = tx.QueryRow("SELECT path FROM photos WHERE id = ?", id).Scan(&path)
+	file, err := store.WithTx(tx).PhotoFile(id)
 	if err != nil {
-		log.Printf("failed to get photo path: %s", err)
+		log.Printf("%s", err)
 		return
 	}
 
-	f, err := os.Open(path)
+	f, err := openBlob(file.Path, file.Key)
 	if err != nil {
 		log.Printf("failed to open photo: %s", err)
+		http.Error(w, "failed to open photo", http.StatusInternalServerError)
 		return
 	}
-	_, err = io.Copy(w, f)
-	if err != nil {
-		log.Printf("failed to copy photo to response writer: %s", err)
-		return
-	}
+	defer f.Close()
+	// ServeContent decrypts only the chunks a request needs, so large photos stream and can be fetched in ranges
+	modified, _ := time.Parse(timeLayout, file.UploadedAt)
+	http.ServeContent(w, r, "", modified, f)
 	if err := tx.Commit(); err != nil {
 		log.Printf("%s", err)
 	}
 }
 
-//TODO: move checkPerm call from addPhoto to uploadHandler
+// TODO: move checkPerm call from addPhoto to uploadHandler
 func uploadHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
-	_, err := checkSesh(w, r, db)
+	userID, err := checkSesh(w, r, db)
 	if err != nil {
 		log.Printf("failed to validate user session: %s", err)
+		return
 	}
 
 	err = r.ParseMultipartForm(1000000)
 	if err != nil {
-		log.Printf("failed to parse multipart form: %w", err)
+		log.Printf("failed to parse multipart form: %s", err)
 		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
 		return
 	}
 	imageInput := r.MultipartForm.File
 	fh := imageInput["photo"]
 	if len(fh) < 1 {
-		log.Fatalf("ERR: no file uploaded")
+		log.Printf("ERR: no file uploaded")
+		http.Error(w, "no file uploaded", http.StatusUnprocessableEntity)
+		return
 	} else if len(fh) > 1 {
-		log.Fatalf("ERR: too many files uploaded\n")
+		log.Printf("ERR: too many files uploaded\n")
+		http.Error(w, "too many files uploaded", http.StatusUnprocessableEntity)
+		return
 	}
 	fmt.Printf("uploaded file size: %v\n", fh[0].Size)
 	mpf, err := fh[0].Open()
-	defer mpf.Close()
 	if err != nil {
-		log.Printf("failed to open multipart file: %w", err)
+		log.Printf("failed to open multipart file: %s", err)
 		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
 		return
 	}
+	defer mpf.Close()
 	albumID, err := strconv.ParseInt(path.Base(r.URL.Path), 10, 64)
 	if err != nil {
 		log.Printf("failed to convert albumID string to int")
@@ -739,38 +1288,25 @@ func uploadHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 		return
 	}
 
-	//TODO: Get userID from site token or cookie
-	photoID, path, err := addPhoto(albumID, 1, db)
-	if err != nil {
-		log.Printf("failed to add photo to database: %s", err)
-		http.Error(w, err.Error(), http.StatusNotFound)
-		return
-	}
-	f, err := os.Create(path)
-	if err != nil {
-		log.Printf("failed to create file with path %s: %s", path, err)
-		http.Redirect(w, r, "/album/"+strconv.FormatInt(albumID, 10), http.StatusInternalServerError)
-		return
-	}
-	_, err = io.Copy(f, mpf)
-	if err != nil {
-		log.Printf("failed to copy data from multipart file to photo file: %s", err)
-		http.Redirect(w, r, "/album/"+strconv.FormatInt(albumID, 10), http.StatusInternalServerError)
+	photoID, _, err := addPhoto(albumID, userID, fh[0].Filename, mpf, db)
+	if errors.Is(err, errQuotaExceeded) {
+		log.Printf("user %v can't upload to album %v: %s", userID, albumID, err)
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
 		return
-	}
-	info, err := f.Stat()
-	if err != nil {
-		log.Printf("failed to get information about the created file: %s", err)
-		http.Redirect(w, r, "/album/"+strconv.FormatInt(albumID, 10), http.StatusInternalServerError)
+	} else if err != nil {
+		log.Printf("failed to add photo: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	fmt.Printf("copied file size: %v\n", info.Size())
 	http.Redirect(w, r, "/photo/"+strconv.FormatInt(photoID, 10), http.StatusFound)
 }
 
+// moves a photo to its owner's trash
 func deletePhotoHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
-	if _, err := checkSesh(w, r, db); err != nil {
+	userID, err := checkSesh(w, r, db)
+	if err != nil {
 		log.Printf("failed to validate user session: %s", err)
+		return
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -785,27 +1321,30 @@ func deletePhotoHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 	photoID := path.Base(r.URL.Path)
 
 	//get albumID of photo to use for redirect destination in case of error
-	var albumID string
-	if err = tx.QueryRow("SELECT album_id FROM photos WHERE id = ?", photoID).Scan(&albumID); err != nil {
-		log.Printf("failed to select album id from database: %s", err)
-		http.Redirect(w, r, "/home/", http.StatusFound) //TODO: redirect to specific homepage of user
+	albumID := r.PostFormValue("album")
+	if albumID == "" {
+		if err = tx.QueryRow("SELECT album_id FROM album_photos WHERE photo_id = ? ORDER BY album_id LIMIT 1", photoID).Scan(&albumID); err != nil {
+			log.Printf("failed to select album id from database: %s", err)
+			http.Redirect(w, r, "/home/", http.StatusFound) //TODO: redirect to specific homepage of user
+		}
 	}
 
 	//check if last element of path is a number
-	if _, err = strconv.Atoi(photoID); err != nil {
+	id, err := strconv.ParseInt(photoID, 10, 64)
+	if err != nil {
 		log.Printf("failed to get photo id to be deleted: %s", err)
 		http.Redirect(w, r, path.Join("/album/", albumID), http.StatusFound)
 		return
 	}
 
-	if _, err = tx.Exec("DELETE FROM photos WHERE id = ?", photoID); err != nil {
-		log.Printf("failed to delete photo %s from database: %s", photoID, err)
-		http.Redirect(w, r, path.Join("/album/", albumID), http.StatusFound)
+	if !checkPhotoContributor(id, userID, tx) {
+		log.Printf("user %v can't delete photo %s", userID, photoID)
+		http.Error(w, "you don't have contributor rights for this photo", http.StatusForbidden)
 		return
 	}
 
-	if err = os.Remove(filepath.Join(os.Getenv("SILSILA_PHOTO_PATH"), photoID)); err != nil {
-		log.Printf("failed to delete photo %s from system: %s", photoID, err)
+	if err = trashPhoto(id, tx); err != nil {
+		log.Printf("%s", err)
 		http.Redirect(w, r, path.Join("/album/", albumID), http.StatusFound)
 		return
 	}
@@ -818,7 +1357,7 @@ func deletePhotoHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 
 func viewHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 	if _, err := checkSesh(w, r, db); err != nil {
-		log.Printf("failed to validate user session: %s, err")
+		log.Printf("failed to validate user session: %s", err)
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -841,7 +1380,8 @@ func viewHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 
 	}
 
-	photoRows, err := tx.Query("SELECT id FROM photos WHERE user_id = ?", v.UserID)
+	photoRows, err := tx.Query("SELECT id, title, caption, alt_text FROM photos WHERE user_id = ? AND trashed_at IS NULL "+
+		"AND NOT "+inTrashedAlbumsSQL, v.UserID)
 	if err != nil {
 		log.Printf("failed to query database for photos")
 	}
@@ -866,10 +1406,34 @@ func makeHandler(fn func(http.ResponseWriter, *http.Request, *sql.DB), db *sql.D
 	}
 }
 
+// photoapp is built and tested with -tags sqlite_fts5, which search needs, see sqlite.go:
+// go build -tags sqlite_fts5 && go test -tags sqlite_fts5 ./...
 func main() {
 	port := flag.Int("port", 8080, "designate port to bind to.")
 	dbPath := flag.String("db", "/Users/ben/Documents/photoApp/photoAppDB", "designate database path to use")
+	trashRetention := flag.Duration("trash-retention", 30*24*time.Hour, "how long deleted photos and albums stay in the trash")
+	fsckInterval := flag.Duration("fsck-interval", 0, "how often to check stored photos against the database, 0 to never")
+	autoMigrate := flag.Bool("migrate", true, "apply pending database migrations on startup")
+	keyFile := flag.String("key-file", "", "file holding the master key to encrypt photos with, defaults to $SILSILA_MASTER_KEY")
+	flag.StringVar(&backupDir, "backup-dir", "", "directory to keep backups in")
+	backupInterval := flag.Duration("backup-interval", 0, "how often to back up to -backup-dir, 0 to never")
+	backupKeep := flag.Int("backup-keep", 14, "number of scheduled backups to keep")
+	watchInterval := flag.Duration("watch-interval", 10*time.Second, "how often to look for new photos in watch folders, 0 to never")
+	flag.DurationVar(&exportTTL, "export-ttl", exportTTL, "how long a finished export can be downloaded")
+	smtpAddr := flag.String("smtp-addr", "", "host:port of the SMTP server to email memory digests through, empty to send none")
+	smtpFrom := flag.String("smtp-from", "", "address memory digests are sent from")
+	smtpUser := flag.String("smtp-user", "", "user to log in to the SMTP server as, with the password in $SILSILA_SMTP_PASSWORD")
+	flag.StringVar(&publicURL, "public-url", "", "address the site is reached at, for links in emails")
+	flag.Int64Var(&defaultQuota, "default-quota", 0, "storage quota in bytes of users without one of their own, 0 for unlimited")
 	flag.Parse()
+	// sync runs on the client, which has no database of its own
+	if flag.Arg(0) == "sync" {
+		if err := syncCommand(flag.Args()[1:]); err != nil {
+			log.Printf("%s", err)
+			os.Exit(1)
+		}
+		return
+	}
 	pathenv := "SILSILA_PHOTO_PATH"
 	_, ok := os.LookupEnv(pathenv)
 	if !ok {
@@ -888,21 +1452,95 @@ func main() {
 		log.Printf("failed to get info about database file: %s", err)
 		return
 	}
-	db, err := sql.Open("sqlite3", *dbPath)
+	f.Close()
+	// db is where everything that writes goes, readDB serves the pages that only read
+	readDB, db, err := openSQLite(*dbPath)
 	if err != nil {
-		log.Printf("failed to open database: %s\n", dbPath)
+		log.Printf("failed to open database %s: %s", *dbPath, err)
+		return
 	}
 	defer db.Close()
+	defer readDB.Close()
+	store = newSQLiteStore(db)
+	encryptionKey, err = loadMasterKey(*keyFile)
+	if err != nil {
+		log.Printf("%s", err)
+		return
+	}
+	if *smtpAddr != "" {
+		m, err := newSMTPMailer(*smtpAddr, *smtpFrom, *smtpUser, os.Getenv("SILSILA_SMTP_PASSWORD"))
+		if err != nil {
+			log.Printf("%s", err)
+			return
+		}
+		digestMailer = m
+	}
+
+	// migrate is left to do its own thing, so reverting a migration doesn't reapply it straight away
+	if *autoMigrate && flag.Arg(0) != "migrate" {
+		if err := migrateUp(db, 0); err != nil {
+			log.Printf("failed to migrate database: %s", err)
+			return
+		}
+	}
+
+	if flag.NArg() > 0 {
+		if err := runCommand(flag.Args(), db); err != nil {
+			log.Printf("%s", err)
+			db.Close()
+			readDB.Close()
+			os.Exit(1)
+		}
+		return
+	}
+
+	startPurger(db, *trashRetention, time.Hour)
+	if *fsckInterval > 0 {
+		startFsck(db, os.Getenv(pathenv), *fsckInterval)
+	}
+	startExporter(db, 10*time.Second)
+	startMemories(db, digestMailer, time.Hour)
+	if *watchInterval > 0 {
+		startWatcher(db, *watchInterval)
+	}
+	if *backupInterval > 0 && backupDir != "" {
+		startBackups(readDB, backupDir, *backupInterval, *backupKeep)
+	}
 	http.HandleFunc("/login/", makeHandler(loginHandler, db))
 	http.HandleFunc("/home/", makeHandler(homeHandler, db))
-	http.HandleFunc("/album/", makeHandler(albumHandler, db))
+	http.HandleFunc("/album/", makeHandler(albumHandler, readDB))
 	http.HandleFunc("/photo/", makeHandler(photoHandler, db))
-	http.HandleFunc("/photos/", makeHandler(photosHandler, db))
+	http.HandleFunc("/photos/", makeHandler(photosHandler, readDB))
 	http.HandleFunc("/upload/", makeHandler(uploadHandler, db)) //TODO: change upload path
 	http.HandleFunc("/register/", makeHandler(registerHandler, db))
 	http.HandleFunc("/photo/delete/", makeHandler(deletePhotoHandler, db))
 	http.HandleFunc("/album/delete/", makeHandler(deleteAlbumHandler, db))
-	http.HandleFunc("/view/", makeHandler(viewHandler, db))
+	http.HandleFunc("/view/", makeHandler(viewHandler, readDB))
+	http.HandleFunc("/photo/edit/", makeHandler(editPhotoHandler, db))
+	http.HandleFunc("/search/", makeHandler(searchHandler, readDB))
+	http.HandleFunc("/memories/", makeHandler(memoriesHandler, db))
+	http.HandleFunc("/query/", makeHandler(queryHandler, readDB))
+	http.HandleFunc("/album/smart/", makeHandler(smartAlbumHandler, db))
+	http.HandleFunc("/album/query/", makeHandler(albumQueryHandler, db))
+	http.HandleFunc("/query.json", makeHandler(queryJSONHandler, readDB))
+	http.HandleFunc("/timeline/", makeHandler(timelineHandler, readDB))
+	http.HandleFunc("/timeline.json", makeHandler(timelineJSONHandler, readDB))
+	http.HandleFunc("/album/edit/", makeHandler(editAlbumHandler, db))
+	http.HandleFunc("/album/cover/", makeHandler(albumCoverHandler, db))
+	http.HandleFunc("/album/rename/", makeHandler(renameAlbumHandler, db))
+	http.HandleFunc("/album/sort/", makeHandler(sortAlbumHandler, db))
+	http.HandleFunc("/album/reorder/", makeHandler(reorderAlbumHandler, db))
+	http.HandleFunc("/photo/move/", makeHandler(movePhotoHandler, db))
+	http.HandleFunc("/photo/copy/", makeHandler(copyPhotoHandler, db))
+	http.HandleFunc("/photo/remove/", makeHandler(removePhotoHandler, db))
+	http.HandleFunc("/trash/", makeHandler(trashHandler, readDB))
+	http.HandleFunc("/trash/restore/", makeHandler(restoreHandler, db))
+	http.HandleFunc("/trash/empty", makeHandler(emptyTrashHandler, db))
+	http.HandleFunc("/export/", makeHandler(exportHandler, db))
+	http.HandleFunc("/export/download/", makeHandler(exportDownloadHandler, readDB))
+	http.HandleFunc("/changes/", makeHandler(changesHandler, readDB))
+	http.HandleFunc("/apppasswords/", makeHandler(appPasswordsHandler, db))
+	http.HandleFunc("/dav/", makeHandler(davHandler(readDB), db))
 
 	log.Println(http.ListenAndServe(fmt.Sprintf(":%v", *port), nil))
 }
@@ -1,38 +1,111 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
-	"strconv"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
-const dbInit = "CREATE TABLE users (id integer primary key, email text unique);\n" +
-	"CREATE TABLE albums (id integer primary key, user_id integer references users(id), name text not null);\n" +
-	"CREATE TABLE photos (id integer primary key, album_id integer references albums(id), user_id integer references users(id));\n" +
-	"CREATE TABLE album_permissions (album_id integer references albums(id), user_id integer references users(id), unique (album_id, user_id));\n" +
-	"CREATE TABLE tags (photo_id references photos(id), tagged_user_id references users(id), unique (photo_id, tagged_user_id));\n" +
-	"INSERT INTO users (email) VALUES ('user1@example.com');\n" +
+const dbSeed = "INSERT INTO users (email) VALUES ('user1@example.com');\n" +
 	"INSERT INTO users (email) VALUES ('user2@example.com');\n" +
 	"INSERT INTO users (email) VALUES ('user3@example.com');\n" +
 	"INSERT INTO albums (user_id, name) VALUES (1, '1 main');\n" +
 	"INSERT INTO albums (user_id, name) VALUES (2, '2 main');\n" +
 	"INSERT INTO albums (user_id, name) VALUES (1, '1s Birthday!');\n" +
 	"INSERT INTO albums (user_id, name) VALUES (3, '3 main');\n" +
-	"INSERT INTO photos (album_id, user_id) VALUES (1, 1);\n" +
-	"INSERT INTO photos (album_id, user_id) VALUES (2, 2);\n" +
-	"INSERT INTO photos (album_id, user_id) VALUES (3, 1);\n" +
-	"INSERT INTO photos (album_id, user_id) VALUES (4, 3);\n"
+	"INSERT INTO photos (user_id) VALUES (1);\n" +
+	"INSERT INTO photos (user_id) VALUES (2);\n" +
+	"INSERT INTO photos (user_id) VALUES (1);\n" +
+	"INSERT INTO photos (user_id) VALUES (3);\n" +
+	"INSERT INTO album_photos (album_id, photo_id) VALUES (1, 1), (2, 2), (3, 3), (4, 4);\n"
 
-func TestPerm(t *testing.T) {
+func check(err error) {
+	if err != nil {
+		panic(err)
+	}
+}
+
+// skips t unless SQLite was built with FTS5, which the search migration needs and go-sqlite3 only compiles in with
+// -tags sqlite_fts5
+func needFTS5(t *testing.T) {
 	db, err := sql.Open("sqlite3", ":memory:")
 	check(err)
 	defer db.Close()
+	if _, err := db.Exec("CREATE VIRTUAL TABLE fts5_check USING fts5(text)"); err != nil {
+		t.Skip("needs SQLite with FTS5, run go test -tags sqlite_fts5 ./...")
+	}
+}
 
-	_, err = db.Exec(dbInit + "INSERT INTO album_permissions (album_id, user_id) VALUES (1, 1);\n" +
-		"INSERT INTO album_permissions (album_id, user_id) VALUES (2, 2);\n" +
-		"INSERT INTO album_permissions (album_id, user_id) VALUES (3, 2);\n")
+// opens an in-memory database with the schema built by the migrations, then runs seed on it
+func testDB(t *testing.T, seed string) *sql.DB {
+	needFTS5(t)
+	db, err := sql.Open("sqlite3", sqliteDSN(":memory:"))
+	check(err)
+	// every connection to :memory: gets its own database
+	db.SetMaxOpenConns(1)
+	check(migrateUp(db, 0))
+	_, err = db.Exec(seed)
+	check(err)
+	store = newSQLiteStore(db)
+	return db
+}
+
+// serves target to the user with the session sid, POSTing form unless it's nil
+func serve(handler func(http.ResponseWriter, *http.Request, *sql.DB), db *sql.DB, sid string, target string, form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", target, nil)
+	if form != nil {
+		req = httptest.NewRequest("POST", target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	req.AddCookie(&http.Cookie{Name: "session_cookie", Value: sid})
+	w := httptest.NewRecorder()
+	handler(w, req, db)
+	return w
+}
+
+func TestMigrations(t *testing.T) {
+	db := testDB(t, "")
+	defer db.Close()
+
+	migrations, err := loadMigrations()
 	check(err)
+	applied, err := appliedMigrations(db)
+	check(err)
+	if len(applied) != len(migrations) {
+		t.Fatalf("got %v migrations applied, want %v\n", len(applied), len(migrations))
+	}
+
+	// every down script has to undo its up script so the schema can be rebuilt from scratch
+	check(migrateDown(db, 0))
+	var tables int
+	check(db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name != 'schema_migrations'").Scan(&tables))
+	if tables != 0 {
+		t.Fatalf("got %v tables after migrating down, want 0\n", tables)
+	}
+	check(migrateUp(db, 0))
+	_, err = db.Exec(dbSeed)
+	check(err)
+}
+
+func TestPerm(t *testing.T) {
+	db := testDB(t, dbSeed+"INSERT INTO album_permissions (album_id, user_id) VALUES (1, 1);\n"+
+		"INSERT INTO album_permissions (album_id, user_id) VALUES (2, 2);\n"+
+		"INSERT INTO album_permissions (album_id, user_id) VALUES (3, 2);\n")
+	defer db.Close()
 
 	examples := []struct {
 		name    string
@@ -56,7 +129,10 @@ func TestPerm(t *testing.T) {
 
 	for _, ex := range examples {
 		t.Run(ex.name, func(t *testing.T) {
-			got := checkPerm(ex.albumID, ex.userID, db)
+			tx, err := db.Begin()
+			check(err)
+			defer tx.Rollback()
+			got := checkPerm(ex.albumID, ex.userID, tx)
 			if got != ex.want {
 				t.Fatalf("got %v, want %v\n", got, ex.want)
 			}
@@ -64,15 +140,124 @@ func TestPerm(t *testing.T) {
 	}
 }
 
-func TestTags(t *testing.T) {
-	db, err := sql.Open("sqlite3", ":memory:")
-	check(err)
+func TestMembership(t *testing.T) {
+	db := testDB(t, dbSeed+"INSERT INTO album_permissions (album_id, user_id, role) VALUES (2, 1, 'viewer'), (1, 2, 'contributor');\n"+
+		"INSERT INTO sessions (user_id, session_id) VALUES (1, 'user1'), (2, 'user2');\n")
 	defer db.Close()
 
-	_, err = db.Exec(dbInit + "INSERT INTO tags (photo_id, tagged_user_id) VALUES (3, 2);\n" +
-		"INSERT INTO tags (photo_id, tagged_user_id) VALUES (4, 1);\n" +
-		"INSERT INTO tags (photo_id, tagged_user_id) VALUES (4, 2);\n")
-	check(err)
+	// the albums of photos 1 and 3 and whether they're in the trash
+	state := func() string {
+		var s string
+		for _, photoID := range []int64{1, 3} {
+			var trashed bool
+			var albums []int64
+			check(inTx(db, func(tx *sql.Tx) (err error) {
+				if err := tx.QueryRow("SELECT trashed_at IS NOT NULL FROM photos WHERE id = ?", photoID).Scan(&trashed); err != nil {
+					return err
+				}
+				albums, err = queryIDs(tx, "SELECT album_id FROM album_photos WHERE photo_id = ? ORDER BY album_id", photoID)
+				return err
+			}))
+			s += fmt.Sprintf("%v:%v ", photoID, albums)
+			if trashed {
+				s += "trashed "
+			}
+		}
+		return strings.TrimSpace(s)
+	}
+
+	examples := []struct {
+		name     string
+		handler  func(http.ResponseWriter, *http.Request, *sql.DB)
+		session  string
+		target   string
+		form     url.Values
+		wantCode int
+		want     string
+	}{
+		{
+			name:     "copy to an album the user can only view",
+			handler:  copyPhotoHandler,
+			session:  "user1",
+			target:   "/photo/copy/1",
+			form:     url.Values{"to": {"2"}},
+			wantCode: http.StatusForbidden,
+			want:     "1:[1] 3:[3]",
+		},
+		{
+			name:     "copy a photo the user can't edit",
+			handler:  copyPhotoHandler,
+			session:  "user2",
+			target:   "/photo/copy/3",
+			form:     url.Values{"to": {"1"}},
+			wantCode: http.StatusForbidden,
+			want:     "1:[1] 3:[3]",
+		},
+		{
+			name:     "copy",
+			handler:  copyPhotoHandler,
+			session:  "user1",
+			target:   "/photo/copy/1",
+			form:     url.Values{"to": {"3"}},
+			wantCode: http.StatusFound,
+			want:     "1:[1 3] 3:[3]",
+		},
+		{
+			name:     "move",
+			handler:  movePhotoHandler,
+			session:  "user1",
+			target:   "/photo/move/3",
+			form:     url.Values{"from": {"3"}, "to": {"1"}},
+			wantCode: http.StatusFound,
+			want:     "1:[1 3] 3:[1]",
+		},
+		{
+			name:     "remove from one of two albums",
+			handler:  removePhotoHandler,
+			session:  "user2",
+			target:   "/photo/remove/1",
+			form:     url.Values{"album": {"1"}},
+			wantCode: http.StatusFound,
+			want:     "1:[3] 3:[1]",
+		},
+		{
+			name:     "remove from the last album",
+			handler:  removePhotoHandler,
+			session:  "user1",
+			target:   "/photo/remove/3",
+			form:     url.Values{"album": {"1"}},
+			wantCode: http.StatusFound,
+			want:     "1:[3] 3:[] trashed",
+		},
+		{
+			name:     "bad album id",
+			handler:  removePhotoHandler,
+			session:  "user1",
+			target:   "/photo/remove/1",
+			form:     url.Values{"album": {"x"}},
+			wantCode: http.StatusBadRequest,
+			want:     "1:[3] 3:[] trashed",
+		},
+	}
+
+	for _, ex := range examples {
+		t.Run(ex.name, func(t *testing.T) {
+			w := serve(ex.handler, db, ex.session, ex.target, ex.form)
+			if w.Code != ex.wantCode {
+				t.Fatalf("got %v, want %v\n%s", w.Code, ex.wantCode, w.Body)
+			}
+			if got := state(); got != ex.want {
+				t.Fatalf("got %s, want %s\n", got, ex.want)
+			}
+		})
+	}
+}
+
+func TestTags(t *testing.T) {
+	db := testDB(t, dbSeed+"INSERT INTO tags (photo_id, user_id) VALUES (3, 2);\n"+
+		"INSERT INTO tags (photo_id, user_id) VALUES (4, 1);\n"+
+		"INSERT INTO tags (photo_id, user_id) VALUES (4, 2);\n")
+	defer db.Close()
 
 	examples := []struct {
 		name       string
@@ -102,7 +287,11 @@ func TestTags(t *testing.T) {
 
 	for _, ex := range examples {
 		t.Run(ex.name, func(t *testing.T) {
-			gotPhotos, gotAlbums := showTags(ex.userID, db)
+			gotPhotos, gotAlbums, err := showTags(ex.userID, store)
+			check(err)
+			if len(gotPhotos) != len(ex.wantPhotos) || len(gotAlbums) != len(ex.wantAlbums) {
+				t.Fatalf("got photos %v and albums %v, want photos %v and albums %v\n", gotPhotos, gotAlbums, ex.wantPhotos, ex.wantAlbums)
+			}
 			for i := range gotPhotos {
 				if gotPhotos[i] != ex.wantPhotos[i] {
 					t.Fatalf("got photo %v, want photo %v\n", gotPhotos[i], ex.wantPhotos[i])
@@ -118,46 +307,1831 @@ func TestTags(t *testing.T) {
 }
 
 func TestAddPhoto(t *testing.T) {
-	db, err := sql.Open("sqlite3", ":memory:")
-	check(err)
-	defer db.Close()
-
-	_, err = db.Exec(dbInit + "INSERT INTO album_permissions (album_id, user_id) VALUES (1, 1);\n" +
-		"INSERT INTO album_permissions (album_id, user_id) VALUES (2, 2);\n" +
+	db := testDB(t, dbSeed+"INSERT INTO album_permissions (album_id, user_id) VALUES (1, 1);\n"+
+		"INSERT INTO album_permissions (album_id, user_id) VALUES (2, 2);\n"+
 		"INSERT INTO album_permissions (album_id, user_id) VALUES (3, 2);\n")
-	check(err)
+	defer db.Close()
+	t.Setenv("SILSILA_PHOTO_PATH", t.TempDir())
 
 	examples := []struct {
-		name      string
-		user      int64
-		album     int64
-		photoPath string
+		name     string
+		user     int64
+		album    int64
+		filename string
+		data     string
 	}{
 		{
-			name:      "basic add",
-			user:      1,
-			album:     1,
-			photoPath: "/Users/moose1/Documents/reference/Scrampy.jpg",
+			name:     "basic add",
+			user:     1,
+			album:    1,
+			filename: "Scrampy.jpg",
+			data:     "scrampy",
 		},
 		{
-			name:      "cross user add",
-			user:      2,
-			album:     3,
-			photoPath: "/Users/moose1/Documents/reference/Toph.png",
+			name:     "cross user add",
+			user:     2,
+			album:    3,
+			filename: "Toph.png",
+			data:     "toph",
 		},
 	}
 
 	for _, ex := range examples {
 		t.Run(ex.name, func(t *testing.T) {
-			photoId := addPhoto(ex.album, ex.user, ex.photoPath, db)
+			photoId, photoPath, err := addPhoto(ex.album, ex.user, ex.filename, strings.NewReader(ex.data), db)
+			check(err)
 
 			photoRow := db.QueryRow("SELECT user_id FROM photos WHERE id = ?", photoId)
 			var userId int64
 			if err = photoRow.Scan(&userId); err != nil {
 				t.Fatalf("ERR: %s\n", err)
 			}
+			if userId != ex.user {
+				t.Fatalf("got user %v, want user %v\n", userId, ex.user)
+			}
+			data, err := os.ReadFile(photoPath)
+			check(err)
+			if string(data) != ex.data {
+				t.Fatalf("got %q stored, want %q\n", data, ex.data)
+			}
+		})
+	}
+
+	// the photo is read before its transaction begins, so a slow upload doesn't hold up other writes
+	if _, _, err := addPhoto(1, 1, "slow.jpg", &writingReader{db: db, r: strings.NewReader("slow")}, db); err != nil {
+		t.Fatalf("failed to write while a photo was uploading: %s\n", err)
+	}
+	// and a photo that doesn't make it into the database leaves nothing behind
+	before, err := os.ReadDir(os.Getenv("SILSILA_PHOTO_PATH"))
+	check(err)
+	_, err = db.Exec("UPDATE users SET quota_bytes = 1 WHERE id = 1")
+	check(err)
+	if _, _, err := addPhoto(1, 1, "big.jpg", strings.NewReader("over quota"), db); !errors.Is(err, errQuotaExceeded) {
+		t.Fatalf("got %v adding a photo over quota\n", err)
+	}
+	after, err := os.ReadDir(os.Getenv("SILSILA_PHOTO_PATH"))
+	check(err)
+	if len(after) != len(before) {
+		t.Fatalf("got %v files after a failed upload, want %v\n", len(after), len(before))
+	}
+}
+
+// writingReader reads from r, writing to db's one connection first to check nothing is holding it
+type writingReader struct {
+	db *sql.DB
+	r  io.Reader
+}
+
+func (w *writingReader) Read(p []byte) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := w.db.ExecContext(ctx, "UPDATE users SET email = email WHERE id = 0"); err != nil {
+		return 0, fmt.Errorf("reading with the database busy: %w", err)
+	}
+	return w.r.Read(p)
+}
+
+func TestEditPhoto(t *testing.T) {
+	db := testDB(t, dbSeed+"INSERT INTO album_permissions (album_id, user_id, role) VALUES (1, 2, 'viewer'), (1, 3, 'contributor');\n"+
+		"INSERT INTO sessions (user_id, session_id) VALUES (1, 'owner'), (2, 'viewer'), (3, 'contributor');\n")
+	defer db.Close()
+
+	examples := []struct {
+		name     string
+		session  string
+		form     url.Values
+		wantCode int
+		want     photoDetails
+	}{
+		{
+			name:     "owner",
+			session:  "owner",
+			form:     url.Values{"title": {"Scrampy"}, "caption": {"asleep"}, "alt": {"a cat on a sofa"}, "album": {"1"}},
+			wantCode: http.StatusFound,
+			want:     photoDetails{Title: "Scrampy", Caption: "asleep", AltText: "a cat on a sofa"},
+		},
+		{
+			name:     "contributor",
+			session:  "contributor",
+			form:     url.Values{"title": {"Toph"}},
+			wantCode: http.StatusFound,
+			want:     photoDetails{Title: "Toph"},
+		},
+		{
+			name:     "viewer",
+			session:  "viewer",
+			form:     url.Values{"title": {"mine now"}},
+			wantCode: http.StatusForbidden,
+			want:     photoDetails{Title: "Toph"},
+		},
+		{
+			name:     "not a POST",
+			session:  "owner",
+			wantCode: http.StatusFound,
+			want:     photoDetails{Title: "Toph"},
+		},
+	}
+
+	for _, ex := range examples {
+		t.Run(ex.name, func(t *testing.T) {
+			w := serve(editPhotoHandler, db, ex.session, "/photo/edit/1", ex.form)
+			if w.Code != ex.wantCode {
+				t.Fatalf("got %v, want %v\n%s", w.Code, ex.wantCode, w.Body)
+			}
+			got, err := store.PhotoDetails(1)
+			check(err)
+			if got != ex.want {
+				t.Fatalf("got %+v, want %+v\n", got, ex.want)
+			}
+		})
+	}
+
+	// the alt text falls back to the title
+	w := serve(photoHandler, db, "viewer", "/photo/1", nil)
+	if !strings.Contains(w.Body.String(), `alt="Toph"`) {
+		t.Fatalf("photo page has no alt text from the title\n%s", w.Body)
+	}
+}
+
+func TestAlbumDetails(t *testing.T) {
+	db := testDB(t, dbSeed+"INSERT INTO album_photos (album_id, photo_id) VALUES (1, 3);\n"+
+		"INSERT INTO album_permissions (album_id, user_id, role) VALUES (1, 2, 'contributor');\n"+
+		"UPDATE photos SET captured_at = '2024-05-01 10:00:00' WHERE id = 1;\n"+
+		"UPDATE photos SET captured_at = '2024-06-30 10:00:00' WHERE id = 3;\n"+
+		"INSERT INTO sessions (user_id, session_id) VALUES (1, 'owner'), (2, 'contributor');\n")
+	defer db.Close()
+
+	examples := []struct {
+		name      string
+		handler   func(http.ResponseWriter, *http.Request, *sql.DB)
+		session   string
+		target    string
+		form      url.Values
+		wantCode  int
+		wantCover int64
+	}{
+		{
+			name:      "contributor can't edit the description",
+			handler:   editAlbumHandler,
+			session:   "contributor",
+			target:    "/album/edit/1",
+			form:      url.Values{"description": {"ours"}},
+			wantCode:  http.StatusForbidden,
+			wantCover: 1,
+		},
+		{
+			name:      "owner edits the description",
+			handler:   editAlbumHandler,
+			session:   "owner",
+			target:    "/album/edit/1",
+			form:      url.Values{"description": {"the cats"}},
+			wantCode:  http.StatusFound,
+			wantCover: 1,
+		},
+		{
+			name:      "cover from another album",
+			handler:   albumCoverHandler,
+			session:   "owner",
+			target:    "/album/cover/1",
+			form:      url.Values{"photo": {"2"}},
+			wantCode:  http.StatusBadRequest,
+			wantCover: 1,
+		},
+		{
+			name:      "contributor can't choose the cover",
+			handler:   albumCoverHandler,
+			session:   "contributor",
+			target:    "/album/cover/1",
+			form:      url.Values{"photo": {"3"}},
+			wantCode:  http.StatusForbidden,
+			wantCover: 1,
+		},
+		{
+			name:      "owner chooses the cover",
+			handler:   albumCoverHandler,
+			session:   "owner",
+			target:    "/album/cover/1",
+			form:      url.Values{"photo": {"3"}},
+			wantCode:  http.StatusFound,
+			wantCover: 3,
+		},
+	}
+
+	for _, ex := range examples {
+		t.Run(ex.name, func(t *testing.T) {
+			w := serve(ex.handler, db, ex.session, ex.target, ex.form)
+			if w.Code != ex.wantCode {
+				t.Fatalf("got %v, want %v\n%s", w.Code, ex.wantCode, w.Body)
+			}
+			var cover int64
+			check(db.QueryRow("SELECT " + albumCoverSQL + " FROM albums WHERE id = 1").Scan(&cover))
+			if cover != ex.wantCover {
+				t.Fatalf("got cover %v, want %v\n", cover, ex.wantCover)
+			}
+		})
+	}
+
+	w := serve(albumHandler, db, "owner", "/album/1", nil)
+	for _, want := range []string{"the cats", "May 1, 2024 – Jun 30, 2024"} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("album page doesn't show %q\n%s", want, w.Body)
+		}
+	}
+	// a cover that's gone to the trash falls back to the album's first photo
+	_, err := db.Exec("UPDATE photos SET trashed_at = CURRENT_TIMESTAMP WHERE id = 3")
+	check(err)
+	var cover int64
+	check(db.QueryRow("SELECT " + albumCoverSQL + " FROM albums WHERE id = 1").Scan(&cover))
+	if cover != 1 {
+		t.Fatalf("got cover %v after trashing the chosen one, want 1\n", cover)
+	}
+}
+
+func TestAlbumOrder(t *testing.T) {
+	db := testDB(t, dbSeed+"INSERT INTO album_photos (album_id, photo_id) VALUES (1, 3), (1, 2);\n"+
+		"INSERT INTO album_permissions (album_id, user_id, role) VALUES (1, 2, 'contributor'), (1, 3, 'viewer');\n"+
+		"UPDATE photos SET filename = 'c.jpg' WHERE id = 1;\n"+
+		"UPDATE photos SET filename = 'B.jpg' WHERE id = 2;\n"+
+		"UPDATE photos SET filename = 'a.jpg' WHERE id = 3;\n"+
+		"INSERT INTO sessions (user_id, session_id) VALUES (1, 'owner'), (2, 'contributor'), (3, 'viewer');\n")
+	defer db.Close()
+
+	// the album's name, sort mode and photos in the order they're shown
+	state := func() string {
+		var name, mode string
+		var ids []int64
+		check(inTx(db, func(tx *sql.Tx) (err error) {
+			if err := tx.QueryRow("SELECT name, sort_mode FROM albums WHERE id = 1").Scan(&name, &mode); err != nil {
+				return err
+			}
+			ids, err = queryIDs(tx, "SELECT id FROM photos JOIN album_photos ON photos.id = album_photos.photo_id "+
+				"WHERE album_id = 1 ORDER BY "+sortModes[mode])
+			return err
+		}))
+		return fmt.Sprintf("%s|%s|%v", name, mode, ids)
+	}
+
+	examples := []struct {
+		name     string
+		handler  func(http.ResponseWriter, *http.Request, *sql.DB)
+		session  string
+		target   string
+		form     url.Values
+		wantCode int
+		want     string
+	}{
+		{
+			name:     "contributor can't rename",
+			handler:  renameAlbumHandler,
+			session:  "contributor",
+			target:   "/album/rename/1",
+			form:     url.Values{"name": {"ours"}},
+			wantCode: http.StatusForbidden,
+			want:     "1 main|upload|[1 2 3]",
+		},
+		{
+			name:     "owner renames",
+			handler:  renameAlbumHandler,
+			session:  "owner",
+			target:   "/album/rename/1",
+			form:     url.Values{"name": {"cats"}},
+			wantCode: http.StatusFound,
+			want:     "cats|upload|[1 2 3]",
+		},
+		{
+			name:     "empty name",
+			handler:  renameAlbumHandler,
+			session:  "owner",
+			target:   "/album/rename/1",
+			form:     url.Values{"name": {""}},
+			wantCode: http.StatusFound,
+			want:     "cats|upload|[1 2 3]",
+		},
+		{
+			name:     "unknown sort mode",
+			handler:  sortAlbumHandler,
+			session:  "owner",
+			target:   "/album/sort/1",
+			form:     url.Values{"sort": {"random"}},
+			wantCode: http.StatusBadRequest,
+			want:     "cats|upload|[1 2 3]",
+		},
+		{
+			name:     "viewer can't sort",
+			handler:  sortAlbumHandler,
+			session:  "viewer",
+			target:   "/album/sort/1",
+			form:     url.Values{"sort": {"filename"}},
+			wantCode: http.StatusForbidden,
+			want:     "cats|upload|[1 2 3]",
+		},
+		{
+			name:     "contributor sorts by filename",
+			handler:  sortAlbumHandler,
+			session:  "contributor",
+			target:   "/album/sort/1",
+			form:     url.Values{"sort": {"filename"}},
+			wantCode: http.StatusFound,
+			want:     "cats|filename|[3 2 1]",
+		},
+		{
+			name:     "viewer can't reorder",
+			handler:  reorderAlbumHandler,
+			session:  "viewer",
+			target:   "/album/reorder/1",
+			form:     url.Values{"order": {"2,1,3"}},
+			wantCode: http.StatusForbidden,
+			want:     "cats|filename|[3 2 1]",
+		},
+		{
+			name:     "bad order",
+			handler:  reorderAlbumHandler,
+			session:  "owner",
+			target:   "/album/reorder/1",
+			form:     url.Values{"order": {"2,x"}},
+			wantCode: http.StatusBadRequest,
+			want:     "cats|filename|[3 2 1]",
+		},
+		{
+			name:     "reorder leaving a photo out",
+			handler:  reorderAlbumHandler,
+			session:  "owner",
+			target:   "/album/reorder/1",
+			form:     url.Values{"order": {"2,3"}},
+			wantCode: http.StatusFound,
+			want:     "cats|manual|[2 3 1]",
+		},
+	}
+
+	for _, ex := range examples {
+		t.Run(ex.name, func(t *testing.T) {
+			w := serve(ex.handler, db, ex.session, ex.target, ex.form)
+			if w.Code != ex.wantCode {
+				t.Fatalf("got %v, want %v\n%s", w.Code, ex.wantCode, w.Body)
+			}
+			if got := state(); got != ex.want {
+				t.Fatalf("got %s, want %s\n", got, ex.want)
+			}
+		})
+	}
+}
+
+func TestTrash(t *testing.T) {
+	db := testDB(t, dbSeed+"INSERT INTO sessions (user_id, session_id) VALUES (1, 'user1'), (2, 'user2');\n"+
+		"INSERT INTO album_permissions (album_id, user_id, role) VALUES (3, 2, 'viewer'), (1, 2, 'contributor');\n"+
+		"INSERT INTO photos (user_id) VALUES (2);\n"+
+		"INSERT INTO album_photos (album_id, photo_id) VALUES (1, 5);\n")
+	defer db.Close()
+
+	// only people who can edit an album are offered to move its photos to the trash
+	for session, want := range map[string]bool{"user1": true, "user2": false} {
+		if w := serve(albumHandler, db, session, "/album/3", nil); strings.Contains(w.Body.String(), "move to trash") != want {
+			t.Fatalf("%s offered to move photos to the trash: %v\n", session, !want)
+		}
+	}
+
+	// where a photo is and whether it's in the trash, or "gone"
+	state := func(photoID int64) string {
+		var trashed bool
+		var albums []int64
+		err := inTx(db, func(tx *sql.Tx) (err error) {
+			if err := tx.QueryRow("SELECT trashed_at IS NOT NULL FROM photos WHERE id = ?", photoID).Scan(&trashed); err != nil {
+				return err
+			}
+			albums, err = queryIDs(tx, "SELECT album_id FROM album_photos WHERE photo_id = ? ORDER BY album_id", photoID)
+			return err
+		})
+		if err == sql.ErrNoRows {
+			return "gone"
+		}
+		check(err)
+		if trashed {
+			return fmt.Sprintf("%v trashed", albums)
+		}
+		return fmt.Sprint(albums)
+	}
+
+	check(inTx(db, func(tx *sql.Tx) error { return trashPhoto(1, tx) }))
+	if w := serve(restoreHandler, db, "user2", "/trash/restore/photo/1", url.Values{}); w.Code != http.StatusNotFound {
+		t.Fatalf("got %v restoring someone else's photo\n", w.Code)
+	}
+	if w := serve(restoreHandler, db, "user1", "/trash/restore/photo/1", url.Values{}); w.Code != http.StatusFound || state(1) != "[1]" {
+		t.Fatalf("got %v and photo 1 in %s after restoring it\n", w.Code, state(1))
+	}
+
+	// with both of user 1's albums in the trash, a restored photo gets a new album
+	check(inTx(db, func(tx *sql.Tx) error {
+		if err := trashAlbum(1, tx); err != nil {
+			return err
+		}
+		if err := trashAlbum(3, tx); err != nil {
+			return err
+		}
+		return trashPhoto(3, tx)
+	}))
+	// photo 1 went to the trash with album 1, so it's not on user 1's page anymore
+	if body := serve(viewHandler, db, "user1", "/view/1", nil).Body.String(); strings.Contains(body, "/photos/1\"") {
+		t.Fatalf("photo 1 is still on user 1's page after its album was trashed:\n%s", body)
+	}
+	if w := serve(restoreHandler, db, "user1", "/trash/restore/photo/3", url.Values{}); w.Code != http.StatusFound {
+		t.Fatalf("got %v restoring a photo without an album\n%s", w.Code, w.Body)
+	}
+	var restoredID int64
+	check(db.QueryRow("SELECT id FROM albums WHERE user_id = 1 AND name = ? AND trashed_at IS NULL", restoredAlbumName).Scan(&restoredID))
+	if got := state(3); got != fmt.Sprintf("[3 %v]", restoredID) {
+		t.Fatalf("got photo 3 in %s after restoring it without an album\n", got)
+	}
+
+	// emptying the trash purges user 1's albums and the photos of theirs only they held. User 2's photo in album 1
+	// goes to user 2's trash instead
+	check(inTx(db, func(tx *sql.Tx) error { return trashPhoto(2, tx) }))
+	if w := serve(emptyTrashHandler, db, "user1", "/trash/empty", url.Values{}); w.Code != http.StatusFound {
+		t.Fatalf("got %v emptying the trash\n", w.Code)
+	}
+	var albums int
+	check(db.QueryRow("SELECT count(*) FROM albums WHERE user_id = 1").Scan(&albums))
+	if albums != 1 || state(1) != "gone" || state(3) != fmt.Sprintf("[%v]", restoredID) || state(2) != "[2] trashed" || state(5) != "[] trashed" {
+		t.Fatalf("after emptying the trash got %v albums, photos 1: %s, 2: %s, 3: %s, 5: %s\n", albums, state(1), state(2), state(3), state(5))
+	}
+
+	// the purger only takes what's been in the trash for longer than the retention period
+	old := time.Now().UTC().Add(-48 * time.Hour).Format(timeLayout)
+	_, err := db.Exec("UPDATE photos SET trashed_at = ? WHERE id = 2", old)
+	check(err)
+	check(inTx(db, func(tx *sql.Tx) error { return trashPhoto(4, tx) }))
+	startPurger(db, 24*time.Hour, time.Hour)
+	for deadline := time.Now().Add(5 * time.Second); state(2) != "gone"; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("purger left photo 2 in the trash\n")
+		}
+	}
+	if got := state(4); got != "[4] trashed" {
+		t.Fatalf("got photo 4 %s after the purger ran\n", got)
+	}
+}
+
+func TestParseIDList(t *testing.T) {
+	examples := []struct {
+		name    string
+		input   string
+		want    []int64
+		wantErr bool
+	}{
+		{
+			name:  "empty",
+			input: "",
+			want:  []int64{},
+		},
+		{
+			name:  "ordered",
+			input: "3,1,2",
+			want:  []int64{3, 1, 2},
+		},
+		{
+			name:  "spaces and trailing comma",
+			input: " 4, 5 ,",
+			want:  []int64{4, 5},
+		},
+		{
+			name:    "not a number",
+			input:   "1,a",
+			wantErr: true,
+		},
+	}
+
+	for _, ex := range examples {
+		t.Run(ex.name, func(t *testing.T) {
+			got, err := parseIDList(ex.input)
+			if (err != nil) != ex.wantErr {
+				t.Fatalf("got error %v, want error %v\n", err, ex.wantErr)
+			}
+			if len(got) != len(ex.want) {
+				t.Fatalf("got %v, want %v\n", got, ex.want)
+			}
+			for i := range got {
+				if got[i] != ex.want[i] {
+					t.Fatalf("got %v, want %v\n", got, ex.want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseBytes(t *testing.T) {
+	examples := []struct {
+		name    string
+		input   string
+		want    int64
+		wantErr bool
+	}{
+		{
+			name:  "plain bytes",
+			input: "1024",
+			want:  1024,
+		},
+		{
+			name:  "megabytes",
+			input: "500MB",
+			want:  500 << 20,
+		},
+		{
+			name:  "fraction with space and lowercase",
+			input: "1.5 gb",
+			want:  3 << 29,
+		},
+		{
+			name:    "not a size",
+			input:   "lots",
+			wantErr: true,
+		},
+	}
 
-			err = os.Remove("/Users/moose1/Documents/photoApp/Photos/" + strconv.FormatInt(photoId, 10))
+	for _, ex := range examples {
+		t.Run(ex.name, func(t *testing.T) {
+			got, err := parseBytes(ex.input)
+			if (err != nil) != ex.wantErr {
+				t.Fatalf("got error %v, want error %v\n", err, ex.wantErr)
+			}
+			if got != ex.want {
+				t.Fatalf("got %v, want %v\n", got, ex.want)
+			}
 		})
 	}
 }
+
+// errReader returns some data and then fails, like a client disconnecting mid upload
+type errReader struct{ sent bool }
+
+func (e *errReader) Read(p []byte) (int, error) {
+	if e.sent {
+		return 0, errors.New("connection reset")
+	}
+	e.sent = true
+	return copy(p, "partial"), nil
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+
+	examples := []struct {
+		name     string
+		src      io.Reader
+		wantErr  bool
+		wantData string
+	}{
+		{
+			name:     "complete",
+			src:      strings.NewReader("photo data"),
+			wantData: "photo data",
+		},
+		{
+			name:    "failed copy",
+			src:     &errReader{},
+			wantErr: true,
+		},
+	}
+
+	for _, ex := range examples {
+		t.Run(ex.name, func(t *testing.T) {
+			dst := filepath.Join(dir, ex.name)
+			_, err := writeFileAtomic(dst, ex.src)
+			if (err != nil) != ex.wantErr {
+				t.Fatalf("got error %v, want error %v\n", err, ex.wantErr)
+			}
+			data, err := os.ReadFile(dst)
+			if ex.wantErr {
+				if !os.IsNotExist(err) {
+					t.Fatalf("got file %q after failed write, want no file\n", data)
+				}
+			} else if string(data) != ex.wantData {
+				t.Fatalf("got %q, want %q\n", data, ex.wantData)
+			}
+		})
+	}
+
+	leftovers, err := filepath.Glob(filepath.Join(dir, ".upload-*"))
+	if err != nil {
+		t.Fatalf("ERR: %s\n", err)
+	}
+	if len(leftovers) > 0 {
+		t.Fatalf("temporary files left behind: %v\n", leftovers)
+	}
+}
+
+func TestEncryptedBlob(t *testing.T) {
+	encoded, err := generateMasterKey()
+	check(err)
+	encryptionKey, err = parseMasterKey(encoded)
+	check(err)
+	defer func() { encryptionKey = nil }()
+	dir := t.TempDir()
+
+	examples := []struct {
+		name     string
+		size     int
+		truncate int64
+		wantErr  bool
+	}{
+		{
+			name: "empty",
+			size: 0,
+		},
+		{
+			name: "small",
+			size: 100,
+		},
+		{
+			name: "exactly one chunk",
+			size: blobChunkSize,
+		},
+		{
+			name: "several chunks",
+			size: 2*blobChunkSize + 5,
+		},
+		{
+			name:     "last chunk cut off",
+			size:     2*blobChunkSize + 5,
+			truncate: 5 + blobOverhead,
+			wantErr:  true,
+		},
+	}
+
+	for _, ex := range examples {
+		t.Run(ex.name, func(t *testing.T) {
+			data := make([]byte, ex.size)
+			for i := range data {
+				data[i] = byte(i * 7)
+			}
+			sealed, key, err := sealBlob(bytes.NewReader(data))
+			check(err)
+			p := filepath.Join(dir, ex.name)
+			n, err := writeFileAtomic(p, sealed)
+			check(err)
+			if got := plainSize(n); got != int64(ex.size) {
+				t.Fatalf("got plain size %v, want %v\n", got, ex.size)
+			}
+			if ex.truncate > 0 {
+				check(os.Truncate(p, n-ex.truncate))
+			}
+
+			f, err := openBlob(p, key)
+			if (err != nil) != ex.wantErr {
+				t.Fatalf("got error %v, want error %v\n", err, ex.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer f.Close()
+			got, err := io.ReadAll(f)
+			check(err)
+			if !bytes.Equal(got, data) {
+				t.Fatalf("decrypted photo doesn't match the original\n")
+			}
+			if ex.size > 10 {
+				_, err = f.Seek(int64(ex.size-10), io.SeekStart)
+				check(err)
+				got, err = io.ReadAll(f)
+				check(err)
+				if !bytes.Equal(got, data[ex.size-10:]) {
+					t.Fatalf("got %v after seeking, want %v\n", got, data[ex.size-10:])
+				}
+			}
+		})
+	}
+}
+
+func TestForeignKeys(t *testing.T) {
+	db := testDB(t, dbSeed+
+		"UPDATE photos SET path = '/photos/' || id;\n"+
+		"UPDATE albums SET cover_photo_id = 2 WHERE id = 1;\n"+
+		"INSERT INTO album_photos (album_id, photo_id) VALUES (1, 2);\n"+
+		"INSERT INTO tags (photo_id, user_id) VALUES (1, 2), (2, 3);\n"+
+		"INSERT INTO album_permissions (album_id, user_id) VALUES (1, 2);\n"+
+		"INSERT INTO sessions (user_id, session_id) VALUES (2, 'abc');")
+	defer db.Close()
+
+	count := func(query string) int {
+		var n int
+		check(db.QueryRow(query).Scan(&n))
+		return n
+	}
+	if _, err := db.Exec("INSERT INTO tags (photo_id, user_id) VALUES (99, 1)"); err == nil {
+		t.Fatalf("tagged a photo that doesn't exist\n")
+	}
+
+	_, err := db.Exec("DELETE FROM users WHERE id = 2")
+	check(err)
+	for query, want := range map[string]int{
+		"SELECT count(*) FROM albums WHERE user_id = 2":                 0,
+		"SELECT count(*) FROM photos WHERE user_id = 2":                 0,
+		"SELECT count(*) FROM album_photos WHERE photo_id = 2":          0,
+		"SELECT count(*) FROM tags":                                     0,
+		"SELECT count(*) FROM album_permissions":                        0,
+		"SELECT count(*) FROM sessions":                                 0,
+		"SELECT count(*) FROM albums WHERE cover_photo_id IS NOT NULL":  0,
+		"SELECT count(*) FROM file_cleanup WHERE path = '/photos/2'":    1,
+		"SELECT count(*) FROM album_photos WHERE album_id IN (1, 3, 4)": 3,
+	} {
+		if got := count(query); got != want {
+			t.Fatalf("%s: got %v, want %v\n", query, got, want)
+		}
+	}
+}
+
+func TestOpenSQLite(t *testing.T) {
+	needFTS5(t)
+	read, write, err := openSQLite(filepath.Join(t.TempDir(), "db"))
+	check(err)
+	defer read.Close()
+	defer write.Close()
+	check(migrateUp(write, 0))
+
+	var mode string
+	check(read.QueryRow("PRAGMA journal_mode").Scan(&mode))
+	if mode != "wal" {
+		t.Fatalf("got journal mode %q, want wal\n", mode)
+	}
+	if _, err := read.Exec("INSERT INTO users (email) VALUES ('a@example.com')"); err == nil {
+		t.Fatalf("wrote through the read pool\n")
+	}
+	// a reader in the middle of a transaction doesn't hold up the writer
+	tx, err := read.Begin()
+	check(err)
+	defer tx.Rollback()
+	var n int
+	check(tx.QueryRow("SELECT count(*) FROM users").Scan(&n))
+	if _, err := write.Exec("INSERT INTO users (email) VALUES ('a@example.com')"); err != nil {
+		t.Fatalf("failed to write while reading: %s\n", err)
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	needFTS5(t)
+	t.Setenv("SILSILA_PHOTO_PATH", t.TempDir())
+	dir := t.TempDir()
+	read, db, err := openSQLite(filepath.Join(t.TempDir(), "db"))
+	check(err)
+	defer read.Close()
+	defer db.Close()
+	check(migrateUp(db, 0))
+	_, err = db.Exec(dbSeed)
+	check(err)
+	store = newSQLiteStore(db)
+
+	first, firstPath, err := addPhoto(1, 1, "a.jpg", strings.NewReader("first photo"), db)
+	check(err)
+	report, err := backup(read, dir)
+	check(err)
+	if report.Files != 1 || report.Copied != 1 {
+		t.Fatalf("first backup: got %s\n", report)
+	}
+	_, _, err = addPhoto(1, 1, "b.jpg", strings.NewReader("second photo"), db)
+	check(err)
+	report, err = backup(read, dir)
+	check(err)
+	if report.Files != 2 || report.Copied != 1 {
+		t.Fatalf("second backup only has to copy the new photo, got %s\n", report)
+	}
+	taken := report.Snapshot
+
+	// lose the first photo and its file
+	tx, err := db.Begin()
+	check(err)
+	check(purgePhoto(first, tx))
+	check(tx.Commit())
+	check(drainCleanup(db))
+	if _, err := os.Stat(firstPath); !os.IsNotExist(err) {
+		t.Fatalf("photo file wasn't removed: %v\n", err)
+	}
+
+	check(restore(db, dir, taken))
+	var n int
+	check(read.QueryRow("SELECT count(*) FROM photos WHERE id = ?", first).Scan(&n))
+	if n != 1 {
+		t.Fatalf("restored database doesn't have photo %v\n", first)
+	}
+	if b, err := os.ReadFile(firstPath); err != nil || string(b) != "first photo" {
+		t.Fatalf("restored file holds %q, %v\n", b, err)
+	}
+
+	names, err := listSnapshots(dir)
+	check(err)
+	removed, err := pruneBackups(dir, 1)
+	check(err)
+	if removed != len(names)-1 {
+		t.Fatalf("pruned %v of %v snapshots\n", removed, len(names))
+	}
+	blobs, err := os.ReadDir(filepath.Join(dir, backupBlobs))
+	check(err)
+	if len(blobs) != 2 {
+		t.Fatalf("got %v blobs after pruning, want 2\n", len(blobs))
+	}
+
+	// a snapshot that's been tampered with isn't restored
+	check(os.WriteFile(filepath.Join(dir, backupBlobs, blobs[0].Name()), []byte("bit rot"), 0600))
+	if _, err := validateSnapshot(dir, names[len(names)-1]); err == nil {
+		t.Fatalf("validated a snapshot with a corrupt blob\n")
+	}
+
+	// pruning waits for a backup that's going on instead of removing its snapshot
+	unlock, err := lockBackupDir(dir)
+	check(err)
+	partial := filepath.Join(dir, ".20990101T000000.000Z.partial")
+	check(os.Mkdir(partial, 0700))
+	pruned := make(chan error)
+	go func() {
+		_, err := pruneBackups(dir, 1)
+		pruned <- err
+	}()
+	select {
+	case err := <-pruned:
+		t.Fatalf("pruned while a backup held the lock: %v\n", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, err := os.Stat(partial); err != nil {
+		t.Fatalf("removed the snapshot of a backup that's going on: %s\n", err)
+	}
+	unlock()
+	check(<-pruned)
+
+	// backups copy encrypted photos as they are, so they run without the master key
+	encoded, err := generateMasterKey()
+	check(err)
+	encryptionKey, err = parseMasterKey(encoded)
+	check(err)
+	_, _, err = addPhoto(1, 1, "c.jpg", strings.NewReader("sealed photo"), db)
+	encryptionKey = nil
+	check(err)
+	report, err = backup(read, dir)
+	if err != nil || report.Copied == 0 || report.Skipped != 0 {
+		t.Fatalf("backing up an encrypted photo without its key: got %+v, %v\n", report, err)
+	}
+}
+
+func TestExport(t *testing.T) {
+	t.Setenv("SILSILA_PHOTO_PATH", t.TempDir())
+	db := testDB(t, dbSeed)
+	defer db.Close()
+
+	photoID, _, err := addPhoto(1, 1, "beach/day.jpg", strings.NewReader("a day at the beach"), db)
+	check(err)
+	_, err = db.Exec("UPDATE photos SET caption = 'sunny' WHERE id = ?; INSERT INTO tags (photo_id, user_id) VALUES (?, 2)", photoID, photoID)
+	check(err)
+	tx, err := db.Begin()
+	check(err)
+	check(requestExport(1, tx))
+	check(requestExport(1, tx))
+	check(tx.Commit())
+	check(runExports(db))
+
+	var archive, state string
+	check(db.QueryRow("SELECT COALESCE(path, ''), state FROM exports WHERE user_id = 1").Scan(&archive, &state))
+	if state != "done" {
+		t.Fatalf("export is %s\n", state)
+	}
+	zr, err := zip.OpenReader(archive)
+	check(err)
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+	name := fmt.Sprintf("photos/%v-day.jpg", photoID)
+	for _, want := range []string{"account.json", name, name + ".json"} {
+		if files[want] == nil {
+			t.Fatalf("export doesn't have %s\n", want)
+		}
+	}
+	read := func(name string) []byte {
+		f, err := files[name].Open()
+		check(err)
+		defer f.Close()
+		b, err := io.ReadAll(f)
+		check(err)
+		return b
+	}
+	if string(read(name)) != "a day at the beach" {
+		t.Fatalf("exported photo holds %q\n", read(name))
+	}
+	var sidecar exportPhoto
+	check(json.Unmarshal(read(name+".json"), &sidecar))
+	if sidecar.Caption != "sunny" || len(sidecar.Tags) != 1 || sidecar.Tags[0] != "user2@example.com" ||
+		len(sidecar.Albums) != 1 || sidecar.Albums[0].ID != 1 || sidecar.File != name {
+		t.Fatalf("got sidecar %+v\n", sidecar)
+	}
+	zr.Close()
+
+	_, err = db.Exec("UPDATE exports SET expires_at = '2000-01-01 00:00:00'")
+	check(err)
+	check(runExports(db))
+	check(db.QueryRow("SELECT state FROM exports WHERE user_id = 1").Scan(&state))
+	if _, err := os.Stat(archive); state != "expired" || !os.IsNotExist(err) {
+		t.Fatalf("expired export is %s and its archive %v\n", state, err)
+	}
+}
+
+func TestFindSidecar(t *testing.T) {
+	f := importFolder{json: map[string]bool{"metadata.json": true, "a.jpg.json": true, "b.jpg(1).json": true,
+		"c.jpg.supplemental-metadata.json": true, "IMG_20190101_123456789_HDR.jpg.supplemental-met.json": true}}
+	for photo, want := range map[string]string{
+		"a.jpg":                          "a.jpg.json",
+		"a-edited.jpg":                   "a.jpg.json",
+		"b(1).jpg":                       "b.jpg(1).json",
+		"c.jpg":                          "c.jpg.supplemental-metadata.json",
+		"IMG_20190101_123456789_HDR.jpg": "IMG_20190101_123456789_HDR.jpg.supplemental-met.json",
+		"d.jpg":                          "",
+	} {
+		if got := findSidecar(f, photo); got != want {
+			t.Fatalf("sidecar of %s: got %q, want %q\n", photo, got, want)
+		}
+	}
+}
+
+func TestImportTakeout(t *testing.T) {
+	t.Setenv("SILSILA_PHOTO_PATH", t.TempDir())
+	db := testDB(t, dbSeed)
+	defer db.Close()
+
+	export := map[string]string{
+		"Google Photos/Trip/metadata.json":             `{"title": "Trip 2019", "description": "summer"}`,
+		"Google Photos/Trip/a.jpg":                     "photo a",
+		"Google Photos/Trip/a.jpg.json":                `{"title": "a.jpg", "description": "beach", "photoTakenTime": {"timestamp": "1560000000"}, "geoData": {"latitude": 1.5, "longitude": 2.5}}`,
+		"Google Photos/Photos from 2019/a.jpg":         "photo a",
+		"Google Photos/Photos from 2019/a.jpg.json":    `{"title": "a.jpg"}`,
+		"Google Photos/Photos from 2019/b(1).jpg":      "photo b",
+		"Google Photos/Photos from 2019/b.jpg(1).json": `{"title": "b.jpg", "description": "second b", "geoData": {"latitude": 0, "longitude": 0}}`,
+	}
+	dir := t.TempDir()
+	var zipped bytes.Buffer
+	zw := zip.NewWriter(&zipped)
+	for name, content := range export {
+		check(os.MkdirAll(filepath.Join(dir, filepath.Dir(name)), 0700))
+		check(os.WriteFile(filepath.Join(dir, name), []byte(content), 0600))
+		w, err := zw.Create(name)
+		check(err)
+		_, err = w.Write([]byte(content))
+		check(err)
+	}
+	check(zw.Close())
+
+	report, err := importTakeout(db, 1, os.DirFS(dir), "Google Photos")
+	check(err)
+	if report != (importReport{Imported: 2, Duplicates: 1, Albums: 2}) {
+		t.Fatalf("got %s\n", report)
+	}
+	var caption, captured, album string
+	var lat, long sql.NullFloat64
+	check(db.QueryRow("SELECT caption, captured_at, latitude, longitude, albums.name FROM photos "+
+		"JOIN album_photos ON photos.id = album_photos.photo_id JOIN albums ON albums.id = album_photos.album_id "+
+		"WHERE filename = 'a.jpg'").Scan(&caption, &captured, &lat, &long, &album))
+	if caption != "beach" || captured != "2019-06-08 13:20:00" || lat.Float64 != 1.5 || long.Float64 != 2.5 || album != "Trip 2019" {
+		t.Fatalf("got a.jpg with caption %q, captured %s at %v, %v in album %q\n", caption, captured, lat, long, album)
+	}
+	check(db.QueryRow("SELECT caption, latitude, albums.name FROM photos "+
+		"JOIN album_photos ON photos.id = album_photos.photo_id JOIN albums ON albums.id = album_photos.album_id "+
+		"WHERE filename = 'b.jpg'").Scan(&caption, &lat, &album))
+	if caption != "second b" || lat.Valid || album != "Google Photos" {
+		t.Fatalf("got b.jpg with caption %q at %v in album %q\n", caption, lat, album)
+	}
+
+	// importing again finds everything there already
+	report, err = importTakeout(db, 1, os.DirFS(dir), "Google Photos")
+	check(err)
+	if report != (importReport{Duplicates: 3}) {
+		t.Fatalf("importing again: got %s\n", report)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(zipped.Bytes()), int64(zipped.Len()))
+	check(err)
+	report, err = importTakeout(db, 2, zr, "Google Photos")
+	check(err)
+	if report.Imported != 2 {
+		t.Fatalf("importing a zip: got %s\n", report)
+	}
+
+	// a photo whose sidecar can't be saved isn't imported either, so the next import brings both in
+	dir = t.TempDir()
+	check(os.WriteFile(filepath.Join(dir, "c.jpg"), []byte("photo c"), 0600))
+	check(os.WriteFile(filepath.Join(dir, "c.jpg.json"), []byte(`{"title": "c.jpg", "description": "lake"}`), 0600))
+	_, err = db.Exec("CREATE TRIGGER no_captions BEFORE UPDATE OF caption ON photos BEGIN SELECT RAISE(ABORT, 'no captions'); END")
+	check(err)
+	if report, err = importTakeout(db, 3, os.DirFS(dir), "Google Photos"); err != nil || report.Failed != 1 {
+		t.Fatalf("importing with the sidecar failing: got %s, %v\n", report, err)
+	}
+	_, err = db.Exec("DROP TRIGGER no_captions")
+	check(err)
+	if report, err = importTakeout(db, 3, os.DirFS(dir), "Google Photos"); err != nil || report.Imported != 1 {
+		t.Fatalf("importing after the sidecar failed: got %s, %v\n", report, err)
+	}
+	check(db.QueryRow("SELECT caption FROM photos WHERE user_id = 3 AND filename = 'c.jpg'").Scan(&caption))
+	if caption != "lake" {
+		t.Fatalf("got c.jpg with caption %q\n", caption)
+	}
+}
+
+func TestWatchFolder(t *testing.T) {
+	t.Setenv("SILSILA_PHOTO_PATH", t.TempDir())
+	db := testDB(t, dbSeed)
+	defer db.Close()
+
+	dir := t.TempDir()
+	check(inTx(db, func(tx *sql.Tx) error { return addWatchFolder(1, 0, dir, tx) }))
+	check(os.WriteFile(filepath.Join(dir, "scan.jpg"), []byte("scanned photo"), 0600))
+	check(os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("not a photo"), 0600))
+	check(os.WriteFile(filepath.Join(dir, "copying.jpg"), []byte("half a pho"), 0600))
+	past := time.Now().Add(-time.Minute)
+	for _, name := range []string{"scan.jpg", "notes.txt", "copying.jpg"} {
+		check(os.Chtimes(filepath.Join(dir, name), past, past))
+	}
+
+	w := newWatcher()
+	check(w.scan(db))
+	if _, err := os.Stat(filepath.Join(dir, "scan.jpg")); err != nil {
+		t.Fatalf("imported on the first look: %s\n", err)
+	}
+
+	// copying.jpg is still being written to between looks
+	check(os.WriteFile(filepath.Join(dir, "copying.jpg"), []byte("half a photo"), 0600))
+	check(w.scan(db))
+	if _, err := os.Stat(filepath.Join(dir, "processed", "scan.jpg")); err != nil {
+		t.Fatalf("scan.jpg wasn't moved to processed: %s\n", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "failed", "notes.txt.error")); err != nil {
+		t.Fatalf("notes.txt wasn't moved to failed: %s\n", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "copying.jpg")); err != nil {
+		t.Fatalf("copying.jpg was imported while it was being written: %s\n", err)
+	}
+	var n int
+	check(db.QueryRow("SELECT COUNT(*) FROM photos WHERE filename = 'scan.jpg' AND user_id = 1").Scan(&n))
+	if n != 1 {
+		t.Fatalf("got %v photos called scan.jpg\n", n)
+	}
+
+	// photos don't go into an album the user lost access to, or anywhere if the user has no album
+	revoked, empty := t.TempDir(), t.TempDir()
+	check(inTx(db, func(tx *sql.Tx) error {
+		if err := givePerm(1, 3, tx); err != nil {
+			return err
+		}
+		if err := addWatchFolder(3, 1, revoked, tx); err != nil {
+			return err
+		}
+		if err := revokePerm(1, 3, tx); err != nil {
+			return err
+		}
+		userID, err := store.WithTx(tx).CreateUser("empty@example.com", "")
+		if err != nil {
+			return err
+		}
+		return addWatchFolder(userID, 0, empty, tx)
+	}))
+	for _, d := range []string{revoked, empty} {
+		check(os.WriteFile(filepath.Join(d, "scan.jpg"), []byte("another scan"), 0600))
+		check(os.Chtimes(filepath.Join(d, "scan.jpg"), past, past))
+	}
+	check(w.scan(db))
+	check(w.scan(db))
+	for _, d := range []string{revoked, empty} {
+		if _, err := os.Stat(filepath.Join(d, "failed", "scan.jpg.error")); err != nil {
+			t.Fatalf("scan.jpg wasn't moved to failed: %s\n", err)
+		}
+	}
+	check(db.QueryRow("SELECT COUNT(*) FROM photos WHERE filename = 'scan.jpg'").Scan(&n))
+	if n != 1 {
+		t.Fatalf("got %v photos called scan.jpg after importing without access\n", n)
+	}
+}
+
+func TestCreateAlbum(t *testing.T) {
+	db := testDB(t, dbSeed+"INSERT INTO sessions (user_id, session_id) VALUES (1, 'user1');\n")
+	defer db.Close()
+
+	// albums made from the home page go through newAlbum like the admin commands, so their owner gets permission
+	w := serve(homeHandler, db, "user1", "/home/1?"+url.Values{"album name": {"Trips"}}.Encode(), nil)
+	if w.Code != http.StatusFound {
+		t.Fatalf("got %v creating an album\n%s", w.Code, w.Body)
+	}
+	var albumID int64
+	check(db.QueryRow("SELECT id FROM albums WHERE user_id = 1 AND name = 'Trips'").Scan(&albumID))
+	check(inTx(db, func(tx *sql.Tx) error {
+		if !checkPerm(albumID, 1, tx) {
+			t.Fatalf("owner has no permission on the album they created\n")
+		}
+		return nil
+	}))
+}
+
+func TestAdmin(t *testing.T) {
+	db := testDB(t, dbSeed+"INSERT INTO album_permissions (album_id, user_id) VALUES (1, 1);\n")
+	defer db.Close()
+
+	var newID int64
+	check(inTx(db, func(tx *sql.Tx) (err error) {
+		newID, err = newUser("new@example.com", "secret", tx)
+		return err
+	}))
+	check(store.CreateSession(newID, "newsession"))
+	check(store.SetDisabled(newID, true))
+	if _, err := store.SessionUser("newsession"); err != sql.ErrNoRows {
+		t.Fatalf("disabled user still has a session: %v\n", err)
+	}
+	check(store.SetDisabled(newID, false))
+	if disabled, err := store.UserDisabled(newID); err != nil || disabled {
+		t.Fatalf("enabled user is disabled: %v %v\n", disabled, err)
+	}
+
+	// user 3 gets to look at album 1, then owns it and the photos user 1 put in it
+	check(inTx(db, func(tx *sql.Tx) error { return grantRole(1, 3, "viewer", tx) }))
+	if inTx(db, func(tx *sql.Tx) error { return grantRole(1, 3, "owner", tx) }) == nil {
+		t.Fatalf("granted a role that doesn't exist\n")
+	}
+	if inTx(db, func(tx *sql.Tx) error { return revokePerm(1, 1, tx) }) == nil {
+		t.Fatalf("revoked the owner's permission\n")
+	}
+	check(inTx(db, func(tx *sql.Tx) error { return chownAlbum(1, 3, true, tx) }))
+	var owner, photoOwner int64
+	var role string
+	check(db.QueryRow("SELECT user_id FROM albums WHERE id = 1").Scan(&owner))
+	check(db.QueryRow("SELECT role FROM album_permissions WHERE album_id = 1 AND user_id = 3").Scan(&role))
+	check(db.QueryRow("SELECT user_id FROM photos WHERE id = 1").Scan(&photoOwner))
+	if owner != 3 || role != "contributor" || photoOwner != 3 {
+		t.Fatalf("after chown got owner %v with role %s, photo 1 owned by %v\n", owner, role, photoOwner)
+	}
+	check(inTx(db, func(tx *sql.Tx) error { return revokePerm(1, 1, tx) }))
+
+	check(store.DeleteUser(newID))
+	stats, err := collectStats(db)
+	check(err)
+	if stats.Users != 3 || stats.DisabledUsers != 0 {
+		t.Fatalf("got stats %+v\n", stats)
+	}
+}
+
+func TestSync(t *testing.T) {
+	t.Setenv("SILSILA_PHOTO_PATH", t.TempDir())
+	db := testDB(t, "")
+	defer db.Close()
+	const email, password = "sync@example.com", "sync-secret"
+	check(inTx(db, func(tx *sql.Tx) error { _, err := newUser(email, password, tx); return err }))
+	mux := http.NewServeMux()
+	for route, h := range map[string]func(http.ResponseWriter, *http.Request, *sql.DB){
+		"/login/": loginHandler, "/home/": homeHandler, "/upload/": uploadHandler, "/photos/": photosHandler,
+		"/photo/remove/": removePhotoHandler, "/changes/": changesHandler,
+	} {
+		mux.HandleFunc(route, makeHandler(h, db))
+	}
+	// the password mustn't turn up in a URL or the server's log
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.String(), password) {
+			t.Errorf("password sent in %s\n", r.URL)
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	main := filepath.Join(dir, email+"'s Photos")
+	sync := func(want syncReport) {
+		t.Helper()
+		report, err := syncFolder(srv.URL, email, password, dir)
+		check(err)
+		if report != want {
+			t.Fatalf("got %s, want %s\n", report, want)
+		}
+	}
+	check(os.MkdirAll(filepath.Join(dir, "Trip"), 0700))
+	check(os.WriteFile(filepath.Join(dir, "Trip", "a.jpg"), []byte("photo a"), 0600))
+	b, _, err := addPhoto(1, 1, "b.jpg", strings.NewReader("photo b"), db)
+	check(err)
+	sync(syncReport{Downloaded: 1, Uploaded: 1})
+	if got, err := os.ReadFile(filepath.Join(main, "b.jpg")); err != nil || string(got) != "photo b" {
+		t.Fatalf("got b.jpg %q: %v\n", got, err)
+	}
+	var a int64
+	check(db.QueryRow("SELECT photo_id FROM album_photos JOIN albums ON albums.id = album_id WHERE albums.name = 'Trip'").Scan(&a))
+	sync(syncReport{})
+
+	// deleted on either side
+	check(os.Remove(filepath.Join(dir, "Trip", "a.jpg")))
+	check(inTx(db, func(tx *sql.Tx) error { return trashPhoto(b, tx) }))
+	sync(syncReport{DeletedLocal: 1, DeletedRemote: 1})
+	if _, err := os.Stat(filepath.Join(main, "b.jpg")); !os.IsNotExist(err) {
+		t.Fatalf("b.jpg wasn't deleted: %v\n", err)
+	}
+	var trashed sql.NullString
+	check(db.QueryRow("SELECT trashed_at FROM photos WHERE id = ?", a).Scan(&trashed))
+	if !trashed.Valid {
+		t.Fatalf("a.jpg wasn't deleted on the server\n")
+	}
+
+	// a different c.jpg on both sides keeps both
+	c, _, err := addPhoto(1, 1, "c.jpg", strings.NewReader("server c"), db)
+	check(err)
+	check(os.WriteFile(filepath.Join(main, "c.jpg"), []byte("local c"), 0600))
+	sync(syncReport{Downloaded: 1, Uploaded: 1, Conflicts: 1})
+	if got, err := os.ReadFile(filepath.Join(main, fmt.Sprintf("c (%v).jpg", c))); err != nil || string(got) != "server c" {
+		t.Fatalf("got server's c.jpg %q: %v\n", got, err)
+	}
+	var n int
+	check(db.QueryRow("SELECT COUNT(*) FROM album_photos JOIN photos ON photos.id = photo_id WHERE album_id = 1 AND trashed_at IS NULL").Scan(&n))
+	if n != 2 {
+		t.Fatalf("got %v photos in the main album, want both c.jpgs\n", n)
+	}
+	sync(syncReport{})
+
+	// photos uploaded on the server that the folder wouldn't upload itself are kept in step all the same
+	for _, name := range []string{"scan.pdf", ".hidden.jpg", ""} {
+		_, _, err := addPhoto(1, 1, name, strings.NewReader("server "+name), db)
+		check(err)
+	}
+	sync(syncReport{Downloaded: 3})
+	sync(syncReport{})
+	check(db.QueryRow("SELECT COUNT(*) FROM album_photos JOIN photos ON photos.id = photo_id WHERE album_id = 1 AND trashed_at IS NULL").Scan(&n))
+	if n != 5 {
+		t.Fatalf("got %v photos in the main album after syncing ones with other names, want 5\n", n)
+	}
+	for _, name := range []string{"scan.pdf", "hidden.jpg"} {
+		if _, err := os.Stat(filepath.Join(main, name)); err != nil {
+			t.Fatalf("%s wasn't downloaded: %v\n", name, err)
+		}
+	}
+	check(os.Remove(filepath.Join(main, "scan.pdf")))
+	sync(syncReport{DeletedRemote: 1})
+	if strings.Contains(logged.String(), password) {
+		t.Fatalf("password was logged\n")
+	}
+}
+
+func TestWebDAV(t *testing.T) {
+	needFTS5(t)
+	t.Setenv("SILSILA_PHOTO_PATH", t.TempDir())
+	readDB, db, err := openSQLite(filepath.Join(t.TempDir(), "db"))
+	check(err)
+	defer readDB.Close()
+	defer db.Close()
+	check(migrateUp(db, 0))
+	store = newSQLiteStore(db)
+	const email = "dav@example.com"
+	var password string
+	check(inTx(db, func(tx *sql.Tx) error {
+		if _, err := newUser(email, "pw", tx); err != nil {
+			return err
+		}
+		var err error
+		password, err = newAppPassword(1, "drive", tx)
+		return err
+	}))
+	srv := httptest.NewServer(makeHandler(davHandler(readDB), db))
+	defer srv.Close()
+	client := &http.Client{Timeout: 5 * time.Second}
+	dav := func(method string, target string, body string, want int, headers ...string) string {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+target, strings.NewReader(body))
+		check(err)
+		req.SetBasicAuth(email, password)
+		for i := 0; i+1 < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		resp, err := client.Do(req)
+		check(err)
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != want {
+			t.Fatalf("%s %s: got %s, want %v\n%s", method, target, resp.Status, want, b)
+		}
+		return string(b)
+	}
+
+	if !strings.Contains(dav("PROPFIND", "/dav/", "", http.StatusMultiStatus, "Depth", "1"), "dav@example.com&#39;s Photos") {
+		t.Fatalf("the user's album isn't listed\n")
+	}
+	dav("MKCOL", "/dav/Trip", "", http.StatusCreated)
+	dav("PUT", "/dav/Trip/a.jpg", "photo a", http.StatusCreated)
+	dav("PUT", "/dav/Trip/.DS_Store", "junk", http.StatusNotFound)
+	if got := dav("GET", "/dav/Trip/a.jpg", "", http.StatusOK); got != "photo a" {
+		t.Fatalf("got %q back\n", got)
+	}
+	var photoID int64
+	check(db.QueryRow("SELECT photo_id FROM album_photos JOIN albums ON albums.id = album_id WHERE name = 'Trip'").Scan(&photoID))
+	dav("MOVE", "/dav/Trip/a.jpg", "", http.StatusCreated, "Destination", srv.URL+"/dav/"+url.PathEscape(email+"'s Photos")+"/a.jpg")
+	dav("DELETE", "/dav/"+url.PathEscape(email+"'s Photos")+"/a.jpg", "", http.StatusNoContent)
+	var trashed sql.NullString
+	check(db.QueryRow("SELECT trashed_at FROM photos WHERE id = ?", photoID).Scan(&trashed))
+	if !trashed.Valid {
+		t.Fatalf("deleted photo isn't in the trash\n")
+	}
+
+	// looking around doesn't wait for the write connection, which an upload could be holding
+	dav("PUT", "/dav/Trip/b.jpg", "photo b", http.StatusCreated)
+	tx, err := db.Begin()
+	check(err)
+	dav("PROPFIND", "/dav/Trip/", "", http.StatusMultiStatus, "Depth", "1")
+	if got := dav("GET", "/dav/Trip/b.jpg", "", http.StatusOK); got != "photo b" {
+		t.Fatalf("got %q back\n", got)
+	}
+	check(tx.Rollback())
+
+	password = "wrong"
+	dav("PROPFIND", "/dav/", "", http.StatusUnauthorized)
+}
+
+func TestSearch(t *testing.T) {
+	db := testDB(t, dbSeed+"UPDATE photos SET title = 'Beach sunset' WHERE id = 1;\n"+
+		"UPDATE photos SET title = 'Beach party' WHERE id = 2;\n"+
+		"UPDATE photos SET caption = 'cake at the party <3', keywords = 'birthday cake' WHERE id = 3;\n"+
+		"INSERT INTO tags (photo_id, user_id) VALUES (3, 2);\n")
+	defer db.Close()
+
+	queries := map[string]string{
+		`beach`:              `"beach"`,
+		`  "at the" party* `: `"at the" "party"*`,
+		`title:x AND "y`:     `"title:x" "AND" "y"`,
+		`"say ""hi"" * - . `: `"say " "hi"`,
+		``:                   ``,
+	}
+	for q, want := range queries {
+		if got := ftsQuery(q); got != want {
+			t.Errorf("ftsQuery(%q) = %q, want %q\n", q, got, want)
+		}
+	}
+
+	search := func(q string) ([]albumResult, []photoResult) {
+		t.Helper()
+		tx, err := db.Begin()
+		check(err)
+		defer tx.Rollback()
+		albums, err := searchAlbums(ftsQuery(q), 1, tx)
+		check(err)
+		photos, err := searchPhotos(ftsQuery(q), 1, tx)
+		check(err)
+		return albums, photos
+	}
+	photoIDs := func(photos []photoResult) []int64 {
+		ids := make([]int64, 0)
+		for _, p := range photos {
+			ids = append(ids, p.ID)
+		}
+		return ids
+	}
+
+	// photo 2 is in user 2's album
+	_, photos := search("beach")
+	if fmt.Sprint(photoIDs(photos)) != "[1]" || photos[0].Match != "<mark>Beach</mark> sunset" {
+		t.Fatalf("got %+v searching for beach\n", photos)
+	}
+	albums, photos := search("birth*")
+	if len(albums) != 1 || albums[0].ID != 3 || fmt.Sprint(photoIDs(photos)) != "[3]" {
+		t.Fatalf("got albums %+v and photos %+v searching for birth*\n", albums, photos)
+	}
+	if _, photos := search(`"at the party"`); fmt.Sprint(photoIDs(photos)) != "[3]" || !strings.Contains(string(photos[0].Snippet), "&lt;3") {
+		t.Fatalf("got %+v searching for a phrase\n", photos)
+	}
+	if _, photos := search(`"the at party"`); len(photos) != 0 {
+		t.Fatalf("got %+v searching for words in the wrong order\n", photos)
+	}
+	// tagged users are found by email, which follows them when it changes
+	if _, photos := search("user2"); fmt.Sprint(photoIDs(photos)) != "[3]" {
+		t.Fatalf("got %+v searching for a tagged user\n", photos)
+	}
+	_, err := db.Exec("UPDATE users SET email = 'someone@example.com' WHERE id = 2")
+	check(err)
+	if _, photos := search("someone"); fmt.Sprint(photoIDs(photos)) != "[3]" {
+		t.Fatalf("got %+v searching for a tagged user's new email\n", photos)
+	}
+	_, err = db.Exec("UPDATE photos SET trashed_at = '2026-01-01 00:00:00' WHERE id = 1")
+	check(err)
+	if _, photos := search("beach"); len(photos) != 0 {
+		t.Fatalf("got %+v searching for a photo in the trash\n", photos)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	db := testDB(t, dbSeed+"UPDATE photos SET title = 'Beach', camera = 'Canon EOS R6', latitude = 1.5, longitude = 2.5, "+
+		"captured_at = '2025-07-01 12:00:00' WHERE id = 1;\n"+
+		"UPDATE photos SET captured_at = '2024-01-01 12:00:00', caption = 'cake' WHERE id = 3;\n"+
+		"INSERT INTO tags (photo_id, user_id) VALUES (3, 2);\n")
+	defer db.Close()
+
+	for _, q := range []string{"color:red", "after:june", "has:cats", "tagged:"} {
+		if _, err := parseQuery(q, 1); err == nil {
+			t.Errorf("parsed %q\n", q)
+		}
+	}
+	if pq, err := parseQuery(`"at 12:30" beach`, 1); err != nil || pq.filtered() || pq.Text != `"at 12:30" beach` {
+		t.Errorf("got %+v, %v parsing a query without filters\n", pq, err)
+	}
+
+	examples := map[string]string{
+		"camera:canon":             "[1]",
+		"camera:nikon":             "[]",
+		"tagged:user2":             "[3]",
+		"TAGGED:User2@example.com": "[3]",
+		"tagged:user":              "[]",
+		`album:"1s birthday!"`:     "[3]",
+		`album:"2 main"`:           "[]", // user 2's album, which has photo 2 in it
+		"after:2025-06-01 before:2025-09-01 has:gps": "[1]",
+		"before:2025":   "[3]",
+		"has:gps beach": "[1]",
+		"has:gps cake":  "[]",
+		"has:tags":      "[3]",
+		"":              "[1 3]",
+	}
+	for q, want := range examples {
+		t.Run(q, func(t *testing.T) {
+			pq, err := parseQuery(q, 1)
+			check(err)
+			tx, err := db.Begin()
+			check(err)
+			defer tx.Rollback()
+			photos, err := runQuery(pq, searchLimit, tx)
+			check(err)
+			ids := make([]int64, 0)
+			for _, p := range photos {
+				ids = append(ids, p.ID)
+			}
+			if got := fmt.Sprint(ids); got != want {
+				t.Fatalf("got %s, want %s\n", got, want)
+			}
+		})
+	}
+}
+
+func TestSmartAlbum(t *testing.T) {
+	db := testDB(t, dbSeed+"INSERT INTO tags (photo_id, user_id) VALUES (2, 2), (3, 2);\n"+
+		"INSERT INTO album_permissions (album_id, user_id, role) VALUES (1, 1, 'contributor'), (3, 1, 'contributor');\n")
+	defer db.Close()
+
+	var albumID int64
+	check(inTx(db, func(tx *sql.Tx) error {
+		if _, err := newSmartAlbum("Grandma", "color:red", 1, tx); err == nil {
+			t.Fatalf("made a smart album with a bad query\n")
+		}
+		var err error
+		if albumID, err = newSmartAlbum("Grandma", "tagged:user2", 1, tx); err != nil {
+			return err
+		}
+		// photo 2 is tagged too, but it's in user 2's album
+		photos, err := smartAlbumPhotos(albumID, 1, tx)
+		if err != nil {
+			return err
+		}
+		if len(photos) != 1 || photos[0].ID != 3 {
+			t.Fatalf("got %+v in the smart album\n", photos)
+		}
+		if err := addToAlbum(1, albumID, tx); err == nil {
+			t.Fatalf("added a photo to a smart album\n")
+		}
+		if err := setAlbumQuery(1, "has:gps", tx); err == nil {
+			t.Fatalf("turned a regular album into a smart one\n")
+		}
+		targets, err := contributorAlbums(1, tx)
+		if err != nil {
+			return err
+		}
+		for _, a := range targets {
+			if a.ID == albumID {
+				t.Fatalf("smart album is offered as somewhere to add photos\n")
+			}
+		}
+		cards, err := smartAlbumCards(1, tx)
+		if err != nil {
+			return err
+		}
+		if card := cards[albumID]; card.Count != 1 || card.CoverID != 3 {
+			t.Fatalf("got card %+v for the smart album\n", card)
+		}
+		// photos added later show up on their own
+		if err := store.WithTx(tx).AddTag(1, 2); err != nil {
+			return err
+		}
+		if photos, err = smartAlbumPhotos(albumID, 1, tx); err != nil {
+			return err
+		}
+		if len(photos) != 2 {
+			t.Fatalf("got %+v in the smart album after tagging another photo\n", photos)
+		}
+		return store.WithTx(tx).CreateSession(3, "viewer")
+	}))
+
+	// the album can only be seen by the people it's shared with, who see what the owner's query finds among the
+	// photos they can see themselves
+	view := func() (int, string) {
+		w := serve(albumHandler, db, "viewer", fmt.Sprintf("/album/%v", albumID), nil)
+		return w.Code, w.Body.String()
+	}
+	if code, _ := view(); code != http.StatusForbidden {
+		t.Fatalf("got %v viewing a smart album that wasn't shared\n", code)
+	}
+	check(inTx(db, func(tx *sql.Tx) error { return grantRole(albumID, 3, "viewer", tx) }))
+	code, body := view()
+	if code != http.StatusOK {
+		t.Fatalf("got %v viewing a shared smart album\n", code)
+	}
+	if strings.Contains(body, "/photos/1") || strings.Contains(body, "/photos/3") {
+		t.Fatalf("viewer sees photos from albums only shared with the owner:\n%s", body)
+	}
+	check(inTx(db, func(tx *sql.Tx) error { return grantRole(3, 3, "viewer", tx) }))
+	if _, body = view(); !strings.Contains(body, "/photos/3") || strings.Contains(body, "/photos/1") {
+		t.Fatalf("viewer with access to album 3 doesn't see just photo 3:\n%s", body)
+	}
+}
+
+func TestTimeline(t *testing.T) {
+	db := testDB(t, dbSeed+"INSERT INTO album_permissions (album_id, user_id, role) VALUES (1, 1, 'contributor'), (3, 1, 'contributor'), (2, 1, 'viewer');\n"+
+		"UPDATE photos SET captured_at = '2025-07-02 10:00:00' WHERE id = 1;\n"+
+		"UPDATE photos SET captured_at = '2025-07-02 09:00:00' WHERE id = 2;\n"+
+		"UPDATE photos SET captured_at = '2024-12-31 23:00:00' WHERE id = 3;\n"+
+		"UPDATE photos SET captured_at = '2025-01-01 00:00:00' WHERE id = 4;\n")
+	defer db.Close()
+	tx, err := db.Begin()
+	check(err)
+	defer tx.Rollback()
+
+	// photo 4 is in user 3's album
+	feed, err := listTimeline(1, timelineCursor{}, "", "", 2, tx)
+	check(err)
+	if len(feed.Days) != 1 || feed.Days[0].Date != "2025-07-02" || feed.Days[0].Year != "2025" || feed.Days[0].Month != "July 2025" ||
+		len(feed.Days[0].Photos) != 2 || feed.Days[0].Photos[0].ID != 1 || feed.Cursor == "" {
+		t.Fatalf("got %+v for the first page\n", feed)
+	}
+	cursor, err := parseTimelineCursor(feed.Cursor)
+	check(err)
+	feed, err = listTimeline(1, cursor, "", "", 2, tx)
+	check(err)
+	if len(feed.Days) != 1 || feed.Days[0].Year != "2024" || feed.Days[0].Photos[0].ID != 3 || feed.Cursor != "" {
+		t.Fatalf("got %+v for the last page\n", feed)
+	}
+	start, end, err := parseMonth("2025-07")
+	check(err)
+	if feed, err = listTimeline(1, timelineCursor{}, start, end, 10, tx); err != nil || len(feed.Days) != 1 || len(feed.Days[0].Photos) != 2 {
+		t.Fatalf("got %+v, %v for July\n", feed, err)
+	}
+	years, err := timelineMonths(1, tx)
+	check(err)
+	if len(years) != 2 || years[0].Year != "2025" || years[0].Count != 2 || years[1].Months[0].Month != "2024-12" {
+		t.Fatalf("got months %+v\n", years)
+	}
+	check(store.WithTx(tx).CreateSession(1, "timeline"))
+	check(tx.Commit())
+
+	pages := map[string]int{
+		"/timeline/":              http.StatusOK,
+		"/timeline/?from=2024-12": http.StatusOK,
+		"/timeline/2025":          http.StatusOK,
+		"/timeline/2025/07":       http.StatusOK,
+		"/timeline/2025/13":       http.StatusNotFound,
+		"/timeline.json?cursor=x": http.StatusBadRequest,
+	}
+	for target, want := range pages {
+		req := httptest.NewRequest("GET", target, nil)
+		req.AddCookie(&http.Cookie{Name: "session_cookie", Value: "timeline"})
+		w := httptest.NewRecorder()
+		if strings.HasPrefix(target, "/timeline.json") {
+			timelineJSONHandler(w, req, db)
+		} else {
+			timelineHandler(w, req, db)
+		}
+		if w.Code != want {
+			t.Errorf("got %v for %s, want %v\n%s", w.Code, target, want, w.Body)
+		}
+	}
+}
+
+func TestFsck(t *testing.T) {
+	dir := t.TempDir()
+	db := testDB(t, "")
+	defer db.Close()
+
+	write := func(name string, data string) string {
+		p := filepath.Join(dir, name)
+		check(os.WriteFile(p, []byte(data), 0600))
+		return p
+	}
+	good := write("1", "good photo")
+	goodSum, err := hashBlob(good, blobKey{})
+	check(err)
+	corrupt := write("2", "flipped bits")
+	orphan := write("orphan", "nobody points here")
+	old := time.Now().Add(-2 * orphanGrace)
+	check(os.Chtimes(orphan, old, old))
+	// an upload being written, and one written but not yet committed
+	write(".upload-123", "half a photo")
+	write("4", "new photo")
+
+	_, err = db.Exec("INSERT INTO photos (id, path, checksum) VALUES (1, ?, ?), (2, ?, 'abc'), (3, ?, '');",
+		good, goodSum, corrupt, filepath.Join(dir, "3"))
+	check(err)
+
+	report, err := fsck(db, dir, true)
+	if err != nil {
+		t.Fatalf("ERR: %s\n", err)
+	}
+	if report.Checked != 3 || len(report.Missing) != 1 || report.Missing[0] != 3 ||
+		len(report.Corrupt) != 1 || report.Corrupt[0] != 2 || len(report.Orphans) != 1 {
+		t.Fatalf("got report %+v\n", report)
+	}
+	if _, err := os.Stat(filepath.Join(dir, quarantineDir, "orphan")); err != nil {
+		t.Fatalf("orphan wasn't quarantined: %s\n", err)
+	}
+	for _, name := range []string{".upload-123", "4"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Fatalf("upload in progress was quarantined: %s\n", err)
+		}
+	}
+	for id, want := range map[int64]string{1: "", 2: "corrupt", 3: "missing"} {
+		var broken sql.NullString
+		check(db.QueryRow("SELECT broken FROM photos WHERE id = ?", id).Scan(&broken))
+		if broken.String != want {
+			t.Fatalf("photo %v: got broken %q, want %q\n", id, broken.String, want)
+		}
+	}
+}
+
+// runs the same checks against any Store, which has to start out with an empty, migrated database
+func testStore(t *testing.T, s Store) {
+	userID, err := s.CreateUser("store@example.com", "hash")
+	check(err)
+	otherID, err := s.CreateUser("other@example.com", "other hash")
+	check(err)
+	gotID, hash, err := s.UserByEmail("store@example.com")
+	check(err)
+	if gotID != userID || hash != "hash" {
+		t.Fatalf("got user %v with hash %q, want user %v with hash %q\n", gotID, hash, userID, "hash")
+	}
+	if _, _, err := s.UserByEmail("nobody@example.com"); err != sql.ErrNoRows {
+		t.Fatalf("got error %v for a missing user, want sql.ErrNoRows\n", err)
+	}
+
+	albumID, err := s.CreateAlbum(userID, "holiday")
+	check(err)
+	check(s.RenameAlbum(albumID, "summer"))
+	check(s.SetAlbumDescription(albumID, "at the lake"))
+	if ownerID, err := s.AlbumOwner(albumID); err != nil || ownerID != userID {
+		t.Fatalf("got owner %v (%v), want %v\n", ownerID, err, userID)
+	}
+
+	check(s.GrantPermission(albumID, otherID, "viewer"))
+	for _, ex := range []struct {
+		userID   int64
+		wantPerm bool
+		wantRole bool
+	}{
+		{userID: otherID, wantPerm: true, wantRole: false},
+		{userID: userID, wantPerm: false, wantRole: false},
+	} {
+		perm, err := s.HasPermission(albumID, ex.userID)
+		check(err)
+		role, err := s.HasRole(albumID, ex.userID, "contributor")
+		check(err)
+		if perm != ex.wantPerm || role != ex.wantRole {
+			t.Fatalf("user %v: got permission %v and contributor %v, want %v and %v\n", ex.userID, perm, role, ex.wantPerm, ex.wantRole)
+		}
+	}
+
+	photoID, err := s.CreatePhoto(userID, "lake.jpg")
+	check(err)
+	want := photoFile{Path: "/photos/1", Checksum: "abc", Size: 3, Key: blobKey{ID: "key", Wrapped: []byte{1, 2, 3}}}
+	check(s.SetPhotoFile(photoID, want))
+	got, err := s.PhotoFile(photoID)
+	check(err)
+	if got.Path != want.Path || got.Checksum != want.Checksum || got.Size != want.Size || got.Key.ID != want.Key.ID ||
+		!bytes.Equal(got.Key.Wrapped, want.Key.Wrapped) || got.UploadedAt == "" {
+		t.Fatalf("got file %+v, want %+v\n", got, want)
+	}
+	check(s.SetPhotoDetails(photoID, photoDetails{Title: "lake", Caption: "swimming", AltText: "a lake"}))
+	if d, err := s.PhotoDetails(photoID); err != nil || d.Caption != "swimming" {
+		t.Fatalf("got details %+v (%v)\n", d, err)
+	}
+
+	check(s.AddTag(photoID, otherID))
+	if emails, err := s.PhotoTags(photoID); err != nil || len(emails) != 1 || emails[0] != "other@example.com" {
+		t.Fatalf("got tags %v (%v)\n", emails, err)
+	}
+	if photos, err := s.TaggedPhotos(otherID); err != nil || len(photos) != 1 || photos[0] != photoID {
+		t.Fatalf("got tagged photos %v (%v)\n", photos, err)
+	}
+
+	check(s.CreateSession(userID, "session"))
+	if id, err := s.SessionUser("session"); err != nil || id != userID {
+		t.Fatalf("got session user %v (%v), want %v\n", id, err, userID)
+	}
+	check(s.DeleteSession("session"))
+	if _, err := s.SessionUser("session"); err != sql.ErrNoRows {
+		t.Fatalf("got error %v for a deleted session, want sql.ErrNoRows\n", err)
+	}
+}
+
+func TestSQLiteStore(t *testing.T) {
+	db := testDB(t, "")
+	defer db.Close()
+	testStore(t, newSQLiteStore(db))
+}
+
+// fakeMailer keeps the emails it's asked to send, checking nothing is holding db's one connection meanwhile
+type fakeMailer struct {
+	db   *sql.DB
+	fail map[string]bool // addresses sending to fails for
+	sent []string
+}
+
+func (m *fakeMailer) Send(to string, subject string, body string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := m.db.ExecContext(ctx, "UPDATE users SET email = email WHERE id = 0"); err != nil {
+		return fmt.Errorf("sending with the database busy: %w", err)
+	}
+	if m.fail[to] {
+		return fmt.Errorf("can't send to %s", to)
+	}
+	m.sent = append(m.sent, to+": "+body)
+	return nil
+}
+
+func TestMemories(t *testing.T) {
+	db := testDB(t, dbSeed+"INSERT INTO album_permissions (album_id, user_id, role) VALUES (2, 1, 'viewer');\n"+
+		"UPDATE photos SET captured_at = '2025-07-02 10:00:00' WHERE id = 1;\n"+
+		"UPDATE photos SET captured_at = '2023-07-02 09:00:00' WHERE id = 2;\n"+
+		"UPDATE photos SET captured_at = '2026-07-02 08:00:00' WHERE id = 3;\n"+
+		"UPDATE photos SET captured_at = '2024-07-02 07:00:00' WHERE id = 4;\n"+
+		"UPDATE users SET memory_digest_since = '2026-01-01 00:00:00' WHERE id IN (1, 3);\n")
+	defer db.Close()
+
+	day := time.Date(2026, time.July, 2, 6, 0, 0, 0, time.Local)
+	// a digest that can't be sent doesn't stop the others, and is sent on the next run
+	m := &fakeMailer{db: db, fail: map[string]bool{"user1@example.com": true}}
+	if err := prepareMemories(db, day, m); err == nil {
+		t.Fatalf("failing to send a digest wasn't reported\n")
+	}
+	if len(m.sent) != 1 || !strings.HasPrefix(m.sent[0], "user3@example.com: ") {
+		t.Fatalf("sent %q with user 1's digest failing\n", m.sent)
+	}
+	m.fail, m.sent = nil, nil
+	check(prepareMemories(db, day, m))
+	// preparing the day again changes nothing and sends nothing
+	check(prepareMemories(db, day, m))
+	if len(m.sent) != 1 || !strings.HasPrefix(m.sent[0], "user1@example.com: ") || !strings.Contains(m.sent[0], "3 years ago") {
+		t.Fatalf("sent %q\n", m.sent)
+	}
+
+	memoryIDs := func(userID int64) []int64 {
+		ids := make([]int64, 0)
+		check(inTx(db, func(tx *sql.Tx) error {
+			memories, err := dayMemories(userID, day, tx)
+			for _, m := range memories {
+				ids = append(ids, m.ID)
+			}
+			return err
+		}))
+		return ids
+	}
+	// photo 3 is from this year and photo 4 is in an album user 1 can't see
+	if ids := memoryIDs(1); fmt.Sprint(ids) != "[1 2]" {
+		t.Fatalf("got memories %v for user 1\n", ids)
+	}
+	if ids := memoryIDs(3); fmt.Sprint(ids) != "[4]" {
+		t.Fatalf("got memories %v for user 3\n", ids)
+	}
+
+	check(inTx(db, func(tx *sql.Tx) error { return store.WithTx(tx).CreateSession(1, "memories") }))
+	post := func(target string, form url.Values) {
+		req := httptest.NewRequest("POST", target, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(&http.Cookie{Name: "session_cookie", Value: "memories"})
+		w := httptest.NewRecorder()
+		memoriesHandler(w, req, db)
+		if w.Code != http.StatusFound {
+			t.Fatalf("got %v for %s\n%s", w.Code, target, w.Body)
+		}
+	}
+	post("/memories/hide", url.Values{"photo": {"2"}})
+	// photo 4 never came up for user 1
+	post("/memories/hide", url.Values{"photo": {"4"}})
+	if ids := memoryIDs(1); fmt.Sprint(ids) != "[1]" {
+		t.Fatalf("got memories %v for user 1 after hiding photo 2\n", ids)
+	}
+	post("/memories/dismiss", url.Values{"day": {day.Format(dayLayout)}})
+	if ids := memoryIDs(1); len(ids) != 0 {
+		t.Fatalf("got memories %v for user 1 after dismissing them\n", ids)
+	}
+	post("/memories/digest", url.Values{"digest": {"off"}})
+	var hidden, digests int
+	check(db.QueryRow("SELECT COUNT(*) FROM hidden_memories").Scan(&hidden))
+	check(db.QueryRow("SELECT COUNT(*) FROM users WHERE id = 1 AND memory_digest_since IS NOT NULL").Scan(&digests))
+	if hidden != 1 || digests != 0 {
+		t.Fatalf("got %v hidden memories and %v digests\n", hidden, digests)
+	}
+
+	// old memories are dropped
+	check(prepareMemories(db, day.AddDate(0, 0, 8), nil))
+	if ids := memoryIDs(3); len(ids) != 0 {
+		t.Fatalf("got memories %v for user 3 after a week\n", ids)
+	}
+	if dates := memoryDates(time.Date(2027, time.February, 28, 0, 0, 0, 0, time.UTC)); len(dates) != 2 {
+		t.Errorf("got %v for the 28th of February 2027\n", dates)
+	}
+	if dates := memoryDates(time.Date(2028, time.February, 28, 0, 0, 0, 0, time.UTC)); len(dates) != 1 {
+		t.Errorf("got %v for the 28th of February 2028\n", dates)
+	}
+}
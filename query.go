@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// queries find photos by what's known about them as well as by their text, e.g.
+//
+//	tagged:alice album:"Trip 2026" camera:canon after:2025-06-01 before:2025-09-01 has:gps beach
+//
+// Every filter has to match. tagged: takes an email or the part of one before the @, album: an album name, camera:
+// part of the camera's make or model, after: and before: a date as YYYY, YYYY-MM or YYYY-MM-DD compared with when
+// the photo was taken (after: includes the date, before: doesn't), and has: gps, caption, title, tags or keywords.
+// Anything else is searched for like in search. A query compiles to conditions on photos, all inside the albums the
+// user can access. /query/ shows the results in the viewpage grid and /query.json returns them as JSON
+
+// queryDateLayouts are the ways after: and before: can be written
+var queryDateLayouts = []string{"2006-01-02", "2006-01", "2006"}
+
+// hasConditions are the conditions has: can ask for
+var hasConditions = map[string]string{
+	"gps":      "photos.latitude IS NOT NULL AND photos.longitude IS NOT NULL",
+	"caption":  "photos.caption != ''",
+	"title":    "photos.title != ''",
+	"keywords": "photos.keywords != ''",
+	"tags":     "EXISTS (SELECT 1 FROM tags WHERE tags.photo_id = photos.id)",
+}
+
+// accessibleAlbumsSQL selects the ids of the albums out of the trash that the user passed twice as arguments can see
+const accessibleAlbumsSQL = "SELECT id FROM albums WHERE trashed_at IS NULL " +
+	"AND (user_id = ? OR id IN (SELECT album_id FROM album_permissions WHERE user_id = ?))"
+
+// photoQuery is a query parsed for a user: the conditions its filters put on photos, their arguments, and the words
+// left over to search for
+type photoQuery struct {
+	userID int64
+	conds  []string
+	args   []interface{}
+	Text   string
+}
+
+// queryPhoto is a photo found by a query as /query.json returns it
+type queryPhoto struct {
+	ID        int64    `json:"id"`
+	Title     string   `json:"title"`
+	Caption   string   `json:"caption"`
+	AltText   string   `json:"alt_text"`
+	Filename  string   `json:"filename"`
+	TakenAt   string   `json:"taken_at"` // when the photo was taken, or uploaded if that isn't known
+	Camera    string   `json:"camera,omitempty"`
+	Latitude  *float64 `json:"latitude,omitempty"`
+	Longitude *float64 `json:"longitude,omitempty"`
+}
+
+// splitQuery splits a query into terms at spaces outside of double quotes, keeping the quotes
+func splitQuery(q string) []string {
+	terms := make([]string, 0)
+	var term strings.Builder
+	quoted := false
+	for _, r := range q {
+		if r == '"' {
+			quoted = !quoted
+		}
+		if unicode.IsSpace(r) && !quoted {
+			if term.Len() > 0 {
+				terms = append(terms, term.String())
+				term.Reset()
+			}
+			continue
+		}
+		term.WriteRune(r)
+	}
+	if term.Len() > 0 {
+		terms = append(terms, term.String())
+	}
+	return terms
+}
+
+// escapes the wildcards of a LIKE pattern, for use with ESCAPE '\'
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// parseQueryDate reads the date of an after: or before: filter as the first moment it covers
+func parseQueryDate(s string) (string, error) {
+	for _, layout := range queryDateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.Format(timeLayout), nil
+		}
+	}
+	return "", fmt.Errorf("%q isn't a date like 2025-06-01", s)
+}
+
+// parseQuery reads a query for userID, failing on filters it doesn't know or values they can't take
+func parseQuery(q string, userID int64) (photoQuery, error) {
+	pq := photoQuery{userID: userID}
+	where := func(cond string, args ...interface{}) {
+		pq.conds = append(pq.conds, cond)
+		pq.args = append(pq.args, args...)
+	}
+	text := make([]string, 0)
+	for _, term := range splitQuery(q) {
+		key, value, ok := strings.Cut(term, ":")
+		// words with a colon in them that aren't filters, like times, are searched for
+		if !ok || key == "" || strings.IndexFunc(key, func(r rune) bool { return !unicode.IsLetter(r) }) >= 0 {
+			text = append(text, term)
+			continue
+		}
+		value = strings.TrimSpace(strings.Trim(value, `"`))
+		if value == "" {
+			return pq, fmt.Errorf("%s: needs something to look for", key)
+		}
+		switch strings.ToLower(key) {
+		case "tagged":
+			where("photos.id IN (SELECT photo_id FROM tags JOIN users ON users.id = tags.user_id "+
+				`WHERE lower(users.email) = lower(?) OR lower(users.email) LIKE lower(?) ESCAPE '\')`, value, escapeLike(value)+"@%")
+		case "album":
+			where("photos.id IN (SELECT photo_id FROM album_photos JOIN albums ON albums.id = album_photos.album_id "+
+				"WHERE lower(albums.name) = lower(?) AND albums.id IN ("+accessibleAlbumsSQL+"))", value, userID, userID)
+		case "camera":
+			where(`lower(COALESCE(photos.camera, '')) LIKE lower(?) ESCAPE '\'`, "%"+escapeLike(value)+"%")
+		case "after", "before":
+			date, err := parseQueryDate(value)
+			if err != nil {
+				return pq, fmt.Errorf("%s: %w", key, err)
+			}
+			op := ">="
+			if strings.ToLower(key) == "before" {
+				op = "<"
+			}
+			where("COALESCE(photos.captured_at, photos.uploaded_at) "+op+" ?", date)
+		case "has":
+			cond, ok := hasConditions[strings.ToLower(value)]
+			if !ok {
+				return pq, fmt.Errorf("has: takes gps, caption, title, tags or keywords, not %q", value)
+			}
+			where(cond)
+		default:
+			return pq, fmt.Errorf("there's no filter %s:", key)
+		}
+	}
+	pq.Text = strings.Join(text, " ")
+	return pq, nil
+}
+
+// filtered reports whether the query has any filters, rather than just words to search for
+func (pq photoQuery) filtered() bool {
+	return len(pq.conds) > 0
+}
+
+// sql compiles the query to a select of the photos it finds that the user can see, newest first
+func (pq photoQuery) sql(limit int) (string, []interface{}) {
+	where, args := pq.where()
+	query := "SELECT photos.id, photos.title, photos.caption, photos.alt_text, photos.filename, " +
+		"COALESCE(photos.captured_at, photos.uploaded_at), COALESCE(photos.camera, ''), photos.latitude, photos.longitude " +
+		"FROM photos WHERE " + where +
+		" ORDER BY COALESCE(photos.captured_at, photos.uploaded_at) DESC, photos.id DESC LIMIT ?"
+	return query, append(args, limit)
+}
+
+// where returns the conditions photos have to meet to be found by pq, and their arguments
+func (pq photoQuery) where() (string, []interface{}) {
+	where := "photos.trashed_at IS NULL " +
+		"AND photos.id IN (SELECT photo_id FROM album_photos WHERE album_id IN (" + accessibleAlbumsSQL + "))"
+	args := append([]interface{}{pq.userID, pq.userID}, pq.args...)
+	for _, cond := range pq.conds {
+		where += " AND " + cond
+	}
+	if match := ftsQuery(pq.Text); match != "" {
+		where += " AND photos.id IN (SELECT rowid FROM photo_search WHERE photo_search MATCH ?)"
+		args = append(args, match)
+	}
+	return where, args
+}
+
+// visibleTo narrows pq, parsed for someone else, down to the photos userID can see as well
+func (pq photoQuery) visibleTo(userID int64) photoQuery {
+	if userID == pq.userID {
+		return pq
+	}
+	pq.conds = append(append(make([]string, 0, len(pq.conds)+1), pq.conds...),
+		"photos.id IN (SELECT photo_id FROM album_photos WHERE album_id IN ("+accessibleAlbumsSQL+"))")
+	pq.args = append(append(make([]interface{}, 0, len(pq.args)+2), pq.args...), userID, userID)
+	return pq
+}
+
+// runQuery returns what a query finds
+func runQuery(pq photoQuery, limit int, tx *sql.Tx) ([]queryPhoto, error) {
+	query, args := pq.sql(limit)
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to run query: %w", err)
+	}
+	defer rows.Close()
+	photos := make([]queryPhoto, 0)
+	for rows.Next() {
+		var p queryPhoto
+		var lat, long sql.NullFloat64
+		if err := rows.Scan(&p.ID, &p.Title, &p.Caption, &p.AltText, &p.Filename, &p.TakenAt, &p.Camera, &lat, &long); err != nil {
+			return nil, fmt.Errorf("failed to scan photo: %w", err)
+		}
+		if lat.Valid && long.Valid {
+			p.Latitude, p.Longitude = &lat.Float64, &long.Float64
+		}
+		photos = append(photos, p)
+	}
+	return photos, rows.Err()
+}
+
+// countQuery returns how many photos pq finds
+func countQuery(pq photoQuery, tx *sql.Tx) (int, error) {
+	where, args := pq.where()
+	var n int
+	if err := tx.QueryRow("SELECT count(*) FROM photos WHERE "+where, args...).Scan(&n); err != nil {
+		return 0, fmt.Errorf("failed to count query results: %w", err)
+	}
+	return n, nil
+}
+
+// queryRequest runs the query in the q parameter for the session user. A query that can't be parsed gives
+// http.StatusBadRequest and its error
+func queryRequest(r *http.Request, userID int64, db *sql.DB) ([]queryPhoto, int, error) {
+	pq, err := parseQuery(r.FormValue("q"), userID)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, http.StatusInternalServerError, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	photos, err := runQuery(pq, searchLimit, tx)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return photos, http.StatusOK, tx.Commit()
+}
+
+// shows the photos a query finds in the viewpage grid
+func queryHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	userID, err := checkSesh(w, r, db)
+	if err != nil {
+		log.Printf("failed to validate user session: %s", err)
+		return
+	}
+
+	v := viewpage{UserID: userID, Heading: "query", Action: "/query/", Query: r.FormValue("q"), Photos: make([]photoInfo, 0)}
+	if v.Query != "" {
+		v.Heading += ": " + v.Query
+		photos, status, err := queryRequest(r, userID, db)
+		if status == http.StatusBadRequest {
+			v.Error = err.Error()
+		} else if err != nil {
+			log.Printf("%s", err)
+			http.Error(w, err.Error(), status)
+			return
+		}
+		for _, p := range photos {
+			v.Photos = append(v.Photos, photoInfo{ID: p.ID, Title: p.Title, Caption: p.Caption, AltText: p.AltText})
+		}
+	}
+	if err := templates.ExecuteTemplate(w, "view.html", v); err != nil {
+		log.Printf("failed to render html: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// returns the photos a query finds as JSON, {"query": q, "photos": [...]}
+func queryJSONHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	userID, err := checkSesh(w, r, db)
+	if err != nil {
+		log.Printf("failed to validate user session: %s", err)
+		return
+	}
+	photos, status, err := queryRequest(r, userID, db)
+	if err != nil {
+		if status != http.StatusBadRequest {
+			log.Printf("%s", err)
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	result := struct {
+		Query  string       `json:"query"`
+		Photos []queryPhoto `json:"photos"`
+	}{r.FormValue("q"), photos}
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		log.Printf("failed to write query results: %s", err)
+	}
+}
+
+// queryURL is the page showing the results of a query
+func queryURL(q string) string {
+	return "/query/?" + url.Values{"q": {q}}.Encode()
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// storage is charged per file on disk rather than per photo: a photo that's in several albums is only counted once,
+// and a file that several users uploaded is split evenly between them. users.quota_bytes and albums.quota_bytes
+// limit usage, NULL meaning the user gets defaultQuota and the album has no limit of its own
+
+var errQuotaExceeded = errors.New("storage quota exceeded")
+
+// defaultQuota is the quota of users without one of their own, 0 meaning unlimited. Set by the -default-quota flag
+var defaultQuota int64
+
+// returns the number of bytes charged to a user
+func userUsage(userID int64, tx *sql.Tx) (int64, error) {
+	var used int64
+	err := tx.QueryRow("SELECT COALESCE(CAST(SUM(cost) AS INTEGER), 0) FROM ("+
+		"SELECT MAX(size) * 1.0 / (SELECT COUNT(DISTINCT user_id) FROM photos AS others WHERE others.path = mine.path) AS cost "+
+		"FROM photos AS mine WHERE user_id = ? AND path IS NOT NULL GROUP BY path)", userID).Scan(&used)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get storage used by user %v: %w", userID, err)
+	}
+	return used, nil
+}
+
+// returns the number of bytes taken up by the files of the photos in an album
+func albumUsage(albumID int64, tx *sql.Tx) (int64, error) {
+	var used int64
+	err := tx.QueryRow("SELECT COALESCE(SUM(size), 0) FROM (SELECT MAX(size) AS size FROM photos "+
+		"JOIN album_photos ON photos.id = album_photos.photo_id WHERE album_id = ? AND path IS NOT NULL GROUP BY path)", albumID).Scan(&used)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get storage used by album %v: %w", albumID, err)
+	}
+	return used, nil
+}
+
+// returns the quota of a user in bytes, 0 meaning unlimited
+func userQuota(userID int64, tx *sql.Tx) (int64, error) {
+	var quota sql.NullInt64
+	if err := tx.QueryRow("SELECT quota_bytes FROM users WHERE id = ?", userID).Scan(&quota); err != nil {
+		return 0, fmt.Errorf("failed to get quota of user %v: %w", userID, err)
+	}
+	if !quota.Valid {
+		return defaultQuota, nil
+	}
+	return quota.Int64, nil
+}
+
+// checks that a user and an album are within their quotas, meant to be called in the transaction that adds a photo
+// before it commits
+func checkQuotas(userID int64, albumID int64, tx *sql.Tx) error {
+	quota, err := userQuota(userID, tx)
+	if err != nil {
+		return err
+	}
+	if quota > 0 {
+		used, err := userUsage(userID, tx)
+		if err != nil {
+			return err
+		}
+		if used > quota {
+			return fmt.Errorf("%w: this upload would use %s of your %s", errQuotaExceeded, formatBytes(used), formatBytes(quota))
+		}
+	}
+
+	var albumQuota sql.NullInt64
+	if err := tx.QueryRow("SELECT quota_bytes FROM albums WHERE id = ?", albumID).Scan(&albumQuota); err != nil {
+		return fmt.Errorf("failed to get quota of album %v: %w", albumID, err)
+	}
+	if albumQuota.Valid && albumQuota.Int64 > 0 {
+		used, err := albumUsage(albumID, tx)
+		if err != nil {
+			return err
+		}
+		if used > albumQuota.Int64 {
+			return fmt.Errorf("%w: this upload would make the album %s, its limit is %s", errQuotaExceeded, formatBytes(used), formatBytes(albumQuota.Int64))
+		}
+	}
+	return nil
+}
+
+var byteUnits = []string{"B", "KB", "MB", "GB", "TB"}
+
+// formats a number of bytes for people, e.g. 1536 -> "1.5 KB"
+func formatBytes(n int64) string {
+	f := float64(n)
+	unit := 0
+	for f >= 1024 && unit < len(byteUnits)-1 {
+		f /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d B", n)
+	}
+	return fmt.Sprintf("%.1f %s", f, byteUnits[unit])
+}
+
+// parses sizes like "500MB", "2 GB" or "1024", where units are powers of 1024
+func parseBytes(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for i := len(byteUnits) - 1; i > 0; i-- {
+		if strings.HasSuffix(s, byteUnits[i]) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, byteUnits[i]))
+			multiplier = int64(1) << (10 * i)
+			break
+		}
+	}
+	s = strings.TrimSpace(strings.TrimSuffix(s, "B"))
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("failed to parse size %q", s)
+	}
+	return int64(f * float64(multiplier)), nil
+}
+
+// sets the quota of a user or an album: quota -user <email> 10GB, quota -album <id> 500MB, or "none" to remove it.
+// Without arguments it lists how much every user is using
+func quotaCommand(args []string, db *sql.DB) error {
+	fs := flag.NewFlagSet("quota", flag.ExitOnError)
+	email := fs.String("user", "", "email of the user to set the quota of")
+	albumID := fs.Int64("album", 0, "id of the album to set the quota of")
+	fs.Parse(args)
+	if len(args) == 0 {
+		return listUsage(db)
+	}
+	if fs.NArg() != 1 || (*email == "") == (*albumID == 0) {
+		return fmt.Errorf("usage: quota (-user <email> | -album <id>) <size|none>")
+	}
+
+	var quota sql.NullInt64
+	if fs.Arg(0) != "none" {
+		n, err := parseBytes(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		quota = sql.NullInt64{Int64: n, Valid: true}
+	}
+
+	var res sql.Result
+	var err error
+	if *email != "" {
+		res, err = db.Exec("UPDATE users SET quota_bytes = ? WHERE email = ?", quota, *email)
+	} else {
+		res, err = db.Exec("UPDATE albums SET quota_bytes = ? WHERE id = ?", quota, *albumID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to set quota: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("no such user or album")
+	}
+	return nil
+}
+
+// prints the storage used by every user next to their quota
+func listUsage(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT id, email FROM users ORDER BY id")
+	if err != nil {
+		return fmt.Errorf("failed to get users: %w", err)
+	}
+	type user struct {
+		id    int64
+		email string
+	}
+	users := make([]user, 0)
+	for rows.Next() {
+		var u user
+		if err := rows.Scan(&u.id, &u.email); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan user: %w", err)
+		}
+		users = append(users, u)
+	}
+	rows.Close()
+
+	for _, u := range users {
+		used, err := userUsage(u.id, tx)
+		if err != nil {
+			return err
+		}
+		quota, err := userQuota(u.id, tx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s\t%s of %s\n", u.email, formatBytes(used), formatQuota(quota))
+	}
+	return nil
+}
+
+// formats a quota, where 0 means there isn't one
+func formatQuota(n int64) string {
+	if n == 0 {
+		return "unlimited"
+	}
+	return formatBytes(n)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"html"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+// search goes through two FTS5 indexes kept up to date by triggers (see migrations/0011_search.up.sql):
+// photo_search: rowid = photo id|title|caption|alt_text|filename|keywords|tags	album_search: rowid = album id|name|description
+// where tags holds the emails of the users tagged in the photo. The index has everything in it, so every query joins
+// back to the albums the user can access and leaves out the trash
+
+// searchLimit is the most photos or albums a search returns
+const searchLimit = 100
+
+// FTS5 puts these around matched words in highlight() and snippet(). They can't appear in what people type, so the
+// text can be escaped for html and the markers swapped for <mark> afterwards
+const (
+	matchStart = "\x02"
+	matchEnd   = "\x03"
+)
+
+var markReplacer = strings.NewReplacer(matchStart, "<mark>", matchEnd, "</mark>")
+
+// photoResult is a photo found by a search, with its matches marked
+type photoResult struct {
+	photoInfo
+	Match   template.HTML // the title with matches marked
+	Snippet template.HTML // the part of the photo's text that matched best
+}
+
+// albumResult is an album found by a search, with its matches marked
+type albumResult struct {
+	ID      int64
+	CoverID int64
+	Match   template.HTML
+	Snippet template.HTML
+}
+
+type searchpage struct {
+	UserID int64
+	Query  string
+	Albums []albumResult
+	Photos []photoResult
+}
+
+func (s searchpage) render(w http.ResponseWriter) error {
+	return templates.ExecuteTemplate(w, "search.html", s)
+}
+
+// ftsQuery turns what was typed in the search box into an FTS5 query matching everything in it: "quoted words" are
+// phrases, a word ending in * matches words starting with it, and anything else is quoted so FTS5's own syntax (AND,
+// NEAR, column:, ...) can't make a query fail. Returns "" if there's nothing to search for
+func ftsQuery(q string) string {
+	terms := make([]string, 0)
+	quote := func(s string) string {
+		return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+	}
+	add := func(word string, phrase bool) {
+		prefix := !phrase && strings.HasSuffix(word, "*")
+		word = strings.TrimRight(word, "*")
+		// words that are nothing but punctuation match nothing and would make FTS5 complain
+		if strings.IndexFunc(word, func(r rune) bool { return unicode.IsLetter(r) || unicode.IsNumber(r) }) < 0 {
+			return
+		}
+		term := quote(word)
+		if prefix {
+			term += "*"
+		}
+		terms = append(terms, term)
+	}
+	for rest := strings.TrimSpace(q); rest != ""; rest = strings.TrimSpace(rest) {
+		if strings.HasPrefix(rest, `"`) {
+			phrase, after, _ := strings.Cut(rest[1:], `"`)
+			add(phrase, true)
+			rest = after
+			continue
+		}
+		end := strings.IndexFunc(rest, unicode.IsSpace)
+		if end < 0 {
+			end = len(rest)
+		}
+		add(rest[:end], false)
+		rest = rest[end:]
+	}
+	return strings.Join(terms, " ")
+}
+
+// highlighted escapes text from highlight() or snippet() for html and marks the matches in it
+func highlighted(s string) template.HTML {
+	return template.HTML(markReplacer.Replace(html.EscapeString(s)))
+}
+
+// searchPhotos finds the photos matching an FTS5 query in albums userID can access, best matches first
+func searchPhotos(match string, userID int64, tx *sql.Tx) ([]photoResult, error) {
+	rows, err := tx.Query("SELECT photos.id, photos.title, photos.caption, photos.alt_text, "+
+		"highlight(photo_search, 0, char(2), char(3)), snippet(photo_search, -1, char(2), char(3), '…', 12) "+
+		"FROM photo_search JOIN photos ON photos.id = photo_search.rowid "+
+		"WHERE photo_search MATCH ? AND photos.trashed_at IS NULL AND photos.id IN (SELECT photo_id FROM album_photos "+
+		"JOIN albums ON albums.id = album_photos.album_id WHERE albums.trashed_at IS NULL "+
+		"AND (albums.user_id = ? OR albums.id IN (SELECT album_id FROM album_permissions WHERE user_id = ?))) "+
+		"ORDER BY rank LIMIT ?", match, userID, userID, searchLimit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search photos: %w", err)
+	}
+	defer rows.Close()
+	photos := make([]photoResult, 0)
+	for rows.Next() {
+		var p photoResult
+		var title, snippet string
+		if err := rows.Scan(&p.ID, &p.Title, &p.Caption, &p.AltText, &title, &snippet); err != nil {
+			return nil, fmt.Errorf("failed to scan photo: %w", err)
+		}
+		p.Match, p.Snippet = highlighted(title), highlighted(snippet)
+		photos = append(photos, p)
+	}
+	return photos, rows.Err()
+}
+
+// searchAlbums finds the albums matching an FTS5 query that userID can access, best matches first
+func searchAlbums(match string, userID int64, tx *sql.Tx) ([]albumResult, error) {
+	rows, err := tx.Query("SELECT albums.id, "+albumCoverSQL+", "+
+		"highlight(album_search, 0, char(2), char(3)), snippet(album_search, 1, char(2), char(3), '…', 12) "+
+		"FROM album_search JOIN albums ON albums.id = album_search.rowid "+
+		"WHERE album_search MATCH ? AND albums.trashed_at IS NULL "+
+		"AND (albums.user_id = ? OR albums.id IN (SELECT album_id FROM album_permissions WHERE user_id = ?)) "+
+		"ORDER BY rank LIMIT ?", match, userID, userID, searchLimit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search albums: %w", err)
+	}
+	defer rows.Close()
+	albums := make([]albumResult, 0)
+	for rows.Next() {
+		var a albumResult
+		var name, snippet string
+		if err := rows.Scan(&a.ID, &a.CoverID, &name, &snippet); err != nil {
+			return nil, fmt.Errorf("failed to scan album: %w", err)
+		}
+		a.Match, a.Snippet = highlighted(name), highlighted(snippet)
+		albums = append(albums, a)
+	}
+	return albums, rows.Err()
+}
+
+// finds the albums and photos the user can see whose text matches the query q. Queries with filters go to /query/
+func searchHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	userID, err := checkSesh(w, r, db)
+	if err != nil {
+		log.Printf("failed to validate user session: %s", err)
+		return
+	}
+
+	// filters are for /query/
+	if pq, err := parseQuery(r.FormValue("q"), userID); err != nil || pq.filtered() {
+		http.Redirect(w, r, queryURL(r.FormValue("q")), http.StatusFound)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("failed to begin transaction: %s", err)
+		return
+	}
+	defer tx.Rollback()
+
+	s := searchpage{UserID: userID, Query: r.FormValue("q"), Albums: make([]albumResult, 0), Photos: make([]photoResult, 0)}
+	if match := ftsQuery(s.Query); match != "" {
+		if s.Albums, err = searchAlbums(match, userID, tx); err == nil {
+			s.Photos, err = searchPhotos(match, userID, tx)
+		}
+		if err != nil {
+			log.Printf("%s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("%s", err)
+	}
+	if err := s.render(w); err != nil {
+		log.Printf("failed to render html: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// a smart album is an album whose albums.query holds a query (see query.go) that picks its photos, like
+// tagged:grandma, so it keeps up as photos come and go. The query runs with the access of the album's owner, and the
+// album is shared like any other through album_permissions: the people it's shared with see what it finds for the
+// owner among the photos they could already see themselves. Nothing can be put in or taken out of a smart album by
+// hand, which a trigger on album_photos enforces, so smart albums are left out wherever photos are added to albums,
+// like uploads over WebDAV, sync and restoring photos
+
+// smartAlbumLimit is the most photos a smart album shows
+const smartAlbumLimit = 1000
+
+// checks a smart album's query parses for its owner
+func checkAlbumQuery(query string, userID int64) error {
+	if strings.TrimSpace(query) == "" {
+		return fmt.Errorf("a smart album needs a query")
+	}
+	if _, err := parseQuery(query, userID); err != nil {
+		return fmt.Errorf("bad query: %w", err)
+	}
+	return nil
+}
+
+// newSmartAlbum creates an album of the photos query finds for userID
+func newSmartAlbum(name string, query string, userID int64, tx *sql.Tx) (int64, error) {
+	if err := checkAlbumQuery(query, userID); err != nil {
+		return 0, err
+	}
+	albumID, err := newAlbum(name, userID, tx)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("UPDATE albums SET query = ? WHERE id = ?", query, albumID); err != nil {
+		return 0, fmt.Errorf("failed to save query of album %v: %w", albumID, err)
+	}
+	return albumID, nil
+}
+
+// setAlbumQuery changes the query of a smart album. Regular albums can't be turned into smart ones
+func setAlbumQuery(albumID int64, query string, tx *sql.Tx) error {
+	owner, err := store.WithTx(tx).AlbumOwner(albumID)
+	if err != nil {
+		return err
+	}
+	if err := checkAlbumQuery(query, owner); err != nil {
+		return err
+	}
+	res, err := tx.Exec("UPDATE albums SET query = ? WHERE id = ? AND query IS NOT NULL", query, albumID)
+	if err != nil {
+		return fmt.Errorf("failed to save query of album %v: %w", albumID, err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("album %v isn't a smart album", albumID)
+	}
+	return nil
+}
+
+// smartAlbumQuery returns the query of a smart album as viewerID runs it: what it finds for the owner, out of the
+// photos viewerID can see
+func smartAlbumQuery(albumID int64, viewerID int64, tx *sql.Tx) (photoQuery, error) {
+	var owner int64
+	var query sql.NullString
+	if err := tx.QueryRow("SELECT user_id, query FROM albums WHERE id = ?", albumID).Scan(&owner, &query); err != nil {
+		return photoQuery{}, fmt.Errorf("failed to get query of album %v: %w", albumID, err)
+	}
+	if !query.Valid {
+		return photoQuery{}, fmt.Errorf("album %v isn't a smart album", albumID)
+	}
+	pq, err := parseQuery(query.String, owner)
+	if err != nil {
+		return photoQuery{}, fmt.Errorf("failed to parse query of album %v: %w", albumID, err)
+	}
+	return pq.visibleTo(viewerID), nil
+}
+
+// smartAlbumPhotos returns the photos in a smart album viewerID can see, newest first
+func smartAlbumPhotos(albumID int64, viewerID int64, tx *sql.Tx) ([]queryPhoto, error) {
+	pq, err := smartAlbumQuery(albumID, viewerID, tx)
+	if err != nil {
+		return nil, err
+	}
+	return runQuery(pq, smartAlbumLimit, tx)
+}
+
+// smartAlbumCards returns the card the home page shows for each of userID's smart albums out of the trash, by id.
+// It counts the photos rather than fetching them, since the home page runs on the write pool
+func smartAlbumCards(userID int64, tx *sql.Tx) (map[int64]albumInfo, error) {
+	ids, err := queryIDs(tx, "SELECT id FROM albums WHERE user_id = ? AND trashed_at IS NULL AND query IS NOT NULL", userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get smart albums of user %v: %w", userID, err)
+	}
+	cards := make(map[int64]albumInfo)
+	for _, id := range ids {
+		pq, err := smartAlbumQuery(id, userID, tx)
+		if err != nil {
+			return nil, err
+		}
+		card := albumInfo{ID: id, Smart: true}
+		if card.Count, err = countQuery(pq, tx); err != nil {
+			return nil, err
+		}
+		card.Count = min(card.Count, smartAlbumLimit)
+		cover, err := runQuery(pq, 1, tx)
+		if err != nil {
+			return nil, err
+		}
+		if len(cover) > 0 {
+			card.CoverID = cover[0].ID
+		}
+		cards[id] = card
+	}
+	return cards, nil
+}
+
+// renderSmartAlbum shows a smart album to the people it's shared with. It's called by albumHandler with the
+// album's details filled in
+func renderSmartAlbum(w http.ResponseWriter, a albumpage, sessionUserID int64, tx *sql.Tx) error {
+	// a smart album shows photos from the owner's other albums, so unlike a regular album only the people it's
+	// shared with can see it, and they only see photos from albums they have access to
+	if !checkPerm(a.AlbumID, sessionUserID, tx) {
+		http.Error(w, "you don't have permission to see this album", http.StatusForbidden)
+		return nil
+	}
+	photos, err := smartAlbumPhotos(a.AlbumID, sessionUserID, tx)
+	if err != nil {
+		return err
+	}
+	a.CanEdit, a.SortMode, a.Photos = false, "", make([]photoInfo, 0)
+	for _, p := range photos {
+		a.Photos = append(a.Photos, photoInfo{ID: p.ID, Title: p.Title, Caption: p.Caption, AltText: p.AltText})
+	}
+	if len(photos) > 0 {
+		a.CoverID = photos[0].ID
+		a.From, a.To = formatDate(photos[len(photos)-1].TakenAt), formatDate(photos[0].TakenAt)
+	}
+	return templates.ExecuteTemplate(w, "album.html", a)
+}
+
+// creates a smart album from a POSTed name and query
+func smartAlbumHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	userID, err := checkSesh(w, r, db)
+	if err != nil {
+		log.Printf("failed to validate user session: %s", err)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, path.Join("/home/", strconv.FormatInt(userID, 10)), http.StatusFound)
+		return
+	}
+	name, query := strings.TrimSpace(r.PostFormValue("name")), r.PostFormValue("q")
+	if name == "" {
+		name = query
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("failed to begin transaction: %s", err)
+		return
+	}
+	defer tx.Rollback()
+
+	albumID, err := newSmartAlbum(name, query, userID, tx)
+	if err != nil {
+		log.Printf("failed to create smart album: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("%s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, path.Join("/album/", strconv.FormatInt(albumID, 10)), http.StatusFound)
+}
+
+// changes the query of a smart album to a POSTed one, for the album's owner
+func albumQueryHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	userID, err := checkSesh(w, r, db)
+	if err != nil {
+		log.Printf("failed to validate user session: %s", err)
+		return
+	}
+
+	id := path.Base(r.URL.Path)
+	albumID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		log.Printf("failed to get id of album to change the query of: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, path.Join("/album/", id), http.StatusFound)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("failed to begin transaction: %s", err)
+		return
+	}
+	defer tx.Rollback()
+
+	if !checkOwner(albumID, userID, tx) {
+		log.Printf("user %v can't change the query of album %v", userID, albumID)
+		http.Error(w, "only the album's owner can change its query", http.StatusForbidden)
+		return
+	}
+	if err := setAlbumQuery(albumID, r.PostFormValue("q"), tx); err != nil {
+		log.Printf("%s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("%s", err)
+	}
+	http.Redirect(w, r, path.Join("/album/", id), http.StatusFound)
+}
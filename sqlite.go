@@ -0,0 +1,57 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// SQLite lets one connection write at a time, and with its default rollback journal readers and the writer wait on
+// each other too, which under parallel uploads ends in "database is locked". The server opens the database in WAL
+// mode, where readers don't block the writer or each other, as two pools: query-only connections for the pages that
+// only look at things, and a single connection for everything that writes. The write pool is the queue mutations go
+// through: database/sql hands its connection to one transaction at a time and the others wait their turn in Go
+// instead of on SQLite's lock. Write transactions begin immediately, taking the lock up front rather than failing
+// when a read turns into a write part way through, and the busy timeout covers other processes, like admin
+// commands, holding the lock for a moment. Search uses SQLite's FTS5, which go-sqlite3 only compiles in when built
+// with -tags sqlite_fts5 (go build -tags sqlite_fts5, go test -tags sqlite_fts5 ./...). Without it the migrations
+// fail, and a plain go test skips the tests that need a database
+
+// sqliteBusyTimeout is how long a connection waits for another process to let go of the database
+const sqliteBusyTimeout = 5 * time.Second
+
+// sqliteDSN adds the options every SQLite connection needs to a database path. SQLite only enforces foreign keys
+// when asked to, on each connection
+func sqliteDSN(dbPath string) string {
+	sep := "?"
+	if strings.Contains(dbPath, "?") {
+		sep = "&"
+	}
+	return fmt.Sprintf("%s%s_foreign_keys=on&_busy_timeout=%d", dbPath, sep, sqliteBusyTimeout.Milliseconds())
+}
+
+// openSQLite opens the database at dbPath as a pool for reading and a single connection for writing
+func openSQLite(dbPath string) (read *sql.DB, write *sql.DB, err error) {
+	write, err = sql.Open("sqlite3", sqliteDSN(dbPath)+"&_journal_mode=WAL&_synchronous=NORMAL&_txlock=immediate")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open database for writing: %w", err)
+	}
+	write.SetMaxOpenConns(1)
+	// the write connection switches the database to WAL before any reader opens it, after that it stays in WAL
+	if err = write.Ping(); err != nil {
+		write.Close()
+		return nil, nil, fmt.Errorf("failed to open database for writing: %w", err)
+	}
+
+	read, err = sql.Open("sqlite3", sqliteDSN(dbPath)+"&_query_only=on")
+	if err != nil {
+		write.Close()
+		return nil, nil, fmt.Errorf("failed to open database for reading: %w", err)
+	}
+	readers := max(4, runtime.NumCPU())
+	read.SetMaxOpenConns(readers)
+	read.SetMaxIdleConns(readers)
+	return read, write, nil
+}
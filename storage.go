@@ -0,0 +1,114 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// photo files and rows have to change together. New files are written to a temporary file in the photo directory,
+// synced and renamed into place before the row that points to them is committed, and removed again if the commit
+// fails. Deleting a photo row queues its file in file_cleanup: path|queued_at through a trigger, in the same
+// transaction as the delete, and the file is only removed from disk once that has committed, so the database never
+// points at a missing file
+
+// writeFileAtomic copies src to dst through a temporary file in dst's directory, so dst either doesn't exist or
+// holds all of src, even if the program dies part way through. It returns the number of bytes written
+func writeFileAtomic(dst string, src io.Reader) (int64, error) {
+	tmp, n, err := stageFile(filepath.Dir(dst), src)
+	if err != nil {
+		return 0, err
+	}
+	// after a successful rename there's nothing left at tmp and this is a no-op
+	defer os.Remove(tmp)
+	if err := placeFile(tmp, dst); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+// stageFile copies src to a new temporary file in dir and syncs it to disk. It returns the file's path, which the
+// caller removes or moves into place with placeFile, and the number of bytes written
+func stageFile(dir string, src io.Reader) (string, int64, error) {
+	tmp, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	n, err := io.Copy(tmp, src)
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", 0, fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", 0, fmt.Errorf("failed to sync temporary file: %w", err)
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", 0, fmt.Errorf("failed to close temporary file: %w", err)
+	}
+	return tmp.Name(), n, nil
+}
+
+// placeFile moves a file written by stageFile to dst in the same directory
+func placeFile(tmp string, dst string) error {
+	if err := os.Rename(tmp, dst); err != nil {
+		return fmt.Errorf("failed to move temporary file to %s: %w", dst, err)
+	}
+	// the rename itself is only durable once the directory is synced
+	d, err := os.Open(filepath.Dir(dst))
+	if err != nil {
+		return fmt.Errorf("failed to open photo directory: %w", err)
+	}
+	defer d.Close()
+	if err = d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync photo directory: %w", err)
+	}
+	return nil
+}
+
+// drainCleanup removes the files in the cleanup queue. Files that can't be removed stay queued and are retried on
+// the next run
+func drainCleanup(db *sql.DB) error {
+	rows, err := db.Query("SELECT rowid, path FROM file_cleanup")
+	if err != nil {
+		return fmt.Errorf("failed to read cleanup queue: %w", err)
+	}
+	type queued struct {
+		id   int64
+		path string
+	}
+	files := make([]queued, 0)
+	for rows.Next() {
+		var q queued
+		if err := rows.Scan(&q.id, &q.path); err != nil {
+			rows.Close()
+			return fmt.Errorf("failed to scan cleanup queue: %w", err)
+		}
+		files = append(files, q)
+	}
+	rows.Close()
+
+	for _, q := range files {
+		// a file can't be removed while a live row still points at it, e.g. if a delete was rolled back by hand
+		var n int
+		if err := db.QueryRow("SELECT count(*) FROM photos WHERE path = ?", q.path).Scan(&n); err != nil {
+			return fmt.Errorf("failed to check for photos at %s: %w", q.path, err)
+		}
+		if n == 0 {
+			if err := os.Remove(q.path); err != nil && !os.IsNotExist(err) {
+				log.Printf("failed to remove %s, will retry: %s", q.path, err)
+				continue
+			}
+		}
+		if _, err := db.Exec("DELETE FROM file_cleanup WHERE rowid = ?", q.id); err != nil {
+			return fmt.Errorf("failed to dequeue %s: %w", q.path, err)
+		}
+	}
+	return nil
+}
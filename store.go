@@ -0,0 +1,361 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Store holds the users, albums, photos, tags, permissions and sessions of the app, so the code working with them
+// doesn't depend on the database behind it. SQLite is the only implementation. The queries behind pages, trash,
+// quotas, search, fsck, export, sync and memories, which join across most of these tables, are still written
+// directly against SQLite (INSERT OR IGNORE, FTS5, text dates), and have to move behind Store before another database
+// like PostgreSQL can be added
+type Store interface {
+	// WithTx returns a Store that does everything as part of tx
+	WithTx(tx *sql.Tx) Store
+
+	CreateUser(email string, passwordHash string) (int64, error)
+	// returns the id and password hash of the user with the given email, or sql.ErrNoRows
+	UserByEmail(email string) (int64, string, error)
+	SetPassword(userID int64, passwordHash string) error
+	// a disabled user's sessions are ended and they can't log in again until they're enabled
+	SetDisabled(userID int64, disabled bool) error
+	UserDisabled(userID int64) (bool, error)
+	// deletes the user along with everything they own
+	DeleteUser(userID int64) error
+
+	CreateAlbum(userID int64, name string) (int64, error)
+	AlbumOwner(albumID int64) (int64, error)
+	RenameAlbum(albumID int64, name string) error
+	SetAlbumDescription(albumID int64, description string) error
+
+	CreatePhoto(userID int64, filename string) (int64, error)
+	PhotoDetails(photoID int64) (photoDetails, error)
+	SetPhotoDetails(photoID int64, d photoDetails) error
+	PhotoFile(photoID int64) (photoFile, error)
+	SetPhotoFile(photoID int64, f photoFile) error
+
+	AddTag(photoID int64, userID int64) error
+	// returns the emails of the users tagged in a photo
+	PhotoTags(photoID int64) ([]string, error)
+	TaggedPhotos(userID int64) ([]int64, error)
+	TaggedAlbums(userID int64) ([]int64, error)
+
+	HasPermission(albumID int64, userID int64) (bool, error)
+	HasRole(albumID int64, userID int64, role string) (bool, error)
+	GrantPermission(albumID int64, userID int64, role string) error
+	RevokePermission(albumID int64, userID int64) error
+	SetAlbumOwner(albumID int64, userID int64) error
+
+	CreateSession(userID int64, sessionID string) error
+	// returns the user the session belongs to, or sql.ErrNoRows if there's no such session or the user is disabled
+	SessionUser(sessionID string) (int64, error)
+	DeleteSession(sessionID string) error
+}
+
+// photoDetails is what people write about a photo
+type photoDetails struct {
+	Title   string
+	Caption string
+	AltText string
+	// space separated words to find the photo by in search
+	Keywords string
+}
+
+// photoFile is where and how a photo is stored
+type photoFile struct {
+	Path       string
+	Checksum   string
+	Size       int64
+	Key        blobKey
+	UploadedAt string
+}
+
+// store is what the handlers use, set up in main for the database given by -db
+var store Store
+
+// querier is what *sql.DB and *sql.Tx have in common
+type querier interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// sqlStore implements Store on SQLite
+type sqlStore struct {
+	q querier
+}
+
+func newSQLiteStore(db *sql.DB) Store {
+	return sqlStore{q: db}
+}
+
+func (s sqlStore) WithTx(tx *sql.Tx) Store {
+	return sqlStore{q: tx}
+}
+
+func (s sqlStore) exec(query string, args ...interface{}) error {
+	_, err := s.q.Exec(query, args...)
+	return err
+}
+
+func (s sqlStore) queryRow(query string, args ...interface{}) *sql.Row {
+	return s.q.QueryRow(query, args...)
+}
+
+// runs an INSERT ... RETURNING id and returns the id
+func (s sqlStore) insert(query string, args ...interface{}) (int64, error) {
+	var id int64
+	err := s.queryRow(query+" RETURNING id", args...).Scan(&id)
+	return id, err
+}
+
+// runs a query selecting one id column
+func (s sqlStore) ids(query string, args ...interface{}) ([]int64, error) {
+	rows, err := s.q.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (s sqlStore) CreateUser(email string, passwordHash string) (int64, error) {
+	id, err := s.insert("INSERT INTO users (email, password) VALUES (?, ?)", email, passwordHash)
+	if err != nil {
+		return 0, fmt.Errorf("failed to add user: %w", err)
+	}
+	return id, nil
+}
+
+func (s sqlStore) UserByEmail(email string) (int64, string, error) {
+	var id int64
+	var hash string
+	err := s.queryRow("SELECT id, password FROM users WHERE email = ?", email).Scan(&id, &hash)
+	return id, hash, err
+}
+
+func (s sqlStore) SetPassword(userID int64, passwordHash string) error {
+	if err := s.exec("UPDATE users SET password = ? WHERE id = ?", passwordHash, userID); err != nil {
+		return fmt.Errorf("failed to set password of user %v: %w", userID, err)
+	}
+	return nil
+}
+
+func (s sqlStore) SetDisabled(userID int64, disabled bool) error {
+	var err error
+	if disabled {
+		err = s.exec("UPDATE users SET disabled_at = COALESCE(disabled_at, ?) WHERE id = ?", time.Now().UTC().Format(timeLayout), userID)
+		if err == nil {
+			err = s.exec("DELETE FROM sessions WHERE user_id = ?", userID)
+		}
+	} else {
+		err = s.exec("UPDATE users SET disabled_at = NULL WHERE id = ?", userID)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to change whether user %v is disabled: %w", userID, err)
+	}
+	return nil
+}
+
+func (s sqlStore) UserDisabled(userID int64) (bool, error) {
+	var disabledAt sql.NullString
+	if err := s.queryRow("SELECT disabled_at FROM users WHERE id = ?", userID).Scan(&disabledAt); err != nil {
+		return false, fmt.Errorf("failed to check whether user %v is disabled: %w", userID, err)
+	}
+	return disabledAt.Valid, nil
+}
+
+func (s sqlStore) DeleteUser(userID int64) error {
+	if err := s.exec("DELETE FROM users WHERE id = ?", userID); err != nil {
+		return fmt.Errorf("failed to delete user %v: %w", userID, err)
+	}
+	return nil
+}
+
+func (s sqlStore) CreateAlbum(userID int64, name string) (int64, error) {
+	id, err := s.insert("INSERT INTO albums (user_id, name) VALUES (?, ?)", userID, name)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create album: %w", err)
+	}
+	return id, nil
+}
+
+func (s sqlStore) AlbumOwner(albumID int64) (int64, error) {
+	var ownerID int64
+	if err := s.queryRow("SELECT user_id FROM albums WHERE id = ?", albumID).Scan(&ownerID); err != nil {
+		return 0, fmt.Errorf("failed to get owner of album %v: %w", albumID, err)
+	}
+	return ownerID, nil
+}
+
+func (s sqlStore) RenameAlbum(albumID int64, name string) error {
+	if err := s.exec("UPDATE albums SET name = ? WHERE id = ?", name, albumID); err != nil {
+		return fmt.Errorf("failed to rename album %v: %w", albumID, err)
+	}
+	return nil
+}
+
+func (s sqlStore) SetAlbumDescription(albumID int64, description string) error {
+	if err := s.exec("UPDATE albums SET description = ? WHERE id = ?", description, albumID); err != nil {
+		return fmt.Errorf("failed to update description of album %v: %w", albumID, err)
+	}
+	return nil
+}
+
+func (s sqlStore) CreatePhoto(userID int64, filename string) (int64, error) {
+	id, err := s.insert("INSERT INTO photos (user_id, filename) VALUES (?, ?)", userID, filename)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert photo: %w", err)
+	}
+	return id, nil
+}
+
+func (s sqlStore) PhotoDetails(photoID int64) (photoDetails, error) {
+	var d photoDetails
+	err := s.queryRow("SELECT title, caption, alt_text, keywords FROM photos WHERE id = ?", photoID).Scan(&d.Title, &d.Caption, &d.AltText, &d.Keywords)
+	if err != nil {
+		return d, fmt.Errorf("failed to get details of photo %v: %w", photoID, err)
+	}
+	return d, nil
+}
+
+func (s sqlStore) SetPhotoDetails(photoID int64, d photoDetails) error {
+	err := s.exec("UPDATE photos SET title = ?, caption = ?, alt_text = ?, keywords = ? WHERE id = ?", d.Title, d.Caption, d.AltText, d.Keywords, photoID)
+	if err != nil {
+		return fmt.Errorf("failed to update details of photo %v: %w", photoID, err)
+	}
+	return nil
+}
+
+func (s sqlStore) PhotoFile(photoID int64) (photoFile, error) {
+	var f photoFile
+	var filePath, keyID sql.NullString
+	var wrapped []byte
+	err := s.queryRow("SELECT path, checksum, size, key_id, wrapped_key, uploaded_at FROM photos WHERE id = ?", photoID).
+		Scan(&filePath, &f.Checksum, &f.Size, &keyID, &wrapped, &f.UploadedAt)
+	if err != nil {
+		return f, fmt.Errorf("failed to get file of photo %v: %w", photoID, err)
+	}
+	f.Path, f.Key = filePath.String, scanBlobKey(keyID, wrapped)
+	return f, nil
+}
+
+func (s sqlStore) SetPhotoFile(photoID int64, f photoFile) error {
+	err := s.exec("UPDATE photos SET path = ?, checksum = ?, size = ?, key_id = NULLIF(?, ''), wrapped_key = ? WHERE id = ?",
+		f.Path, f.Checksum, f.Size, f.Key.ID, f.Key.Wrapped, photoID)
+	if err != nil {
+		return fmt.Errorf("failed to add path to photo table: %w", err)
+	}
+	return nil
+}
+
+func (s sqlStore) AddTag(photoID int64, userID int64) error {
+	if err := s.exec("INSERT INTO tags (photo_id, user_id) VALUES (?, ?)", photoID, userID); err != nil {
+		return fmt.Errorf("failed to tag user %v in photo %v: %w", userID, photoID, err)
+	}
+	return nil
+}
+
+func (s sqlStore) PhotoTags(photoID int64) ([]string, error) {
+	rows, err := s.q.Query("SELECT email FROM users JOIN tags ON users.id = tags.user_id WHERE tags.photo_id = ? ORDER BY email", photoID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get tagged users: %w", err)
+	}
+	defer rows.Close()
+	emails := make([]string, 0)
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			return nil, fmt.Errorf("failed to scan tagged user: %w", err)
+		}
+		emails = append(emails, email)
+	}
+	return emails, rows.Err()
+}
+
+func (s sqlStore) TaggedPhotos(userID int64) ([]int64, error) {
+	ids, err := s.ids("SELECT DISTINCT photo_id FROM tags WHERE user_id = ? ORDER BY photo_id", userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to access photo tags: %w", err)
+	}
+	return ids, nil
+}
+
+func (s sqlStore) TaggedAlbums(userID int64) ([]int64, error) {
+	ids, err := s.ids("SELECT DISTINCT album_id FROM album_photos JOIN tags ON album_photos.photo_id = tags.photo_id "+
+		"WHERE tags.user_id = ? ORDER BY album_id", userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to access tagged albums: %w", err)
+	}
+	return ids, nil
+}
+
+func (s sqlStore) HasPermission(albumID int64, userID int64) (bool, error) {
+	var n int
+	err := s.queryRow("SELECT count(*) FROM album_permissions WHERE album_id = ? AND user_id = ?", albumID, userID).Scan(&n)
+	if err != nil {
+		return false, fmt.Errorf("failed to access album_permissions: %w", err)
+	}
+	return n > 0, nil
+}
+
+func (s sqlStore) HasRole(albumID int64, userID int64, role string) (bool, error) {
+	var n int
+	err := s.queryRow("SELECT count(*) FROM album_permissions WHERE album_id = ? AND user_id = ? AND role = ?", albumID, userID, role).Scan(&n)
+	if err != nil {
+		return false, fmt.Errorf("failed to access album_permissions: %w", err)
+	}
+	return n > 0, nil
+}
+
+func (s sqlStore) GrantPermission(albumID int64, userID int64, role string) error {
+	if err := s.exec("INSERT INTO album_permissions (album_id, user_id, role) VALUES (?, ?, ?)", albumID, userID, role); err != nil {
+		return fmt.Errorf("failed to give permission: %w", err)
+	}
+	return nil
+}
+
+func (s sqlStore) RevokePermission(albumID int64, userID int64) error {
+	if err := s.exec("DELETE FROM album_permissions WHERE album_id = ? AND user_id = ?", albumID, userID); err != nil {
+		return fmt.Errorf("failed to take away permission: %w", err)
+	}
+	return nil
+}
+
+func (s sqlStore) SetAlbumOwner(albumID int64, userID int64) error {
+	if err := s.exec("UPDATE albums SET user_id = ? WHERE id = ?", userID, albumID); err != nil {
+		return fmt.Errorf("failed to change owner of album %v: %w", albumID, err)
+	}
+	return nil
+}
+
+func (s sqlStore) CreateSession(userID int64, sessionID string) error {
+	if err := s.exec("INSERT INTO sessions (user_id, session_id) VALUES (?, ?)", userID, sessionID); err != nil {
+		return fmt.Errorf("failed to insert session id into database: %w", err)
+	}
+	return nil
+}
+
+func (s sqlStore) SessionUser(sessionID string) (int64, error) {
+	var userID int64
+	err := s.queryRow("SELECT user_id FROM sessions JOIN users ON users.id = sessions.user_id "+
+		"WHERE session_id = ? AND disabled_at IS NULL", sessionID).Scan(&userID)
+	return userID, err
+}
+
+func (s sqlStore) DeleteSession(sessionID string) error {
+	if err := s.exec("DELETE FROM sessions WHERE session_id = ?", sessionID); err != nil {
+		return fmt.Errorf("failed to delete session: %w", err)
+	}
+	return nil
+}
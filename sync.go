@@ -0,0 +1,729 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// photoapp sync keeps a folder in step with the albums a user can see: every folder in it is an album and every
+// photo in a folder is a photo in that album. Triggers record every change to albums and to which photos they hold
+// in changes: id!|album_id|photo_id|changed_at, and /changes/ lists the ones a user can see since a cursor (the last
+// change id they've seen), each with what the album or photo is like now. The client keeps a manifest in the folder
+// with its cursor, which folder is which album and the checksum of every file as last synced. A sync first pulls
+// changes from the server, then pushes the ones made locally:
+//   - a photo added on the server is downloaded, one removed is deleted locally unless it was changed locally
+//   - a file added locally is uploaded, one deleted locally is removed from its album, and one changed locally is
+//     uploaded as a new photo in place of the old one
+//   - when the server and the folder both changed the same file, the local file is kept and uploaded as a new photo,
+//     and when a downloaded photo would overwrite a file that isn't synced it's saved next to it instead
+//
+// Photos on the server never change their content, so the only conflicts are between a change on one side and a
+// removal or a different file of the same name on the other. Deleting a folder locally empties the album but
+// leaves it on the server
+
+// syncManifestName is where in the synced folder the client keeps its manifest
+const syncManifestName = ".photoapp-sync.json"
+
+// changeLimit is how many changes /changes/ returns at most
+const changeLimit = 500
+
+// change is a change to an album, or to a photo in it if PhotoID is set, along with what it's like now
+type change struct {
+	Cursor   int64  `json:"cursor"`
+	AlbumID  int64  `json:"album_id"`
+	Album    string `json:"album"`
+	PhotoID  int64  `json:"photo_id,omitempty"`
+	Filename string `json:"filename,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+	// the album is in the trash, or the photo isn't in the album anymore
+	Deleted bool `json:"deleted"`
+}
+
+// changeFeed is what /changes/ returns. Cursor is where to carry on from, and More is set if there are changes
+// after it already
+type changeFeed struct {
+	Cursor  int64    `json:"cursor"`
+	More    bool     `json:"more"`
+	Changes []change `json:"changes"`
+}
+
+// listChanges returns the changes after cursor in albums userID owns or was given permission to, only those to
+// albumID unless it's 0. Smart albums aren't synced, nothing can be added to them
+func listChanges(userID int64, cursor int64, albumID int64, limit int, tx *sql.Tx) (changeFeed, error) {
+	feed := changeFeed{Cursor: cursor, Changes: make([]change, 0)}
+	query := "SELECT changes.id, changes.album_id, COALESCE(changes.photo_id, 0), albums.name, albums.trashed_at IS NOT NULL, " +
+		"photos.filename, photos.checksum, photos.size, " +
+		"photos.id IS NULL OR photos.trashed_at IS NOT NULL OR album_photos.photo_id IS NULL " +
+		"FROM changes JOIN albums ON albums.id = changes.album_id " +
+		"LEFT JOIN photos ON photos.id = changes.photo_id " +
+		"LEFT JOIN album_photos ON album_photos.album_id = changes.album_id AND album_photos.photo_id = changes.photo_id " +
+		"WHERE changes.id > ? AND albums.query IS NULL AND (albums.user_id = ? OR albums.id IN (SELECT album_id FROM album_permissions WHERE user_id = ?)) "
+	args := []interface{}{cursor, userID, userID}
+	if albumID != 0 {
+		query += "AND changes.album_id = ? "
+		args = append(args, albumID)
+	}
+	rows, err := tx.Query(query+"ORDER BY changes.id LIMIT ?", append(args, limit)...)
+	if err != nil {
+		return feed, fmt.Errorf("failed to get changes: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c change
+		var albumTrashed, photoGone bool
+		var filename, checksum sql.NullString
+		var size sql.NullInt64
+		if err := rows.Scan(&c.Cursor, &c.AlbumID, &c.PhotoID, &c.Album, &albumTrashed, &filename, &checksum, &size, &photoGone); err != nil {
+			return feed, fmt.Errorf("failed to scan change: %w", err)
+		}
+		c.Filename, c.Checksum, c.Size = filename.String, checksum.String, size.Int64
+		c.Deleted = albumTrashed || (c.PhotoID != 0 && photoGone)
+		feed.Changes = append(feed.Changes, c)
+		feed.Cursor = c.Cursor
+	}
+	feed.More = len(feed.Changes) == limit
+	return feed, rows.Err()
+}
+
+// changesHandler lists the changes the session user can see after the cursor given in the query, in JSON.
+// album limits them to one album, and limit to fewer than changeLimit at a time
+func changesHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	userID, err := checkSesh(w, r, db)
+	if err != nil {
+		log.Printf("failed to validate user session: %s", err)
+		return
+	}
+	q := r.URL.Query()
+	var cursor, albumID int64
+	limit := changeLimit
+	if s := q.Get("cursor"); s != "" {
+		if cursor, err = strconv.ParseInt(s, 10, 64); err != nil {
+			http.Error(w, "bad cursor", http.StatusBadRequest)
+			return
+		}
+	}
+	if s := q.Get("album"); s != "" {
+		if albumID, err = strconv.ParseInt(s, 10, 64); err != nil {
+			http.Error(w, "bad album id", http.StatusBadRequest)
+			return
+		}
+	}
+	if s := q.Get("limit"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 && n < limit {
+			limit = n
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("failed to begin transaction: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	feed, err := listChanges(userID, cursor, albumID, limit, tx)
+	if err != nil {
+		log.Printf("%s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(feed); err != nil {
+		log.Printf("failed to write changes: %s", err)
+	}
+}
+
+// syncEntry is a synced file as it was last synced
+type syncEntry struct {
+	PhotoID  int64  `json:"photo_id"`
+	AlbumID  int64  `json:"album_id"`
+	Checksum string `json:"checksum"`
+}
+
+// syncManifest is what the client remembers between syncs. Files are keyed by their slash separated path in the
+// synced folder
+type syncManifest struct {
+	Server string               `json:"server"`
+	Email  string               `json:"email"`
+	Cursor int64                `json:"cursor"`
+	Albums map[string]int64     `json:"albums"`
+	Files  map[string]syncEntry `json:"files"`
+}
+
+// syncReport says what a sync did
+type syncReport struct {
+	Downloaded    int
+	Uploaded      int
+	DeletedLocal  int
+	DeletedRemote int
+	Conflicts     int
+	Failed        int
+}
+
+func (r syncReport) String() string {
+	return fmt.Sprintf("downloaded %v, uploaded %v, deleted %v locally and %v on the server, %v conflicts, %v failed",
+		r.Downloaded, r.Uploaded, r.DeletedLocal, r.DeletedRemote, r.Conflicts, r.Failed)
+}
+
+// syncClient syncs dir with the server it's logged in to
+type syncClient struct {
+	server string
+	http   *http.Client
+	userID int64
+	dir    string
+	m      syncManifest
+	report syncReport
+}
+
+func readSyncManifest(dir string) (syncManifest, error) {
+	m := syncManifest{Albums: make(map[string]int64), Files: make(map[string]syncEntry)}
+	b, err := os.ReadFile(filepath.Join(dir, syncManifestName))
+	if os.IsNotExist(err) {
+		return m, nil
+	} else if err != nil {
+		return m, fmt.Errorf("failed to read sync manifest: %w", err)
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return m, fmt.Errorf("failed to parse sync manifest: %w", err)
+	}
+	if m.Albums == nil {
+		m.Albums = make(map[string]int64)
+	}
+	if m.Files == nil {
+		m.Files = make(map[string]syncEntry)
+	}
+	return m, nil
+}
+
+// saves the manifest, so a sync that's interrupted carries on from the last change it got through
+func (c *syncClient) save() error {
+	b, err := json.MarshalIndent(c.m, "", "\t")
+	if err != nil {
+		return fmt.Errorf("failed to encode sync manifest: %w", err)
+	}
+	if _, err := writeFileAtomic(filepath.Join(c.dir, syncManifestName), bytes.NewReader(b)); err != nil {
+		return fmt.Errorf("failed to save sync manifest: %w", err)
+	}
+	return nil
+}
+
+// logs in to server and returns a client for syncing dir
+func loginSync(server string, email string, password string, dir string) (*syncClient, error) {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	c := &syncClient{
+		server: strings.TrimSuffix(server, "/"),
+		dir:    dir,
+		// redirects say where things ended up, so they're read rather than followed
+		http: &http.Client{Jar: jar, CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }},
+	}
+	// POSTed so the password stays out of URLs, which end up in proxy and access logs
+	resp, err := c.http.PostForm(c.server+"/login/", url.Values{"email": {email}, "password": {password}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to log in: %w", err)
+	}
+	resp.Body.Close()
+	home := resp.Header.Get("Location")
+	if !strings.HasPrefix(home, "/home/") {
+		return nil, fmt.Errorf("failed to log in as %s: wrong email or password", email)
+	}
+	if c.userID, err = strconv.ParseInt(path.Base(home), 10, 64); err != nil {
+		return nil, fmt.Errorf("failed to log in: unexpected redirect to %s", home)
+	}
+	return c, nil
+}
+
+// sends req and returns where the server redirected to
+func (c *syncClient) redirect(req *http.Request) (string, error) {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	next := resp.Header.Get("Location")
+	if strings.HasPrefix(next, "/login/") {
+		return "", errors.New("session expired")
+	}
+	return next, nil
+}
+
+func (c *syncClient) fetchChanges(cursor int64, albumID int64) (changeFeed, error) {
+	var feed changeFeed
+	q := url.Values{"cursor": {strconv.FormatInt(cursor, 10)}}
+	if albumID != 0 {
+		q.Set("album", strconv.FormatInt(albumID, 10))
+	}
+	resp, err := c.http.Get(c.server + "/changes/?" + q.Encode())
+	if err != nil {
+		return feed, fmt.Errorf("failed to get changes: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return feed, fmt.Errorf("failed to get changes: %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&feed); err != nil {
+		return feed, fmt.Errorf("failed to read changes: %w", err)
+	}
+	return feed, nil
+}
+
+func (c *syncClient) createAlbum(name string) (int64, error) {
+	req, err := http.NewRequest("GET", c.server+"/home/"+strconv.FormatInt(c.userID, 10)+"?"+url.Values{"album name": {name}}.Encode(), nil)
+	if err != nil {
+		return 0, err
+	}
+	next, err := c.redirect(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create album %s: %w", name, err)
+	}
+	albumID, err := strconv.ParseInt(path.Base(next), 10, 64)
+	if err != nil || !strings.HasPrefix(next, "/album/") {
+		return 0, fmt.Errorf("failed to create album %s", name)
+	}
+	return albumID, nil
+}
+
+func (c *syncClient) upload(albumID int64, p string) (int64, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	fw, err := mw.CreateFormFile("photo", filepath.Base(p))
+	if err != nil {
+		return 0, err
+	}
+	if _, err := io.Copy(fw, f); err != nil {
+		return 0, err
+	}
+	if err := mw.Close(); err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest("POST", c.server+"/upload/"+strconv.FormatInt(albumID, 10), &body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	next, err := c.redirect(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to upload %s: %w", p, err)
+	}
+	return strconv.ParseInt(path.Base(strings.SplitN(next, "?", 2)[0]), 10, 64)
+}
+
+// takes a photo out of an album on the server, which sends it to the trash if it isn't in any other album
+func (c *syncClient) remove(e syncEntry) error {
+	form := url.Values{"album": {strconv.FormatInt(e.AlbumID, 10)}}
+	req, err := http.NewRequest("POST", c.server+"/photo/remove/"+strconv.FormatInt(e.PhotoID, 10), strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if _, err := c.redirect(req); err != nil {
+		return fmt.Errorf("failed to remove photo %v from album %v: %w", e.PhotoID, e.AlbumID, err)
+	}
+	return nil
+}
+
+// downloads a photo to p, making sure it's what the server said it would be
+func (c *syncClient) download(photoID int64, checksum string, p string) error {
+	resp, err := c.http.Get(c.server + "/photos/" + strconv.FormatInt(photoID, 10))
+	if err != nil {
+		return fmt.Errorf("failed to download photo %v: %w", photoID, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download photo %v: %s", photoID, resp.Status)
+	}
+	if _, err := writeFileAtomic(p, resp.Body); err != nil {
+		return fmt.Errorf("failed to save photo %v: %w", photoID, err)
+	}
+	if got, err := hashFile(p); err != nil || got != checksum {
+		os.Remove(p)
+		return fmt.Errorf("photo %v didn't download completely", photoID)
+	}
+	return nil
+}
+
+// the path of a synced file on disk
+func (c *syncClient) local(key string) string {
+	return filepath.Join(c.dir, filepath.FromSlash(key))
+}
+
+// returns the folder synced with the album, or "" if there isn't one
+func (c *syncClient) folder(albumID int64) string {
+	for folder, id := range c.m.Albums {
+		if id == albumID {
+			return folder
+		}
+	}
+	return ""
+}
+
+// returns the key of the file synced with the photo in the album
+func (c *syncClient) tracked(albumID int64, photoID int64) (string, bool) {
+	for key, e := range c.m.Files {
+		if e.AlbumID == albumID && e.PhotoID == photoID {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// the folder an album named name would go in
+func folderName(name string, albumID int64) string {
+	name = strings.TrimSpace(strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r < ' ' {
+			return '-'
+		}
+		return r
+	}, name))
+	if name == "" || strings.HasPrefix(name, ".") {
+		name = fmt.Sprintf("album %v%s", albumID, name)
+	}
+	return name
+}
+
+// returns key, or if there's a file there already, key with the photo id before the extension
+func (c *syncClient) conflictKey(key string, photoID int64) string {
+	if _, err := os.Lstat(c.local(key)); os.IsNotExist(err) {
+		return key
+	}
+	ext := path.Ext(key)
+	return fmt.Sprintf("%s (%v)%s", strings.TrimSuffix(key, ext), photoID, ext)
+}
+
+// pull applies the changes made on the server since the last sync
+func (c *syncClient) pull() error {
+	for {
+		feed, err := c.fetchChanges(c.m.Cursor, 0)
+		if err != nil {
+			return err
+		}
+		for _, ch := range feed.Changes {
+			if err := c.apply(ch); err != nil {
+				return err
+			}
+		}
+		c.m.Cursor = feed.Cursor
+		if err := c.save(); err != nil {
+			return err
+		}
+		if !feed.More {
+			return nil
+		}
+	}
+}
+
+// apply brings the folder in line with one change from the server
+func (c *syncClient) apply(ch change) error {
+	folder := c.folder(ch.AlbumID)
+	if ch.PhotoID == 0 {
+		return c.applyAlbum(ch, folder)
+	}
+	// photos in albums without a folder come with the album
+	if folder == "" {
+		return nil
+	}
+	key, ok := c.tracked(ch.AlbumID, ch.PhotoID)
+	entry := c.m.Files[key]
+	if ch.Deleted {
+		if !ok {
+			return nil
+		}
+		delete(c.m.Files, key)
+		sum, err := hashFile(c.local(key))
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if sum != entry.Checksum {
+			// changed here and removed there: what's here is uploaded as a new photo
+			c.report.Conflicts++
+			return nil
+		}
+		c.report.DeletedLocal++
+		return os.Remove(c.local(key))
+	}
+	if ok && entry.Checksum == ch.Checksum {
+		return nil
+	}
+	if !ok {
+		key = path.Join(folder, syncFileName(ch.Filename, ch.PhotoID))
+	}
+	if sum, err := hashFile(c.local(key)); err == nil {
+		other, otherTracked := c.m.Files[key]
+		switch {
+		case sum == ch.Checksum:
+			// it's already here, for instance from before the folder was synced
+			c.m.Files[key] = syncEntry{PhotoID: ch.PhotoID, AlbumID: ch.AlbumID, Checksum: sum}
+			return nil
+		case !otherTracked || other.PhotoID != ch.PhotoID || other.Checksum != sum:
+			// what's here is either not synced or changed here, and stays to be uploaded
+			delete(c.m.Files, key)
+			key = c.conflictKey(key, ch.PhotoID)
+			c.report.Conflicts++
+		}
+	}
+	if err := c.download(ch.PhotoID, ch.Checksum, c.local(key)); err != nil {
+		log.Printf("%s", err)
+		c.report.Failed++
+		return nil
+	}
+	c.m.Files[key] = syncEntry{PhotoID: ch.PhotoID, AlbumID: ch.AlbumID, Checksum: ch.Checksum}
+	c.report.Downloaded++
+	return nil
+}
+
+// applyAlbum makes, renames or empties the folder synced with an album
+func (c *syncClient) applyAlbum(ch change, folder string) error {
+	if ch.Deleted {
+		if folder == "" {
+			return nil
+		}
+		for key, e := range c.m.Files {
+			if e.AlbumID != ch.AlbumID {
+				continue
+			}
+			delete(c.m.Files, key)
+			if sum, err := hashFile(c.local(key)); err == nil && sum == e.Checksum {
+				os.Remove(c.local(key))
+				c.report.DeletedLocal++
+			} else if err == nil {
+				c.report.Conflicts++
+			}
+		}
+		delete(c.m.Albums, folder)
+		// anything left in it isn't synced, and makes a new album next time
+		os.Remove(c.local(folder))
+		return nil
+	}
+
+	name := folderName(ch.Album, ch.AlbumID)
+	if id, taken := c.m.Albums[name]; taken && id != ch.AlbumID {
+		name = fmt.Sprintf("%s (%v)", name, ch.AlbumID)
+	}
+	if folder == name {
+		return nil
+	}
+	if folder != "" {
+		// renamed on the server
+		if _, err := os.Lstat(c.local(name)); !os.IsNotExist(err) {
+			return nil
+		}
+		if err := os.Rename(c.local(folder), c.local(name)); err != nil {
+			return fmt.Errorf("failed to rename folder %s to %s: %w", folder, name, err)
+		}
+		delete(c.m.Albums, folder)
+		c.m.Albums[name] = ch.AlbumID
+		for key, e := range c.m.Files {
+			if strings.HasPrefix(key, folder+"/") {
+				delete(c.m.Files, key)
+				c.m.Files[name+strings.TrimPrefix(key, folder)] = e
+			}
+		}
+		return nil
+	}
+
+	// new to this folder, so everything in the album is fetched. Each change says what its photo is like now, so
+	// going through the album's changes from the start leaves the folder as the album is now
+	if err := os.MkdirAll(c.local(name), 0700); err != nil {
+		return fmt.Errorf("failed to create folder for album %v: %w", ch.AlbumID, err)
+	}
+	c.m.Albums[name] = ch.AlbumID
+	var cursor int64
+	for {
+		feed, err := c.fetchChanges(cursor, ch.AlbumID)
+		if err != nil {
+			return err
+		}
+		for _, photo := range feed.Changes {
+			if photo.PhotoID != 0 {
+				if err := c.apply(photo); err != nil {
+					return err
+				}
+			}
+		}
+		if cursor = feed.Cursor; !feed.More {
+			return nil
+		}
+	}
+}
+
+// syncUploadable reports whether a file found in a folder is uploaded: photos that aren't hidden
+func syncUploadable(name string) bool {
+	return !strings.HasPrefix(name, ".") && importExtensions[strings.ToLower(filepath.Ext(name))]
+}
+
+// syncFileName is the name a photo is downloaded as: its filename without leading dots, which would hide it, or its
+// id if that leaves nothing
+func syncFileName(filename string, photoID int64) string {
+	name := strings.TrimLeft(filepath.Base(filename), ".")
+	if name == "" || name == string(filepath.Separator) {
+		return strconv.FormatInt(photoID, 10)
+	}
+	return name
+}
+
+// push sends the changes made in the folder since the last sync to the server
+func (c *syncClient) push() error {
+	folders, err := os.ReadDir(c.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", c.dir, err)
+	}
+	seen := make(map[string]bool)
+	for _, f := range folders {
+		if !f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		folder := f.Name()
+		files, err := os.ReadDir(c.local(folder))
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", folder, err)
+		}
+		albumID, ok := c.m.Albums[folder]
+		for _, file := range files {
+			if !file.Type().IsRegular() {
+				continue
+			}
+			key := path.Join(folder, file.Name())
+			entry, tracked := c.m.Files[key]
+			// only new photos are uploaded, but whatever came from the server stays synced
+			if !tracked && !syncUploadable(file.Name()) {
+				continue
+			}
+			seen[key] = true
+			sum, err := hashFile(c.local(key))
+			if err != nil {
+				return err
+			}
+			if tracked && entry.Checksum == sum {
+				continue
+			}
+			if !ok {
+				if albumID, err = c.createAlbum(folder); err != nil {
+					return err
+				}
+				c.m.Albums[folder], ok = albumID, true
+			}
+			photoID, err := c.upload(albumID, c.local(key))
+			if err != nil {
+				log.Printf("%s", err)
+				c.report.Failed++
+				continue
+			}
+			if tracked {
+				// changed here, so the new photo takes the old one's place
+				if err := c.remove(entry); err != nil {
+					log.Printf("%s", err)
+				}
+			}
+			c.m.Files[key] = syncEntry{PhotoID: photoID, AlbumID: albumID, Checksum: sum}
+			c.report.Uploaded++
+		}
+	}
+
+	for key, e := range c.m.Files {
+		if seen[key] {
+			continue
+		}
+		if err := c.remove(e); err != nil {
+			log.Printf("%s", err)
+			c.report.Failed++
+			continue
+		}
+		delete(c.m.Files, key)
+		c.report.DeletedRemote++
+	}
+	for folder := range c.m.Albums {
+		if info, err := os.Stat(c.local(folder)); err != nil || !info.IsDir() {
+			delete(c.m.Albums, folder)
+		}
+	}
+	return c.save()
+}
+
+// syncFolder does one sync of dir with server
+func syncFolder(server string, email string, password string, dir string) (syncReport, error) {
+	m, err := readSyncManifest(dir)
+	if err != nil {
+		return syncReport{}, err
+	}
+	if m.Server != "" && (m.Server != server || m.Email != email) {
+		return syncReport{}, fmt.Errorf("%s is synced with %s as %s", dir, m.Server, m.Email)
+	}
+	m.Server, m.Email = server, email
+	c, err := loginSync(server, email, password, dir)
+	if err != nil {
+		return syncReport{}, err
+	}
+	c.m = m
+	if err := c.pull(); err != nil {
+		return c.report, err
+	}
+	err = c.push()
+	return c.report, err
+}
+
+// sync -server url -email e <dir> syncs dir with the albums of the user on the server. The password is read from
+// $PHOTOAPP_PASSWORD unless given with -password. The server and email are remembered for the next sync
+func syncCommand(args []string) error {
+	fs := flag.NewFlagSet("sync", flag.ExitOnError)
+	server := fs.String("server", "", "url of the server, defaults to the one the folder was synced with before")
+	email := fs.String("email", "", "email to log in with, defaults to the one the folder was synced with before")
+	password := fs.String("password", os.Getenv("PHOTOAPP_PASSWORD"), "password to log in with")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: sync [-server url] [-email e] [-password p] <dir>")
+	}
+
+	dir := fs.Arg(0)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	m, err := readSyncManifest(dir)
+	if err != nil {
+		return err
+	}
+	if *server == "" {
+		*server = m.Server
+	}
+	if *email == "" {
+		*email = m.Email
+	}
+	if *server == "" || *email == "" {
+		return fmt.Errorf("usage: sync -server url -email e <dir>")
+	}
+	report, err := syncFolder(*server, *email, *password, dir)
+	fmt.Println(report)
+	return err
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// importing reads a Google Takeout export, or any folder of photos laid out like one, either unpacked or as a zip.
+// Every folder with photos in it becomes an album named after the folder, or after the title in its metadata.json.
+// Takeout also puts every photo in a "Photos from <year>" folder, which aren't albums: their photos go into one
+// album of their own, and since album folders are imported first, photos that are in an album are skipped there as
+// duplicates. Each photo is paired with its JSON sidecar, from which the capture time, description and location
+// are restored. A photo whose content the user already has isn't uploaded again, just added to the album. Each
+// archive of a multi-part export is imported on its own, so a sidecar that ended up in a different part than its
+// photo isn't found
+
+// importExtensions are the files that are imported as photos
+var importExtensions = map[string]bool{".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true,
+	".heic": true, ".heif": true, ".tif": true, ".tiff": true, ".bmp": true}
+
+// yearFolder matches the folders Takeout sorts every photo into by year
+var yearFolder = regexp.MustCompile(`^Photos from \d{4}$`)
+
+// duplicateSuffix matches the (1) Takeout adds to the second photo of the same name in a folder
+var duplicateSuffix = regexp.MustCompile(`^(.*)(\(\d+\))(\.[^.]*)$`)
+
+// takeoutSidecar is the part of a Takeout sidecar that's imported
+type takeoutSidecar struct {
+	Title          string `json:"title"`
+	Description    string `json:"description"`
+	PhotoTakenTime struct {
+		Timestamp string `json:"timestamp"`
+	} `json:"photoTakenTime"`
+	GeoData     takeoutGeo `json:"geoData"`
+	GeoDataExif takeoutGeo `json:"geoDataExif"`
+}
+
+// Takeout writes 0, 0 for photos without a location
+type takeoutGeo struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+func (g takeoutGeo) known() bool {
+	return g.Latitude != 0 || g.Longitude != 0
+}
+
+// takeoutAlbum is an album folder's metadata.json, in either of the layouts Takeout has used
+type takeoutAlbum struct {
+	Title       string `json:"title"`
+	Description string `json:"description"`
+	AlbumData   struct {
+		Title       string `json:"title"`
+		Description string `json:"description"`
+	} `json:"albumData"`
+}
+
+// importFolder is a folder with photos in it and the JSON files next to them
+type importFolder struct {
+	dir    string
+	photos []string
+	json   map[string]bool
+}
+
+// importReport says what an import did
+type importReport struct {
+	Imported   int
+	Duplicates int
+	Failed     int
+	Albums     int
+}
+
+func (r importReport) String() string {
+	return fmt.Sprintf("imported %v photos into %v albums, skipped %v duplicates, %v failed", r.Imported, r.Albums, r.Duplicates, r.Failed)
+}
+
+// findSidecar returns the name of the sidecar of the photo with the given name in f, or "" if it has none
+func findSidecar(f importFolder, name string) string {
+	candidates := []string{name + ".json", name + ".supplemental-metadata.json"}
+	// IMG(1).jpg goes with IMG.jpg(1).json
+	if m := duplicateSuffix.FindStringSubmatch(name); m != nil {
+		candidates = append(candidates, m[1]+m[3]+m[2]+".json", m[1]+m[3]+".supplemental-metadata"+m[2]+".json")
+	}
+	// an edited copy shares the original's sidecar
+	if ext := path.Ext(name); strings.HasSuffix(strings.TrimSuffix(name, ext), "-edited") {
+		original := strings.TrimSuffix(strings.TrimSuffix(name, ext), "-edited") + ext
+		candidates = append(candidates, original+".json", original+".supplemental-metadata.json")
+	}
+	for _, c := range candidates {
+		if f.json[c] {
+			return c
+		}
+	}
+	// long names get cut short, e.g. IMG_20190101_123456789_HDR.jpg.supplemental-met.json, so the longest sidecar
+	// whose name the photo's starts with is taken, as long as it isn't so short it could belong to anything
+	best := ""
+	for j := range f.json {
+		stem := strings.TrimSuffix(j, ".json")
+		if j == "metadata.json" || len(stem) <= len(best) || len(stem) < len(name)/2 {
+			continue
+		}
+		if strings.HasPrefix(name+".supplemental-metadata", stem) {
+			best = stem
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return best + ".json"
+}
+
+// reads and decodes the JSON file at p in fsys
+func readJSON(fsys fs.FS, p string, v interface{}) error {
+	b, err := fs.ReadFile(fsys, p)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// hashes the file at p in fsys the way addPhoto does
+func hashImport(fsys fs.FS, p string) (string, error) {
+	f, err := fsys.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// returns the album of userID with the given name, creating it if it doesn't exist
+func importAlbum(db *sql.DB, userID int64, name string, description string) (int64, bool, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var albumID int64
+	err = tx.QueryRow("SELECT id FROM albums WHERE user_id = ? AND name = ? AND trashed_at IS NULL AND query IS NULL ORDER BY id LIMIT 1", userID, name).Scan(&albumID)
+	if err == nil {
+		return albumID, false, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, false, fmt.Errorf("failed to look for album %q: %w", name, err)
+	}
+	if albumID, err = newAlbum(name, userID, tx); err != nil {
+		return 0, false, err
+	}
+	if description != "" {
+		if err := store.WithTx(tx).SetAlbumDescription(albumID, description); err != nil {
+			return 0, false, err
+		}
+	}
+	return albumID, true, tx.Commit()
+}
+
+// runs fn in a transaction
+func inTx(db *sql.DB, fn func(tx *sql.Tx) error) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// restores what a sidecar knows about an imported photo
+func applySidecar(photoID int64, s takeoutSidecar, tx *sql.Tx) error {
+	if s.Description != "" {
+		if _, err := tx.Exec("UPDATE photos SET caption = ? WHERE id = ?", s.Description, photoID); err != nil {
+			return fmt.Errorf("failed to save caption of photo %v: %w", photoID, err)
+		}
+	}
+	if secs, err := strconv.ParseInt(s.PhotoTakenTime.Timestamp, 10, 64); err == nil && secs > 0 {
+		taken := time.Unix(secs, 0).UTC().Format(timeLayout)
+		if _, err := tx.Exec("UPDATE photos SET captured_at = ? WHERE id = ?", taken, photoID); err != nil {
+			return fmt.Errorf("failed to save capture time of photo %v: %w", photoID, err)
+		}
+	}
+	// the location as edited in Google Photos wins over the one from the camera
+	for _, g := range []takeoutGeo{s.GeoData, s.GeoDataExif} {
+		if g.known() {
+			return setLocation(photoID, g.Latitude, g.Longitude, tx)
+		}
+	}
+	return nil
+}
+
+// importTakeout imports the photos in fsys for userID, putting photos that aren't in an album folder into the
+// album named otherAlbum
+func importTakeout(db *sql.DB, userID int64, fsys fs.FS, otherAlbum string) (importReport, error) {
+	report := importReport{}
+	folders := make(map[string]*importFolder)
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		dir, name := path.Split(p)
+		dir = path.Clean(dir)
+		f, ok := folders[dir]
+		if !ok {
+			f = &importFolder{dir: dir, json: make(map[string]bool)}
+			folders[dir] = f
+		}
+		switch ext := strings.ToLower(path.Ext(name)); {
+		case ext == ".json":
+			f.json[name] = true
+		case importExtensions[ext]:
+			f.photos = append(f.photos, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return report, fmt.Errorf("failed to read export: %w", err)
+	}
+
+	// album folders go first, so a photo ends up in its album rather than only in the catch-all one
+	order := make([]*importFolder, 0, len(folders))
+	for _, f := range folders {
+		if len(f.photos) > 0 {
+			order = append(order, f)
+		}
+	}
+	isAlbum := func(f *importFolder) bool { return f.dir != "." && !yearFolder.MatchString(path.Base(f.dir)) }
+	sort.Slice(order, func(i, j int) bool {
+		if isAlbum(order[i]) != isAlbum(order[j]) {
+			return isAlbum(order[i])
+		}
+		return order[i].dir < order[j].dir
+	})
+
+	for _, f := range order {
+		name, description := otherAlbum, ""
+		if isAlbum(f) {
+			name = path.Base(f.dir)
+			var meta takeoutAlbum
+			if f.json["metadata.json"] && readJSON(fsys, path.Join(f.dir, "metadata.json"), &meta) == nil {
+				if meta.AlbumData.Title != "" {
+					meta.Title, meta.Description = meta.AlbumData.Title, meta.AlbumData.Description
+				}
+				if meta.Title != "" {
+					name = meta.Title
+				}
+				description = meta.Description
+			}
+		}
+		// the album is only created once a photo needs it, so a folder of duplicates doesn't leave an empty one
+		var albumID int64
+		album := func() (int64, error) {
+			if albumID == 0 {
+				id, created, err := importAlbum(db, userID, name, description)
+				if err != nil {
+					return 0, err
+				}
+				if created {
+					report.Albums++
+				}
+				albumID = id
+			}
+			return albumID, nil
+		}
+
+		sort.Strings(f.photos)
+		for _, photo := range f.photos {
+			p := path.Join(f.dir, photo)
+			err := importPhoto(db, userID, album, isAlbum(f), fsys, f, photo)
+			switch {
+			case errors.Is(err, errDuplicate):
+				report.Duplicates++
+			case errors.Is(err, errQuotaExceeded):
+				return report, fmt.Errorf("stopped at %s: %w", p, err)
+			case err != nil:
+				log.Printf("failed to import %s: %s", p, err)
+				report.Failed++
+			default:
+				report.Imported++
+			}
+		}
+	}
+	return report, nil
+}
+
+// errDuplicate is returned for a photo the user already has
+var errDuplicate = errors.New("photo has been imported already")
+
+// imports one photo of f into the album returned by album. A duplicate is only added to the album if f is an
+// album folder
+func importPhoto(db *sql.DB, userID int64, album func() (int64, error), inAlbum bool, fsys fs.FS, f *importFolder, name string) error {
+	p := path.Join(f.dir, name)
+	checksum, err := hashImport(fsys, p)
+	if err != nil {
+		return err
+	}
+	var existing int64
+	err = db.QueryRow("SELECT id FROM photos WHERE user_id = ? AND checksum = ? AND trashed_at IS NULL ORDER BY id LIMIT 1", userID, checksum).Scan(&existing)
+	if err == nil {
+		if inAlbum {
+			albumID, err := album()
+			if err != nil {
+				return err
+			}
+			if err := inTx(db, func(tx *sql.Tx) error { return addToAlbum(existing, albumID, tx) }); err != nil {
+				return err
+			}
+		}
+		return errDuplicate
+	}
+	if err != sql.ErrNoRows {
+		return fmt.Errorf("failed to look for duplicates: %w", err)
+	}
+
+	var sidecar takeoutSidecar
+	if s := findSidecar(*f, name); s != "" {
+		if err := readJSON(fsys, path.Join(f.dir, s), &sidecar); err != nil {
+			log.Printf("failed to read sidecar %s: %s", path.Join(f.dir, s), err)
+		}
+	}
+	filename := name
+	if sidecar.Title != "" {
+		filename = sidecar.Title
+	}
+	albumID, err := album()
+	if err != nil {
+		return err
+	}
+	src, err := fsys.Open(p)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	s, err := stagePhoto(src)
+	if err != nil {
+		return err
+	}
+	defer s.discard()
+	// the sidecar goes in with the photo, since a photo imported without it would be skipped as a duplicate next time
+	err = inTx(db, func(tx *sql.Tx) error {
+		photoID, _, err := s.add(albumID, userID, filename, tx)
+		if err != nil {
+			return err
+		}
+		return applySidecar(photoID, sidecar, tx)
+	})
+	if err != nil {
+		return err
+	}
+	s.keep()
+	return nil
+}
+
+// import -user email [-album name] <folder or zip> imports a Google Takeout export, or any folder of photos, for
+// the user with the given email
+func importCommand(args []string, db *sql.DB) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	email := fs.String("user", "", "email of the user to import for")
+	otherAlbum := fs.String("album", "Google Photos", "album for photos that aren't in an album folder")
+	fs.Parse(args)
+	if *email == "" || fs.NArg() != 1 {
+		return fmt.Errorf("usage: import -user email [-album name] <folder or zip>")
+	}
+
+	userID, _, err := store.UserByEmail(*email)
+	if err != nil {
+		return fmt.Errorf("failed to find user %s: %w", *email, err)
+	}
+	src := fs.Arg(0)
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	var fsys = os.DirFS(src)
+	if !info.IsDir() {
+		zr, err := zip.OpenReader(src)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %w", src, err)
+		}
+		defer zr.Close()
+		fsys = zr
+	}
+
+	report, err := importTakeout(db, userID, fsys, *otherAlbum)
+	fmt.Println(report)
+	return err
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the timeline shows every photo the user can see, from all the albums they can access, newest first and grouped by
+// the day it was taken, or uploaded for photos that don't say. /timeline/ is the whole of it, starting at the month
+// in from (YYYY-MM) if given, /timeline/YYYY lists the months of a year and /timeline/YYYY/MM shows a month. Pages
+// show the first timelinePageSize photos and load the rest as they're scrolled to from /timeline.json, which returns
+// a page of days after a cursor (the last photo shown), optionally within a month
+
+// timelinePageSize is how many photos a page of the timeline has
+const timelinePageSize = 60
+
+// takenSQL is when a photo was taken, falling back to when it was uploaded
+const takenSQL = "COALESCE(photos.captured_at, photos.uploaded_at)"
+
+// timelinePhoto is a photo on the timeline
+type timelinePhoto struct {
+	ID      int64  `json:"id"`
+	Alt     string `json:"alt"`
+	TakenAt string `json:"taken_at"`
+}
+
+// timelineDay is the photos taken on a day. Month and Year are only set on the first day of a month or a year, where
+// the timeline shows them as headings
+type timelineDay struct {
+	Date   string          `json:"date"`
+	Label  string          `json:"label"`
+	Month  string          `json:"month,omitempty"`
+	Year   string          `json:"year,omitempty"`
+	Photos []timelinePhoto `json:"photos"`
+}
+
+// timelineFeed is what /timeline.json returns. Cursor is where the next page starts, empty at the end
+type timelineFeed struct {
+	Cursor string        `json:"cursor"`
+	Days   []timelineDay `json:"days"`
+}
+
+// timelineMonth is a month of the scrubber or a year's archive page
+type timelineMonth struct {
+	Month   string // YYYY-MM
+	Label   string
+	Count   int
+	CoverID int64
+}
+
+// timelineYear is a year of the scrubber
+type timelineYear struct {
+	Year   string
+	Count  int
+	Months []timelineMonth
+}
+
+type timelinepage struct {
+	UserID  int64
+	Heading string
+	Years   []timelineYear  // the scrubber
+	Months  []timelineMonth // on a year's page
+	Days    []timelineDay
+	Cursor  string
+	Month   string // YYYY-MM on a month's page, which only loads photos from that month
+}
+
+func (t timelinepage) render(w http.ResponseWriter) error {
+	return templates.ExecuteTemplate(w, "timeline.html", t)
+}
+
+// timelineCursor is the last photo of a page: the next page has the photos taken before it
+type timelineCursor struct {
+	TakenAt string
+	ID      int64
+}
+
+func (c timelineCursor) String() string {
+	if c.TakenAt == "" {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(c.TakenAt + "|" + strconv.FormatInt(c.ID, 10)))
+}
+
+func parseTimelineCursor(s string) (timelineCursor, error) {
+	var c timelineCursor
+	if s == "" {
+		return c, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return c, fmt.Errorf("bad cursor: %w", err)
+	}
+	taken, id, ok := strings.Cut(string(b), "|")
+	if !ok {
+		return c, fmt.Errorf("bad cursor %q", s)
+	}
+	if c.ID, err = strconv.ParseInt(id, 10, 64); err != nil {
+		return c, fmt.Errorf("bad cursor: %w", err)
+	}
+	c.TakenAt = taken
+	return c, nil
+}
+
+// parseMonth reads a YYYY-MM month, returning its first moment and the first moment of the month after
+func parseMonth(s string) (string, string, error) {
+	t, err := time.Parse("2006-01", s)
+	if err != nil {
+		return "", "", fmt.Errorf("%q isn't a month like 2025-06", s)
+	}
+	return t.Format(timeLayout), t.AddDate(0, 1, 0).Format(timeLayout), nil
+}
+
+// listTimeline returns up to limit photos userID can see taken before the cursor, and from start up to end where
+// they're set, grouped into days
+func listTimeline(userID int64, cursor timelineCursor, start string, end string, limit int, tx *sql.Tx) (timelineFeed, error) {
+	feed := timelineFeed{Days: make([]timelineDay, 0)}
+	query := "SELECT photos.id, photos.title, photos.alt_text, " + takenSQL + " FROM photos WHERE photos.trashed_at IS NULL " +
+		"AND photos.id IN (SELECT photo_id FROM album_photos WHERE album_id IN (" + accessibleAlbumsSQL + "))"
+	args := []interface{}{userID, userID}
+	if cursor.TakenAt != "" {
+		query += " AND (" + takenSQL + " < ? OR (" + takenSQL + " = ? AND photos.id < ?))"
+		args = append(args, cursor.TakenAt, cursor.TakenAt, cursor.ID)
+	}
+	if start != "" {
+		query += " AND " + takenSQL + " >= ?"
+		args = append(args, start)
+	}
+	if end != "" {
+		query += " AND " + takenSQL + " < ?"
+		args = append(args, end)
+	}
+	// one more than asked for says whether there's another page
+	rows, err := tx.Query(query+" ORDER BY "+takenSQL+" DESC, photos.id DESC LIMIT ?", append(args, limit+1)...)
+	if err != nil {
+		return feed, fmt.Errorf("failed to get timeline of user %v: %w", userID, err)
+	}
+	defer rows.Close()
+	photos := make([]timelinePhoto, 0)
+	for rows.Next() {
+		var p photoInfo
+		var taken string
+		if err := rows.Scan(&p.ID, &p.Title, &p.AltText, &taken); err != nil {
+			return feed, fmt.Errorf("failed to scan photo: %w", err)
+		}
+		photos = append(photos, timelinePhoto{ID: p.ID, Alt: p.Alt(), TakenAt: taken})
+	}
+	if err := rows.Err(); err != nil {
+		return feed, err
+	}
+	if len(photos) > limit {
+		photos = photos[:limit]
+		last := photos[len(photos)-1]
+		feed.Cursor = timelineCursor{TakenAt: last.TakenAt, ID: last.ID}.String()
+	}
+	feed.Days = groupTimeline(photos, cursor.TakenAt)
+	return feed, nil
+}
+
+// groupTimeline groups photos into the days they were taken. after is when the photo before them was taken, so the
+// month and year they start in only get a heading if it's a new one
+func groupTimeline(photos []timelinePhoto, after string) []timelineDay {
+	days := make([]timelineDay, 0)
+	for _, p := range photos {
+		date := p.TakenAt
+		if len(date) > 10 {
+			date = date[:10]
+		}
+		if len(days) == 0 || days[len(days)-1].Date != date {
+			day := timelineDay{Date: date, Label: date, Photos: make([]timelinePhoto, 0)}
+			if t, err := time.Parse("2006-01-02", date); err == nil {
+				day.Label = t.Format("Monday, January 2")
+				if !strings.HasPrefix(after, date[:7]) {
+					day.Month = t.Format("January 2006")
+				}
+				if !strings.HasPrefix(after, date[:4]) {
+					day.Year = date[:4]
+				}
+			}
+			days = append(days, day)
+			after = date
+		}
+		days[len(days)-1].Photos = append(days[len(days)-1].Photos, p)
+	}
+	return days
+}
+
+// timelineMonths returns the months userID has photos in, newest first, grouped into years
+func timelineMonths(userID int64, tx *sql.Tx) ([]timelineYear, error) {
+	rows, err := tx.Query("SELECT substr("+takenSQL+", 1, 7) AS month, COUNT(*), MAX(photos.id) FROM photos "+
+		"WHERE photos.trashed_at IS NULL AND photos.id IN (SELECT photo_id FROM album_photos WHERE album_id IN ("+accessibleAlbumsSQL+")) "+
+		"GROUP BY month ORDER BY month DESC", userID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get timeline months of user %v: %w", userID, err)
+	}
+	defer rows.Close()
+	years := make([]timelineYear, 0)
+	for rows.Next() {
+		var m timelineMonth
+		if err := rows.Scan(&m.Month, &m.Count, &m.CoverID); err != nil {
+			return nil, fmt.Errorf("failed to scan month: %w", err)
+		}
+		m.Label = m.Month
+		if t, err := time.Parse("2006-01", m.Month); err == nil {
+			m.Label = t.Format("January")
+		}
+		year := m.Month[:4]
+		if len(years) == 0 || years[len(years)-1].Year != year {
+			years = append(years, timelineYear{Year: year, Months: make([]timelineMonth, 0)})
+		}
+		years[len(years)-1].Count += m.Count
+		years[len(years)-1].Months = append(years[len(years)-1].Months, m)
+	}
+	return years, rows.Err()
+}
+
+// shows the timeline, a year's months at /timeline/YYYY or a month at /timeline/YYYY/MM
+func timelineHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	userID, err := checkSesh(w, r, db)
+	if err != nil {
+		log.Printf("failed to validate user session: %s", err)
+		return
+	}
+
+	t := timelinepage{UserID: userID, Heading: "timeline", Days: make([]timelineDay, 0)}
+	var start, end string
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/timeline/"), "/"), "/")
+	switch {
+	case parts[0] == "":
+		// jumping to a month from the scrubber starts the timeline at its end, the pages after carry on from there
+		if from := r.FormValue("from"); from != "" {
+			if _, end, err = parseMonth(from); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	case len(parts) == 1:
+		year, err := time.Parse("2006", parts[0])
+		if err != nil {
+			http.Error(w, "no such year", http.StatusNotFound)
+			return
+		}
+		t.Heading = parts[0]
+		start, end = year.Format(timeLayout), year.AddDate(1, 0, 0).Format(timeLayout)
+	case len(parts) == 2:
+		t.Month = parts[0] + "-" + parts[1]
+		if start, end, err = parseMonth(t.Month); err != nil {
+			http.Error(w, "no such month", http.StatusNotFound)
+			return
+		}
+		month, _ := time.Parse(timeLayout, start)
+		t.Heading = month.Format("January 2006")
+	default:
+		http.Error(w, "no such page", http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("failed to begin transaction: %s", err)
+		return
+	}
+	defer tx.Rollback()
+
+	if t.Years, err = timelineMonths(userID, tx); err != nil {
+		log.Printf("%s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(parts) == 1 && parts[0] != "" {
+		// a year's page lists its months rather than its photos
+		for _, y := range t.Years {
+			if y.Year == parts[0] {
+				t.Months = y.Months
+			}
+		}
+	} else {
+		feed, err := listTimeline(userID, timelineCursor{}, start, end, timelinePageSize, tx)
+		if err != nil {
+			log.Printf("%s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		t.Days, t.Cursor = feed.Days, feed.Cursor
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("%s", err)
+	}
+	if err := t.render(w); err != nil {
+		log.Printf("failed to render html: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// returns the page of the timeline after the cursor as JSON, only from the month given as YYYY-MM if there is one.
+// limit can ask for fewer photos than a page
+func timelineJSONHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	userID, err := checkSesh(w, r, db)
+	if err != nil {
+		log.Printf("failed to validate user session: %s", err)
+		return
+	}
+	q := r.URL.Query()
+	cursor, err := parseTimelineCursor(q.Get("cursor"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var start, end string
+	if month := q.Get("month"); month != "" {
+		if start, end, err = parseMonth(month); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	limit := timelinePageSize
+	if s := q.Get("limit"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 && n < limit {
+			limit = n
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("failed to begin transaction: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	feed, err := listTimeline(userID, cursor, start, end, limit, tx)
+	if err != nil {
+		log.Printf("%s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(feed); err != nil {
+		log.Printf("failed to write timeline: %s", err)
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+)
+
+// deleting a photo or an album sets its trashed_at instead of removing it. Trashed photos keep their album_photos
+// rows and trashed albums keep their photos, so restoring puts everything back where it was. The purger removes
+// items for good once they've been in the trash longer than the retention period, and retries any files left in
+// the cleanup queue
+
+// restoredAlbumName is the name of the album restored photos go in when their owner has no other album
+const restoredAlbumName = "Restored"
+
+type trashpage struct {
+	UserID int64
+	Photos []photoInfo
+	Albums []albumRef
+}
+
+func (t trashpage) render(w http.ResponseWriter) error {
+	return templates.ExecuteTemplate(w, "trash.html", t)
+}
+
+// moves a photo to its owner's trash
+func trashPhoto(photoID int64, tx *sql.Tx) error {
+	if _, err := tx.Exec("UPDATE photos SET trashed_at = CURRENT_TIMESTAMP WHERE id = ? AND trashed_at IS NULL", photoID); err != nil {
+		return fmt.Errorf("failed to move photo %v to the trash: %w", photoID, err)
+	}
+	return nil
+}
+
+// inTrashedAlbumsSQL is true for photos that went to the trash with their albums: they're in albums, but only in
+// trashed ones
+const inTrashedAlbumsSQL = "(EXISTS (SELECT 1 FROM album_photos JOIN albums ON albums.id = album_photos.album_id " +
+	"WHERE album_photos.photo_id = photos.id AND albums.trashed_at IS NOT NULL) " +
+	"AND NOT EXISTS (SELECT 1 FROM album_photos JOIN albums ON albums.id = album_photos.album_id " +
+	"WHERE album_photos.photo_id = photos.id AND albums.trashed_at IS NULL))"
+
+// moves an album to its owner's trash. Its photos go with it unless they're also in another album, see
+// inTrashedAlbumsSQL
+func trashAlbum(albumID int64, tx *sql.Tx) error {
+	if _, err := tx.Exec("UPDATE albums SET trashed_at = CURRENT_TIMESTAMP WHERE id = ? AND trashed_at IS NULL", albumID); err != nil {
+		return fmt.Errorf("failed to move album %v to the trash: %w", albumID, err)
+	}
+	return nil
+}
+
+// takes a photo out of the trash. A photo that isn't in any album that's still around is put in its owner's
+// first regular album so it doesn't disappear again, or in a new album if they don't have one
+func restorePhoto(photoID int64, tx *sql.Tx) error {
+	if _, err := tx.Exec("UPDATE photos SET trashed_at = NULL WHERE id = ?", photoID); err != nil {
+		return fmt.Errorf("failed to restore photo %v: %w", photoID, err)
+	}
+	var n int
+	err := tx.QueryRow("SELECT count(*) FROM album_photos JOIN albums ON albums.id = album_photos.album_id "+
+		"WHERE album_photos.photo_id = ? AND albums.trashed_at IS NULL", photoID).Scan(&n)
+	if err != nil {
+		return fmt.Errorf("failed to get albums of photo %v: %w", photoID, err)
+	}
+	if n > 0 {
+		return nil
+	}
+	var ownerID int64
+	var albumID sql.NullInt64
+	err = tx.QueryRow("SELECT photos.user_id, (SELECT MIN(albums.id) FROM albums WHERE albums.user_id = photos.user_id "+
+		"AND albums.trashed_at IS NULL AND albums.query IS NULL) FROM photos WHERE photos.id = ?", photoID).Scan(&ownerID, &albumID)
+	if err != nil {
+		return fmt.Errorf("failed to find an album to restore photo %v to: %w", photoID, err)
+	}
+	if !albumID.Valid {
+		if albumID.Int64, err = newAlbum(restoredAlbumName, ownerID, tx); err != nil {
+			return fmt.Errorf("failed to create an album to restore photo %v to: %w", photoID, err)
+		}
+	}
+	return addToAlbum(photoID, albumID.Int64, tx)
+}
+
+// takes an album out of the trash, along with the photos that went with it
+func restoreAlbum(albumID int64, tx *sql.Tx) error {
+	if _, err := tx.Exec("UPDATE albums SET trashed_at = NULL WHERE id = ?", albumID); err != nil {
+		return fmt.Errorf("failed to restore album %v: %w", albumID, err)
+	}
+	return nil
+}
+
+// permanently deletes a photo. Its tags and album memberships go with it, albums it was the cover of lose their
+// cover, and its file is queued for removal once the transaction commits
+func purgePhoto(photoID int64, tx *sql.Tx) error {
+	if _, err := tx.Exec("DELETE FROM photos WHERE id = ?", photoID); err != nil {
+		return fmt.Errorf("failed to purge photo %v: %w", photoID, err)
+	}
+	return nil
+}
+
+// permanently deletes an album along with its permissions. The album owner's photos that were only in this album
+// are deleted with it, while other people's go to their own trash, so they get the retention period to restore
+// them. Photos that are also in other albums, even trashed ones, stay there
+func purgeAlbum(albumID int64, tx *sql.Tx) error {
+	photos, err := queryIDs(tx, "SELECT photo_id FROM album_photos JOIN photos ON photos.id = album_photos.photo_id "+
+		"WHERE album_photos.album_id = ? AND photos.user_id = (SELECT user_id FROM albums WHERE id = ?) "+
+		"AND photo_id NOT IN (SELECT photo_id FROM album_photos WHERE album_id != ?)", albumID, albumID, albumID)
+	if err != nil {
+		return fmt.Errorf("failed to get photos of album %v: %w", albumID, err)
+	}
+	for _, photoID := range photos {
+		if err := purgePhoto(photoID, tx); err != nil {
+			return err
+		}
+	}
+	others, err := queryIDs(tx, "SELECT photo_id FROM album_photos WHERE album_id = ? "+
+		"AND photo_id NOT IN (SELECT photo_id FROM album_photos WHERE album_id != ?)", albumID, albumID)
+	if err != nil {
+		return fmt.Errorf("failed to get other people's photos of album %v: %w", albumID, err)
+	}
+	for _, photoID := range others {
+		if err := trashPhoto(photoID, tx); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("DELETE FROM albums WHERE id = ?", albumID); err != nil {
+		return fmt.Errorf("failed to purge album %v: %w", albumID, err)
+	}
+	return nil
+}
+
+// permanently deletes the trashed photos and albums selected by the given conditions, which are applied to the
+// photos and albums tables respectively, and then removes their files
+func purge(db *sql.DB, photoWhere string, albumWhere string, args ...interface{}) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	albums, err := queryIDs(tx, "SELECT id FROM albums WHERE trashed_at IS NOT NULL AND "+albumWhere, args...)
+	if err != nil {
+		return fmt.Errorf("failed to get trashed albums: %w", err)
+	}
+	for _, albumID := range albums {
+		if err := purgeAlbum(albumID, tx); err != nil {
+			return err
+		}
+	}
+	photos, err := queryIDs(tx, "SELECT id FROM photos WHERE trashed_at IS NOT NULL AND "+photoWhere, args...)
+	if err != nil {
+		return fmt.Errorf("failed to get trashed photos: %w", err)
+	}
+	for _, photoID := range photos {
+		if err := purgePhoto(photoID, tx); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	if len(albums)+len(photos) > 0 {
+		log.Printf("purged %v albums and %v photos from the trash", len(albums), len(photos))
+	}
+	return drainCleanup(db)
+}
+
+// runs the given query and returns the ids it selects
+func queryIDs(tx *sql.Tx, query string, args ...interface{}) ([]int64, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := make([]int64, 0)
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// startPurger permanently deletes everything that's been in the trash for longer than retention, checking every
+// interval until the program exits
+func startPurger(db *sql.DB, retention time.Duration, interval time.Duration) {
+	go func() {
+		for {
+			cutoff := time.Now().UTC().Add(-retention).Format(timeLayout)
+			if err := purge(db, "trashed_at < ?", "trashed_at < ?", cutoff); err != nil {
+				log.Printf("failed to purge trash: %s", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// serves the session user's trash
+func trashHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	userID, err := checkSesh(w, r, db)
+	if err != nil {
+		log.Printf("failed to validate user session: %s", err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("failed to begin transaction: %s", err)
+		return
+	}
+	defer tx.Rollback()
+
+	t := trashpage{UserID: userID}
+	photoRows, err := tx.Query("SELECT id, title, caption, alt_text FROM photos WHERE user_id = ? AND trashed_at IS NOT NULL "+
+		"ORDER BY trashed_at DESC", userID)
+	if err != nil {
+		log.Printf("failed to get trashed photos: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	t.Photos, err = scanPhotoInfos(photoRows)
+	photoRows.Close()
+	if err != nil {
+		log.Printf("failed to scan trashed photos: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	albumRows, err := tx.Query("SELECT id, name FROM albums WHERE user_id = ? AND trashed_at IS NOT NULL ORDER BY trashed_at DESC", userID)
+	if err != nil {
+		log.Printf("failed to get trashed albums: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	t.Albums, err = scanAlbumRefs(albumRows)
+	albumRows.Close()
+	if err != nil {
+		log.Printf("%s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := t.render(w); err != nil {
+		log.Printf("failed to render html: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// takes a photo (/trash/restore/photo/<id>) or an album (/trash/restore/album/<id>) out of the session user's trash
+func restoreHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	userID, err := checkSesh(w, r, db)
+	if err != nil {
+		log.Printf("failed to validate user session: %s", err)
+		return
+	}
+	id, err := strconv.ParseInt(path.Base(r.URL.Path), 10, 64)
+	if err != nil {
+		log.Printf("failed to get id of item to restore: %s", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	kind := path.Base(path.Dir(r.URL.Path))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		log.Printf("failed to begin transaction: %s", err)
+		return
+	}
+	defer tx.Rollback()
+
+	var ownerID int64
+	switch kind {
+	case "photo":
+		err = tx.QueryRow("SELECT user_id FROM photos WHERE id = ?", id).Scan(&ownerID)
+	case "album":
+		err = tx.QueryRow("SELECT user_id FROM albums WHERE id = ?", id).Scan(&ownerID)
+	default:
+		http.Error(w, fmt.Sprintf("can't restore a %q", kind), http.StatusNotFound)
+		return
+	}
+	if err != nil || ownerID != userID {
+		log.Printf("user %v can't restore %s %v: %v", userID, kind, id, err)
+		http.Error(w, "that isn't in your trash", http.StatusNotFound)
+		return
+	}
+	if kind == "photo" {
+		err = restorePhoto(id, tx)
+	} else {
+		err = restoreAlbum(id, tx)
+	}
+	if err != nil {
+		log.Printf("%s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("%s", err)
+	}
+	http.Redirect(w, r, "/trash/", http.StatusFound)
+}
+
+// permanently deletes everything in the session user's trash
+func emptyTrashHandler(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	userID, err := checkSesh(w, r, db)
+	if err != nil {
+		log.Printf("failed to validate user session: %s", err)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Redirect(w, r, "/trash/", http.StatusFound)
+		return
+	}
+	if err := purge(db, "user_id = ?", "user_id = ?", userID); err != nil {
+		log.Printf("failed to empty trash of user %v: %s", userID, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/trash/", http.StatusFound)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// scanners and card readers drop files into a folder, which the server can watch for a user. watch_folders:
+// id!|user_id|album_id|path|created_at lists them; photos go into album_id, or the user's first album if that's
+// NULL. The watcher looks at every folder each interval. A file is imported once it has looked the same on two
+// looks in a row and hasn't been written to for watchSettle, so files that are still being copied in are left
+// alone. Imported files go through addPhoto like any upload and are then moved to processed/, files that couldn't
+// be imported to failed/ along with a .error file saying why
+
+const (
+	watchProcessed = "processed"
+	watchFailed    = "failed"
+)
+
+// watchSettle is how long a file has to go unmodified before it's imported
+const watchSettle = 2 * time.Second
+
+type watchFolder struct {
+	id      int64
+	userID  int64
+	albumID sql.NullInt64
+	path    string
+}
+
+// watchedFile is how a file looked the last time the watcher saw it
+type watchedFile struct {
+	size    int64
+	modTime time.Time
+}
+
+// watcher remembers the files it has seen between looks
+type watcher struct {
+	seen map[string]watchedFile
+}
+
+func newWatcher() *watcher {
+	return &watcher{seen: make(map[string]watchedFile)}
+}
+
+// addWatchFolder starts watching dir for userID, importing into albumID, or the user's first album if it's 0
+func addWatchFolder(userID int64, albumID int64, dir string, tx *sql.Tx) error {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return fmt.Errorf("failed to get absolute path of %s: %w", dir, err)
+	}
+	if info, err := os.Stat(abs); err != nil || !info.IsDir() {
+		return fmt.Errorf("%s isn't a directory", abs)
+	}
+	album := sql.NullInt64{Int64: albumID, Valid: albumID != 0}
+	if album.Valid && !checkContributor(albumID, userID, tx) {
+		return fmt.Errorf("user %v can't add photos to album %v", userID, albumID)
+	}
+	if _, err := tx.Exec("INSERT INTO watch_folders (user_id, album_id, path) VALUES (?, ?, ?)", userID, album, abs); err != nil {
+		return fmt.Errorf("failed to watch %s: %w", abs, err)
+	}
+	return nil
+}
+
+func listWatchFolders(db *sql.DB) ([]watchFolder, error) {
+	rows, err := db.Query("SELECT id, user_id, album_id, path FROM watch_folders ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("failed to get watch folders: %w", err)
+	}
+	defer rows.Close()
+	folders := make([]watchFolder, 0)
+	for rows.Next() {
+		var f watchFolder
+		if err := rows.Scan(&f.id, &f.userID, &f.albumID, &f.path); err != nil {
+			return nil, fmt.Errorf("failed to scan watch folder: %w", err)
+		}
+		folders = append(folders, f)
+	}
+	return folders, rows.Err()
+}
+
+// returns the album photos from f go into, checking the user can still add photos to it
+func (f watchFolder) album(tx *sql.Tx) (int64, error) {
+	if f.albumID.Valid {
+		if !checkContributor(f.albumID.Int64, f.userID, tx) {
+			return 0, fmt.Errorf("user %v can't add photos to album %v anymore", f.userID, f.albumID.Int64)
+		}
+		return f.albumID.Int64, nil
+	}
+	var albumID sql.NullInt64
+	err := tx.QueryRow("SELECT MIN(id) FROM albums WHERE user_id = ? AND trashed_at IS NULL AND query IS NULL", f.userID).Scan(&albumID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to find an album for user %v: %w", f.userID, err)
+	}
+	if !albumID.Valid {
+		return 0, fmt.Errorf("user %v has no album to import into", f.userID)
+	}
+	return albumID.Int64, nil
+}
+
+// scan looks at every watch folder once and imports the files that are ready
+func (w *watcher) scan(db *sql.DB) error {
+	folders, err := listWatchFolders(db)
+	if err != nil {
+		return err
+	}
+	stillThere := make(map[string]bool)
+	for _, f := range folders {
+		entries, err := os.ReadDir(f.path)
+		if err != nil {
+			log.Printf("failed to read watch folder %s: %s", f.path, err)
+			continue
+		}
+		for _, e := range entries {
+			if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+				continue
+			}
+			p := filepath.Join(f.path, e.Name())
+			info, err := e.Info()
+			if err != nil {
+				continue
+			}
+			stillThere[p] = true
+			now := watchedFile{size: info.Size(), modTime: info.ModTime()}
+			before, ok := w.seen[p]
+			w.seen[p] = now
+			if !ok || before != now || time.Since(now.modTime) < watchSettle {
+				continue
+			}
+			w.ingest(db, f, p)
+			delete(w.seen, p)
+		}
+	}
+	for p := range w.seen {
+		if !stillThere[p] {
+			delete(w.seen, p)
+		}
+	}
+	return nil
+}
+
+// imports the file at p into f's album and moves it out of the way
+func (w *watcher) ingest(db *sql.DB, f watchFolder, p string) {
+	err := func() error {
+		if !importExtensions[strings.ToLower(filepath.Ext(p))] {
+			return errors.New("not a photo")
+		}
+		var albumID int64
+		err := inTx(db, func(tx *sql.Tx) (err error) {
+			albumID, err = f.album(tx)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		src, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, _, err = addPhoto(albumID, f.userID, filepath.Base(p), src, db)
+		return err
+	}()
+
+	dest := watchProcessed
+	if err != nil {
+		log.Printf("failed to import %s: %s", p, err)
+		dest = watchFailed
+	}
+	moved, moveErr := moveAside(p, filepath.Join(f.path, dest))
+	if moveErr != nil {
+		log.Printf("failed to move %s to %s: %s", p, dest, moveErr)
+		return
+	}
+	if err != nil {
+		if writeErr := os.WriteFile(moved+".error", []byte(err.Error()+"\n"), 0600); writeErr != nil {
+			log.Printf("failed to write why %s failed: %s", moved, writeErr)
+		}
+	}
+}
+
+// moves the file at p into dir, numbering it if dir already has a file of that name, and returns where it went
+func moveAside(p string, dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	name := filepath.Base(p)
+	ext := filepath.Ext(name)
+	dst := filepath.Join(dir, name)
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(dst); os.IsNotExist(err) {
+			break
+		}
+		dst = filepath.Join(dir, fmt.Sprintf("%s-%v%s", strings.TrimSuffix(name, ext), i, ext))
+	}
+	return dst, os.Rename(p, dst)
+}
+
+// startWatcher looks at the watch folders every interval until the program exits
+func startWatcher(db *sql.DB, interval time.Duration) {
+	w := newWatcher()
+	go func() {
+		for {
+			if err := w.scan(db); err != nil {
+				log.Printf("failed to scan watch folders: %s", err)
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// watch add -user email [-album id] <dir> starts watching a folder, watch remove <dir> stops, and watch list lists
+// the folders being watched
+func watchCommand(args []string, db *sql.DB) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: watch add|remove|list")
+	}
+	fs := flag.NewFlagSet("watch "+args[0], flag.ExitOnError)
+	email := fs.String("user", "", "email of the user photos are imported for")
+	albumID := fs.Int64("album", 0, "album to import into, defaults to the user's first album")
+	fs.Parse(args[1:])
+
+	switch args[0] {
+	case "add":
+		if *email == "" || fs.NArg() != 1 {
+			return fmt.Errorf("usage: watch add -user email [-album id] <dir>")
+		}
+		userID, _, err := store.UserByEmail(*email)
+		if err != nil {
+			return fmt.Errorf("failed to find user %s: %w", *email, err)
+		}
+		return inTx(db, func(tx *sql.Tx) error { return addWatchFolder(userID, *albumID, fs.Arg(0), tx) })
+	case "remove":
+		if fs.NArg() != 1 {
+			return fmt.Errorf("usage: watch remove <dir>")
+		}
+		abs, err := filepath.Abs(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		res, err := db.Exec("DELETE FROM watch_folders WHERE path = ?", abs)
+		if err != nil {
+			return fmt.Errorf("failed to stop watching %s: %w", abs, err)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return fmt.Errorf("%s isn't being watched", abs)
+		}
+		return nil
+	case "list":
+		folders, err := listWatchFolders(db)
+		if err != nil {
+			return err
+		}
+		for _, f := range folders {
+			album := "first album"
+			if f.albumID.Valid {
+				album = "album " + strconv.FormatInt(f.albumID.Int64, 10)
+			}
+			fmt.Printf("%s\tuser %v\t%s\n", f.path, f.userID, album)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown watch command %q", args[0])
+	}
+}